@@ -0,0 +1,139 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/liujed/goutil/optionals"
+)
+
+// A weekly window during which an account can be used.
+type ActiveHoursWindow struct {
+	// The days of the week on which the window starts, e.g., `mon`, or ranges of
+	// days, e.g., `mon-fri`. Optional. If omitted, then the window starts on
+	// every day.
+	Days []string `json:"days,omitempty"`
+
+	// The time of day at which the window starts and ends, in 24-hour `HH:MM`
+	// format. If the end is not after the start, then the window ends on the
+	// following day, e.g., `22:00` to `06:00`.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// The IANA time zone in which the window is given, e.g., `Europe/London`.
+	// Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	// The provisioned versions of the above.
+	days     [7]bool
+	startMin int
+	endMin   int
+	location *time.Location
+}
+
+// The default for [Handler.ExpiryWarning].
+const defaultExpiryWarning = 14 * 24 * time.Hour
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (w *ActiveHoursWindow) provision() error {
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, daysRaw := range w.Days {
+		firstRaw, lastRaw, isRange := strings.Cut(strings.ToLower(daysRaw), "-")
+		if !isRange {
+			lastRaw = firstRaw
+		}
+		first, ok := weekdayNames[firstRaw]
+		if !ok {
+			return fmt.Errorf("invalid day of the week: %q", daysRaw)
+		}
+		last, ok := weekdayNames[lastRaw]
+		if !ok {
+			return fmt.Errorf("invalid day of the week: %q", daysRaw)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	var err error
+	w.startMin, err = parseTimeOfDay(w.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start time: %w", err)
+	}
+	w.endMin, err = parseTimeOfDay(w.End)
+	if err != nil {
+		return fmt.Errorf("invalid end time: %w", err)
+	}
+
+	w.location = time.UTC
+	if w.Timezone != "" {
+		w.location, err = time.LoadLocation(w.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone: %w", err)
+		}
+	}
+	return nil
+}
+
+// Parses a time of day in `HH:MM` format into minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Determines whether the given time falls within the window.
+func (w *ActiveHoursWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+
+	if w.startMin < w.endMin {
+		return w.days[day] && w.startMin <= minute && minute < w.endMin
+	}
+
+	// The window wraps past midnight.
+	yesterday := (day + 6) % 7
+	return (w.days[day] && minute >= w.startMin) ||
+		(w.days[yesterday] && minute < w.endMin)
+}
+
+// Checks whether the account can be used at the given time. Returns None if
+// so. Otherwise, returns the reason for denial.
+func (c *ClientPolicy) checkLifecycle(now time.Time) optionals.Optional[DenyReason] {
+	if c.Disabled {
+		return optionals.Some(DenyAccountDisabled)
+	}
+	if c.NotBefore != nil && now.Before(*c.NotBefore) {
+		return optionals.Some(DenyAccountNotYetValid)
+	}
+	if c.NotAfter != nil && !now.Before(*c.NotAfter) {
+		return optionals.Some(DenyAccountExpired)
+	}
+	if len(c.ActiveHours) == 0 {
+		return optionals.None[DenyReason]()
+	}
+	for i := range c.ActiveHours {
+		if c.ActiveHours[i].contains(now) {
+			return optionals.None[DenyReason]()
+		}
+	}
+	return optionals.Some(DenyOutsideActiveHours)
+}
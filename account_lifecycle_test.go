@@ -0,0 +1,135 @@
+package caddydns01proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liujed/goutil/optionals"
+)
+
+// Returns the given time on Monday, 2 March 2026, in UTC.
+func onMonday(hour, minute int) time.Time {
+	return time.Date(2026, time.March, 2, hour, minute, 0, 0, time.UTC)
+}
+
+func TestCheckLifecycle(t *testing.T) {
+	now := onMonday(12, 0)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	for _, test := range []struct {
+		name   string
+		policy ClientPolicy
+		want   optionals.Optional[DenyReason]
+	}{
+		{"no restrictions", ClientPolicy{}, optionals.None[DenyReason]()},
+		{"disabled", ClientPolicy{Disabled: true, NotAfter: &future}, optionals.Some(DenyAccountDisabled)},
+		{"not yet valid", ClientPolicy{NotBefore: &future}, optionals.Some(DenyAccountNotYetValid)},
+		{"valid", ClientPolicy{NotBefore: &past, NotAfter: &future}, optionals.None[DenyReason]()},
+		{"expired", ClientPolicy{NotAfter: &past}, optionals.Some(DenyAccountExpired)},
+		{"expires now", ClientPolicy{NotAfter: &now}, optionals.Some(DenyAccountExpired)},
+	} {
+		gotReason, gotDenied := test.policy.checkLifecycle(now).Get()
+		wantReason, wantDenied := test.want.Get()
+		if gotDenied != wantDenied || gotReason != wantReason {
+			t.Errorf("%s: got deny reason %q (%v), want %q (%v)",
+				test.name, gotReason, gotDenied, wantReason, wantDenied)
+		}
+	}
+}
+
+func TestCheckLifecycleActiveHours(t *testing.T) {
+	policy := ClientPolicy{ActiveHours: []ActiveHoursWindow{
+		{Days: []string{"mon-fri"}, Start: "09:00", End: "17:00"},
+		{Days: []string{"sat"}, Start: "10:00", End: "12:00"},
+	}}
+	for i := range policy.ActiveHours {
+		if err := policy.ActiveHours[i].provision(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for when, want := range map[time.Time]optionals.Optional[DenyReason]{
+		onMonday(9, 0):                   optionals.None[DenyReason](),
+		onMonday(16, 59):                 optionals.None[DenyReason](),
+		onMonday(17, 0):                  optionals.Some(DenyOutsideActiveHours),
+		onMonday(8, 59):                  optionals.Some(DenyOutsideActiveHours),
+		onMonday(11, 0).AddDate(0, 0, 5): optionals.None[DenyReason](),           // Saturday.
+		onMonday(13, 0).AddDate(0, 0, 5): optionals.Some(DenyOutsideActiveHours), // Saturday.
+		onMonday(11, 0).AddDate(0, 0, 6): optionals.Some(DenyOutsideActiveHours), // Sunday.
+	} {
+		gotReason, gotDenied := policy.checkLifecycle(when).Get()
+		wantReason, wantDenied := want.Get()
+		if gotDenied != wantDenied || gotReason != wantReason {
+			t.Errorf("%s: got deny reason %q (%v), want %q (%v)",
+				when, gotReason, gotDenied, wantReason, wantDenied)
+		}
+	}
+}
+
+func TestAuthorizeLifecycle(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	registry := newTestRegistry(t, []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID:          "alice",
+			AllowDomainsRaw: []string{"*.example.com"},
+			NotAfter:        &past,
+		},
+	}}, nil)
+
+	req := authedRequest("alice", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "www.example.com", optionals.Some(DenyAccountExpired))
+
+	// Cleanups are still allowed, so that records aren't left behind.
+	req.URL.Path = "/cleanup"
+	expectAuthorization(t, registry, req, "www.example.com", optionals.None[DenyReason]())
+	expectAuthorization(t, registry, req, "example.org", optionals.Some(DenyDomainNotAllowed))
+}
+
+func TestActiveHoursWindowContains(t *testing.T) {
+	// An overnight window that starts on Fridays through Mondays, wrapping past
+	// the end of the week.
+	overnight := ActiveHoursWindow{
+		Days:  []string{"fri-mon"},
+		Start: "22:00",
+		End:   "06:00",
+	}
+	if err := overnight.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for when, want := range map[time.Time]bool{
+		onMonday(23, 0):                  true,
+		onMonday(5, 59):                  true, // Started on Sunday.
+		onMonday(6, 0):                   false,
+		onMonday(23, 0).AddDate(0, 0, 1): false, // Tuesday.
+		onMonday(3, 0).AddDate(0, 0, 1):  true,  // Started on Monday.
+		onMonday(3, 0).AddDate(0, 0, 2):  false, // Wednesday.
+	} {
+		if got := overnight.contains(when); got != want {
+			t.Errorf("%s: got %v, want %v", when, got, want)
+		}
+	}
+
+	// Windows are evaluated in their own time zone.
+	tokyo := ActiveHoursWindow{Start: "09:00", End: "17:00", Timezone: "Asia/Tokyo"}
+	if err := tokyo.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if !tokyo.contains(onMonday(1, 0)) || tokyo.contains(onMonday(12, 0)) {
+		t.Error("time zone not applied")
+	}
+}
+
+func TestActiveHoursWindowConfigErrors(t *testing.T) {
+	for name, window := range map[string]ActiveHoursWindow{
+		"bad day":       {Days: []string{"someday"}, Start: "09:00", End: "17:00"},
+		"bad range":     {Days: []string{"mon-xyz"}, Start: "09:00", End: "17:00"},
+		"bad start":     {Start: "9am", End: "17:00"},
+		"bad end":       {Start: "09:00", End: "24:30"},
+		"bad time zone": {Start: "09:00", End: "17:00", Timezone: "Mars/Olympus"},
+	} {
+		if err := window.provision(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -27,6 +27,9 @@ type App struct {
 	Hostnames []string `json:"hostnames"`
 
 	// The sockets on which to listen. For example, "127.0.0.1:9095" or ":443".
+	// Unix sockets, such as "unix//run/dns01proxy.sock|0660", are served over
+	// plain HTTP, and clients connecting to them can be authenticated by their
+	// UID or GID (see [RawAccount.PeerUIDs]).
 	Listen []string `json:"listen"`
 
 	// Configures the set of trusted proxies, for accurate logging of client IP
@@ -51,31 +54,74 @@ func (App) CaddyModule() caddy.ModuleInfo {
 }
 
 func (app *App) Provision(ctx caddy.Context) error {
+	// Identity headers are only accepted from trusted proxies, so without any,
+	// header authentication would reject everyone.
+	if app.HeaderAuth != nil && len(app.TrustedProxiesRaw) == 0 {
+		return fmt.Errorf("header authentication requires trusted proxies")
+	}
+
+	// Unix sockets get a separate server, without TLS. Each server gets its own
+	// handler, but the handlers' limits, circuit breaker and caches are pooled,
+	// so the servers enforce them together.
+	var netListen, unixListen []string
+	for _, listen := range app.Listen {
+		addr, err := caddy.ParseNetworkAddress(listen)
+		if err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", listen, err)
+		}
+		if addr.IsUnixNetwork() {
+			unixListen = append(unixListen, listen)
+		} else {
+			netListen = append(netListen, listen)
+		}
+	}
+
+	servers := map[string]*caddyhttp.Server{}
+	if len(netListen) > 0 {
+		servers["dns01proxy"] = &caddyhttp.Server{
+			Listen:            netListen,
+			Routes:            app.makeRoutes(true),
+			TrustedProxiesRaw: app.TrustedProxiesRaw,
+
+			// Turn off HTTP-to-HTTPS redirection. It masks insecure client
+			// configurations.
+			AutoHTTPS: &caddyhttp.AutoHTTPSConfig{
+				DisableRedir: true,
+			},
+
+			// Turns on logging.
+			Logs: &caddyhttp.ServerLogConfig{},
+
+			// Turns on TLS.
+			TLSConnPolicies: caddytls.ConnectionPolicies{
+				&caddytls.ConnectionPolicy{
+					ClientAuthentication: app.makeClientAuthentication(),
+				},
+			},
+		}
+	}
+	if len(unixListen) > 0 {
+		servers["dns01proxy_unix"] = &caddyhttp.Server{
+			Listen: unixListen,
+
+			// Clients on Unix sockets don't necessarily send one of our hostnames.
+			Routes: app.makeRoutes(false),
+
+			// The socket's file permissions protect it, so TLS is not needed.
+			AutoHTTPS: &caddyhttp.AutoHTTPSConfig{
+				Disabled: true,
+			},
+
+			// Turns on logging.
+			Logs: &caddyhttp.ServerLogConfig{},
+		}
+	}
+
 	module, err := ctx.LoadModuleByID(
 		"http",
 		caddyconfig.JSON(
 			caddyhttp.App{
-				Servers: map[string]*caddyhttp.Server{
-					"dns01proxy": {
-						Listen:            app.Listen,
-						Routes:            app.makeRoutes(),
-						TrustedProxiesRaw: app.TrustedProxiesRaw,
-
-						// Turn off HTTP-to-HTTPS redirection. It masks insecure client
-						// configurations.
-						AutoHTTPS: &caddyhttp.AutoHTTPSConfig{
-							DisableRedir: true,
-						},
-
-						// Turns on logging.
-						Logs: &caddyhttp.ServerLogConfig{},
-
-						// Turns on TLS.
-						TLSConnPolicies: caddytls.ConnectionPolicies{
-							&caddytls.ConnectionPolicy{},
-						},
-					},
-				},
+				Servers: servers,
 			},
 			nil,
 		),
@@ -88,6 +134,28 @@ func (app *App) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// Returns the TLS client authentication configuration for the server. Returns
+// nil if client certificates are not used.
+func (app *App) makeClientAuthentication() *caddytls.ClientAuthentication {
+	if app.ClientCertAuth == nil {
+		return nil
+	}
+
+	// Ask clients for a certificate, and verify it if given. Clients without a
+	// certificate can still authenticate by other means.
+	return &caddytls.ClientAuthentication{
+		CARaw: caddyconfig.JSONModuleObject(
+			caddytls.FileCAPool{
+				TrustedCACertPEMFiles: app.ClientCertAuth.TrustedCACertPEMFiles,
+			},
+			"provider",
+			"file",
+			nil,
+		),
+		Mode: "verify_if_given",
+	}
+}
+
 func (app *App) Start() error {
 	return app.httpApp.Start()
 }
@@ -96,17 +164,24 @@ func (app *App) Stop() error {
 	return app.httpApp.Stop()
 }
 
-func (app *App) makeRoutes() caddyhttp.RouteList {
+// Returns the server's routes. If matchHosts is true, then only requests for
+// the server's hostnames are handled.
+func (app *App) makeRoutes(matchHosts bool) caddyhttp.RouteList {
+	var matcherSets caddyhttp.RawMatcherSets
+	if matchHosts {
+		matcherSets = caddyhttp.RawMatcherSets{
+			{
+				"host": caddyconfig.JSON(
+					app.Hostnames,
+					nil,
+				),
+			},
+		}
+	}
+
 	return caddyhttp.RouteList{
 		{
-			MatcherSetsRaw: caddyhttp.RawMatcherSets{
-				{
-					"host": caddyconfig.JSON(
-						app.Hostnames,
-						nil,
-					),
-				},
-			},
+			MatcherSetsRaw: matcherSets,
 			HandlersRaw: []json.RawMessage{
 				caddyconfig.JSONModuleObject(
 					app.Handler,
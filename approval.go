@@ -0,0 +1,358 @@
+package caddydns01proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/liujed/goutil/optionals"
+	x509policy "github.com/smallstep/certificates/authority/policy"
+	"go.uber.org/zap"
+)
+
+// Requires an operator to approve requests to present records for sensitive
+// domains. Such requests are answered with HTTP 503 and a `Retry-After` header
+// until an approver approves or rejects them through the `/approvals`
+// endpoints, so clients never hold a connection open while waiting. The status
+// is not a 2xx, because ACME clients take any 2xx as the record having been
+// presented, and would have the CA validate a record that doesn't exist. Once
+// approved, the user can present records at the challenge domain until the
+// approval expires. Requests that aren't decided in time are denied.
+type ApprovalConfig struct {
+	// Domains that require approval. These follow the same rules as
+	// [ClientPolicy.AllowDomainsRaw]. Optional.
+	Domains []string `json:"domains,omitempty"`
+
+	// Regular expressions for domains that require approval, e.g., `login\..*`.
+	// Each pattern must match the whole domain, in lowercase and without a
+	// trailing dot. Optional.
+	Patterns []string `json:"patterns,omitempty"`
+
+	// Whether the apex of each DNS zone requires approval.
+	ZoneApex bool `json:"zone_apex,omitempty"`
+
+	// The user IDs that can approve and reject requests. Users can't decide
+	// their own requests.
+	Approvers []string `json:"approvers"`
+
+	// How long a request waits for a decision before it is denied, and how long
+	// a decision lasts once made. Defaults to 15m.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+const (
+	defaultApprovalTimeout = 15 * time.Minute
+
+	// How long clients are told to wait before retrying a request that is
+	// awaiting approval.
+	approvalRetryAfter = 30 * time.Second
+
+	// The response header that gives the ID of a request that is awaiting
+	// approval, so that the user can point an approver at it.
+	approvalIDHeader = "X-Approval-Id"
+)
+
+// A request that is waiting for approval, as listed by the `/approvals`
+// endpoint.
+type PendingApproval struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	FQDN        string    `json:"fqdn"`
+	Zone        string    `json:"zone"`
+	ClientIP    string    `json:"client_ip"`
+	RequestedAt time.Time `json:"requested_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// The body of a request to approve or reject a pending request.
+type ApprovalDecisionRequest struct {
+	// Identifies the pending request.
+	ID string `json:"id"`
+
+	// Logged with the decision. Optional.
+	Comment string `json:"comment,omitempty"`
+}
+
+// The outcomes of pending requests, as logged.
+const (
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalTimedOut = "timed_out"
+)
+
+// Requests for approval, shared across configuration reloads, so that requests
+// made under an old configuration can be decided under the new one.
+var approvals = &approvalQueue{
+	entries: map[approvalKey]*approvalEntry{},
+}
+
+type approvalQueue struct {
+	mu      sync.Mutex
+	entries map[approvalKey]*approvalEntry
+}
+
+// Approval is given to a user for a challenge domain, so that retries, and
+// other challenges at the same domain, share one decision.
+type approvalKey struct {
+	user string
+	fqdn string
+}
+
+type approvalEntry struct {
+	info PendingApproval
+
+	// The decision, or empty while the request is pending.
+	outcome  string
+	approver string
+
+	// When the entry is forgotten. For pending requests, this is when they time
+	// out.
+	expires time.Time
+}
+
+// The provisioned form of an ApprovalConfig.
+type approvalGate struct {
+	config   ApprovalConfig
+	domains  x509policy.X509Policy
+	patterns *domainPatterns
+	logger   *zap.Logger
+}
+
+func (c *ApprovalConfig) provision(logger *zap.Logger) (*approvalGate, error) {
+	if len(c.Domains) == 0 && len(c.Patterns) == 0 && !c.ZoneApex {
+		return nil, fmt.Errorf("must configure domains, patterns or zone apexes")
+	}
+	if len(c.Approvers) == 0 {
+		return nil, fmt.Errorf("must configure at least one approver")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = caddy.Duration(defaultApprovalTimeout)
+	}
+
+	result := &approvalGate{config: *c, logger: logger}
+	var err error
+	if len(c.Domains) > 0 {
+		result.domains, err = newDomainPolicy(c.Domains, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to provision domains: %w", err)
+		}
+	}
+	result.patterns, err = newDomainPatterns(c.Patterns, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain pattern: %w", err)
+	}
+	return result, nil
+}
+
+// Determines whether presenting a record for the given domain, in the given
+// zone, requires approval.
+func (g *approvalGate) required(domain string, zone string) bool {
+	if g.config.ZoneApex && normalizeZone(domain) == normalizeZone(zone) {
+		return true
+	}
+	if g.domains != nil && g.domains.IsDNSAllowed(domain) == nil {
+		return true
+	}
+	if g.patterns != nil {
+		name := strings.ToLower(domain)
+		for _, re := range g.patterns.allow {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks whether the given request has been approved. Returns None if so. If
+// the request has not yet been decided, then returns DenyApprovalPending, and
+// the caller should tell the client to retry. The first such request is queued
+// for approval. Otherwise, returns the reason for denial. Also returns the ID
+// of the request for approval.
+func (g *approvalGate) check(
+	req *http.Request,
+	info PendingApproval,
+) (optionals.Optional[DenyReason], string, error) {
+	now := time.Now()
+	key := approvalKey{user: info.User, fqdn: strings.ToLower(info.FQDN)}
+
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+	g.expireLocked(now)
+
+	entry, exists := approvals.entries[key]
+	if !exists {
+		var idBytes [8]byte
+		_, err := rand.Read(idBytes[:])
+		if err != nil {
+			return optionals.Some(DenyError), "",
+				fmt.Errorf("unable to generate approval ID: %w", err)
+		}
+		info.ID = hex.EncodeToString(idBytes[:])
+		info.RequestedAt = now
+		info.ExpiresAt = now.Add(time.Duration(g.config.Timeout))
+		entry = &approvalEntry{info: info, expires: info.ExpiresAt}
+		approvals.entries[key] = entry
+
+		g.logger.Info(
+			"request awaiting approval",
+			zap.String("approval_id", info.ID),
+			zap.String("user_id", info.User),
+			zap.String("fqdn", info.FQDN),
+			zap.Time("expires_at", info.ExpiresAt),
+		)
+	}
+	id := entry.info.ID
+	addLogField(req, zap.String(logApprovalID, id))
+
+	switch entry.outcome {
+	case approvalApproved:
+		addLogField(req, zap.String(logApprover, entry.approver))
+		return optionals.None[DenyReason](), id, nil
+	case approvalRejected:
+		addLogField(req, zap.String(logApprover, entry.approver))
+		return optionals.Some(DenyApprovalRejected), id, nil
+	case approvalTimedOut:
+		return optionals.Some(DenyApprovalTimedOut), id, nil
+	}
+	return optionals.Some(DenyApprovalPending), id, nil
+}
+
+// Forgets expired decisions, and times out expired pending requests. Timed-out
+// requests are remembered for another timeout period, so that clients retrying
+// them learn that they timed out. Must be called with the queue's lock held.
+func (g *approvalGate) expireLocked(now time.Time) {
+	for key, entry := range approvals.entries {
+		if now.Before(entry.expires) {
+			continue
+		}
+		if entry.outcome != "" {
+			delete(approvals.entries, key)
+			continue
+		}
+		entry.outcome = approvalTimedOut
+		entry.expires = now.Add(time.Duration(g.config.Timeout))
+		g.logDecision(entry.info, approvalTimedOut, "", "")
+	}
+}
+
+func (g *approvalGate) logDecision(
+	info PendingApproval,
+	outcome string,
+	approver string,
+	comment string,
+) {
+	g.logger.Info(
+		"approval decision",
+		zap.String("approval_id", info.ID),
+		zap.String("user_id", info.User),
+		zap.String("fqdn", info.FQDN),
+		zap.String("decision", outcome),
+		zap.String("approver", approver),
+		zap.String("comment", comment),
+	)
+}
+
+// Checks that the authenticated user is an approver. Returns the user's ID if
+// so.
+func (g *approvalGate) authorizeApprover(req *http.Request) (string, bool, error) {
+	userID, err := authenticatedUserID(req)
+	if err != nil {
+		return "", false, err
+	}
+	if !slices.Contains(g.config.Approvers, userID) {
+		addLogField(req, zap.String(logAuthorizationFailure, string(DenyNotApprover)))
+		return userID, false, nil
+	}
+	return userID, true, nil
+}
+
+// Handles a request to list the pending requests.
+func (g *approvalGate) serveList(w http.ResponseWriter, req *http.Request) error {
+	_, ok, err := g.authorizeApprover(req)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	approvals.mu.Lock()
+	g.expireLocked(time.Now())
+	result := []PendingApproval{}
+	for _, entry := range approvals.entries {
+		if entry.outcome == "" {
+			result = append(result, entry.info)
+		}
+	}
+	approvals.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].RequestedAt.Before(result[j].RequestedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return fmt.Errorf("unable to write response body: %w", err)
+	}
+	return nil
+}
+
+// Returns a handler for requests to approve or reject a pending request.
+func (g *approvalGate) serveDecision(
+	approve bool,
+) func(*http.Request, ApprovalDecisionRequest, http.Header) (int, optionals.Optional[PendingApproval], error) {
+	return func(
+		req *http.Request,
+		reqBody ApprovalDecisionRequest,
+		respHeader http.Header,
+	) (int, optionals.Optional[PendingApproval], error) {
+		approver, ok, err := g.authorizeApprover(req)
+		if err != nil {
+			return 0, optionals.None[PendingApproval](), err
+		}
+		if !ok {
+			return http.StatusForbidden, optionals.None[PendingApproval](), nil
+		}
+		addLogField(req, zap.String(logApprovalID, reqBody.ID))
+
+		approvals.mu.Lock()
+		defer approvals.mu.Unlock()
+		now := time.Now()
+		g.expireLocked(now)
+		var entry *approvalEntry
+		for _, candidate := range approvals.entries {
+			if candidate.info.ID == reqBody.ID && candidate.outcome == "" {
+				entry = candidate
+				break
+			}
+		}
+		if entry == nil {
+			return http.StatusNotFound, optionals.None[PendingApproval](), nil
+		}
+		if entry.info.User == approver {
+			addLogField(req, zap.String(logAuthorizationFailure, string(DenySelfApproval)))
+			return http.StatusForbidden, optionals.None[PendingApproval](), nil
+		}
+
+		// Each request is decided only once. The decision lasts for a timeout
+		// period, during which the user's retries pick it up.
+		entry.outcome = approvalRejected
+		if approve {
+			entry.outcome = approvalApproved
+		}
+		entry.approver = approver
+		entry.expires = now.Add(time.Duration(g.config.Timeout))
+		g.logDecision(entry.info, entry.outcome, approver, reqBody.Comment)
+		return http.StatusOK, optionals.Some(entry.info), nil
+	}
+}
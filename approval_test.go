@@ -0,0 +1,188 @@
+package caddydns01proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liujed/goutil/optionals"
+	"go.uber.org/zap"
+)
+
+func newTestApprovalGate(t *testing.T) *approvalGate {
+	t.Helper()
+	gate, err := (&ApprovalConfig{
+		Domains:   []string{"*.secure.example.com"},
+		Patterns:  []string{`login\..*`},
+		ZoneApex:  true,
+		Approvers: []string{"carol"},
+	}).provision(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests for approval are shared across configurations.
+	t.Cleanup(func() {
+		approvals.mu.Lock()
+		defer approvals.mu.Unlock()
+		clear(approvals.entries)
+	})
+	return gate
+}
+
+// Checks whether alice's request to present a record at the given challenge
+// domain is approved.
+func checkApproval(
+	t *testing.T,
+	gate *approvalGate,
+	fqdn string,
+	want optionals.Optional[DenyReason],
+) string {
+	t.Helper()
+	got, id, err := gate.check(
+		authedRequest("alice", "192.0.2.1", nil),
+		PendingApproval{User: "alice", FQDN: fqdn, Zone: "example.com"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDenyReason(t, got, want)
+	return id
+}
+
+// Decides the given request for approval as the given user, and returns the
+// HTTP status.
+func decideApproval(gate *approvalGate, approver string, id string, approve bool) int {
+	status, _, _ := gate.serveDecision(approve)(
+		authedRequest(approver, "192.0.2.2", nil),
+		ApprovalDecisionRequest{ID: id, Comment: "ok"},
+		http.Header{},
+	)
+	return status
+}
+
+func TestApprovalRequired(t *testing.T) {
+	gate := newTestApprovalGate(t)
+	for domain, want := range map[string]bool{
+		"example.com":            true,
+		"www.secure.example.com": true,
+		"login.example.com":      true,
+		"LOGIN.example.com":      true,
+		"www.example.com":        false,
+		"xlogin.example.com":     false,
+		"secure.example.com":     false,
+		"www.login.example.com":  false,
+	} {
+		if got := gate.required(domain, "example.com."); got != want {
+			t.Errorf("%s: got %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestApprovalApproved(t *testing.T) {
+	gate := newTestApprovalGate(t)
+	fqdn := "_acme-challenge.login.example.com."
+
+	// The request is queued, and stays pending across retries.
+	id := checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalPending))
+	if again := checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalPending)); again != id {
+		t.Errorf("retry got approval ID %q, want %q", again, id)
+	}
+
+	// Approvers see the pending request.
+	w := httptest.NewRecorder()
+	if err := gate.serveList(w, authedRequest("carol", "192.0.2.2", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var pending []PendingApproval
+	if err := json.NewDecoder(w.Body).Decode(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != id || pending[0].User != "alice" {
+		t.Fatalf("got pending requests %+v", pending)
+	}
+
+	// Users can't decide their own requests, and only approvers can decide.
+	if status := decideApproval(gate, "alice", id, true); status != http.StatusForbidden {
+		t.Errorf("non-approver got HTTP %d", status)
+	}
+	if status := decideApproval(gate, "carol", "unknown", true); status != http.StatusNotFound {
+		t.Errorf("unknown ID got HTTP %d", status)
+	}
+	if status := decideApproval(gate, "carol", id, true); status != http.StatusOK {
+		t.Fatalf("approval got HTTP %d", status)
+	}
+
+	// Each request is decided only once.
+	if status := decideApproval(gate, "carol", id, false); status != http.StatusNotFound {
+		t.Errorf("second decision got HTTP %d", status)
+	}
+
+	// The approval covers retries, including with other challenge values.
+	checkApproval(t, gate, fqdn, optionals.None[DenyReason]())
+	checkApproval(t, gate, fqdn, optionals.None[DenyReason]())
+
+	// Other domains need their own approval.
+	checkApproval(t, gate, "_acme-challenge.example.com.", optionals.Some(DenyApprovalPending))
+}
+
+func TestApprovalRejected(t *testing.T) {
+	gate := newTestApprovalGate(t)
+	fqdn := "_acme-challenge.login.example.com."
+
+	id := checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalPending))
+	if status := decideApproval(gate, "carol", id, false); status != http.StatusOK {
+		t.Fatalf("rejection got HTTP %d", status)
+	}
+	checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalRejected))
+}
+
+func TestApprovalExpiry(t *testing.T) {
+	gate := newTestApprovalGate(t)
+	fqdn := "_acme-challenge.login.example.com."
+	expire := func() {
+		approvals.mu.Lock()
+		defer approvals.mu.Unlock()
+		for _, entry := range approvals.entries {
+			entry.expires = time.Now().Add(-time.Second)
+		}
+	}
+
+	// Undecided requests time out, and retries are told so for a while.
+	id := checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalPending))
+	expire()
+	checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalTimedOut))
+	if status := decideApproval(gate, "carol", id, true); status != http.StatusNotFound {
+		t.Errorf("deciding a timed-out request got HTTP %d", status)
+	}
+
+	// Afterwards, a new request for approval is made.
+	expire()
+	newID := checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalPending))
+	if newID == id {
+		t.Error("timed-out request reused")
+	}
+
+	// Approvals expire too.
+	if status := decideApproval(gate, "carol", newID, true); status != http.StatusOK {
+		t.Fatalf("approval got HTTP %d", status)
+	}
+	checkApproval(t, gate, fqdn, optionals.None[DenyReason]())
+	expire()
+	checkApproval(t, gate, fqdn, optionals.Some(DenyApprovalPending))
+}
+
+func TestApprovalConfigErrors(t *testing.T) {
+	for name, config := range map[string]ApprovalConfig{
+		"no domains":   {Approvers: []string{"carol"}},
+		"no approvers": {ZoneApex: true},
+		"bad domain":   {Domains: []string{"*.*.example.com"}, Approvers: []string{"carol"}},
+		"bad pattern":  {Patterns: []string{`login(`}, Approvers: []string{"carol"}},
+	} {
+		if _, err := config.provision(zap.NewNop()); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
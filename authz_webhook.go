@@ -0,0 +1,308 @@
+package caddydns01proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/liujed/goutil/optionals"
+	"go.uber.org/zap"
+)
+
+// Configures an external policy service that makes the final authorization
+// decision for each request, after the local policies have allowed it. Cleanups
+// are sent to the service too, but its denials of them are only logged unless
+// [EnforceOnCleanup] is set, so that an outage or a changed decision can't
+// strand records.
+//
+// The service receives a POST request with a JSON body of the form
+//
+//	{"user": "...", "fqdn": "...", "domain": "...", "zone": "...",
+//	 "client_ip": "...", "mode": "present"|"cleanup"}
+//
+// and must respond with HTTP 200 and a JSON body of the form
+//
+//	{"allow": true|false, "reason": "..."}
+//
+// where `reason` is optional and is logged for denials.
+type AuthzWebhookConfig struct {
+	// The URL to which authorization requests are sent.
+	URL string `json:"url"`
+
+	// Headers to send with each authorization request, e.g., for authenticating
+	// to the policy service. Optional. Placeholders such as `{env.*}` and
+	// `{file.*}` are expanded.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// How long to wait for the policy service. Defaults to 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How long to cache decisions. Optional. If omitted, then decisions are not
+	// cached. Failures are never cached.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// Whether to allow requests when the policy service fails or can't be
+	// reached. Defaults to false, meaning that such requests are denied.
+	FailOpen bool `json:"fail_open,omitempty"`
+
+	// Whether the service's denials of cleanups, including denials because the
+	// service failed, are enforced. Defaults to false, meaning that such denials
+	// are logged, and the cleanups go ahead.
+	EnforceOnCleanup bool `json:"enforce_on_cleanup,omitempty"`
+}
+
+const (
+	defaultAuthzWebhookTimeout = 5 * time.Second
+
+	// The largest response body that is read from the policy service.
+	maxAuthzWebhookResponseSize = 64 << 10
+
+	// When the decision cache has more than this many entries, expired entries
+	// are removed.
+	authzWebhookCacheSweepThreshold = 10000
+)
+
+// The body of a request to the policy service.
+type authzWebhookRequest struct {
+	User     string      `json:"user"`
+	FQDN     string      `json:"fqdn"`
+	Domain   string      `json:"domain"`
+	Zone     string      `json:"zone"`
+	ClientIP string      `json:"client_ip"`
+	Mode     handlerMode `json:"mode"`
+}
+
+// The body of a response from the policy service.
+type authzWebhookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Consults the policy service. Safe for concurrent use.
+type authzWebhook struct {
+	config  AuthzWebhookConfig
+	headers http.Header
+	client  *http.Client
+
+	// Shared by all webhooks for the same policy service. Nil if decisions are
+	// not cached.
+	cache *authzDecisionCache
+
+	logger *zap.Logger
+}
+
+// Holds the decision caches, keyed by the policy service's URL, headers and
+// cache TTL, so that handlers consulting the same service, such as those
+// serving the dns01proxy app's network and Unix socket listeners, share cached
+// decisions.
+var authzDecisionCachePool = caddy.NewUsagePool()
+
+// Caches the policy service's decisions. Safe for concurrent use.
+type authzDecisionCache struct {
+	// The key under which this is held in authzDecisionCachePool.
+	poolKey string
+
+	mu      sync.Mutex
+	entries map[authzWebhookRequest]authzWebhookCacheEntry
+}
+
+var _ caddy.Destructor = (*authzDecisionCache)(nil)
+
+func (c *authzDecisionCache) Destruct() error {
+	return nil
+}
+
+type authzWebhookCacheEntry struct {
+	response authzWebhookResponse
+	expires  time.Time
+}
+
+func (c *AuthzWebhookConfig) provision(logger *zap.Logger) (*authzWebhook, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("must configure a URL")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = caddy.Duration(defaultAuthzWebhookTimeout)
+	}
+
+	repl := caddy.NewReplacer()
+	headers := http.Header{}
+	for name, value := range c.Headers {
+		value, err := repl.ReplaceOrErr(value, true, true)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve header %q: %w", name, err)
+		}
+		headers.Set(name, value)
+	}
+
+	result := &authzWebhook{
+		config:  *c,
+		headers: headers,
+		client:  &http.Client{Timeout: time.Duration(c.Timeout)},
+		logger:  logger,
+	}
+	if c.CacheTTL > 0 {
+		poolKey, err := json.Marshal([]any{c.URL, headers, c.CacheTTL})
+		if err != nil {
+			return nil, fmt.Errorf("unable to build decision cache key: %w", err)
+		}
+		cache, _, err := authzDecisionCachePool.LoadOrNew(
+			string(poolKey),
+			func() (caddy.Destructor, error) {
+				return &authzDecisionCache{
+					poolKey: string(poolKey),
+					entries: map[authzWebhookRequest]authzWebhookCacheEntry{},
+				}, nil
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load decision cache: %w", err)
+		}
+		result.cache = cache.(*authzDecisionCache)
+	}
+	return result, nil
+}
+
+// Releases this webhook's reference to the shared decision cache.
+func (w *authzWebhook) release() error {
+	if w.cache == nil {
+		return nil
+	}
+	_, err := authzDecisionCachePool.Delete(w.cache.poolKey)
+	return err
+}
+
+// Asks the policy service whether the given request is allowed. Returns None if
+// so. Otherwise, returns the reason for denial and the reason given by the
+// policy service, if any.
+func (w *authzWebhook) authorize(
+	ctx context.Context,
+	input authzWebhookRequest,
+) (optionals.Optional[DenyReason], string) {
+	now := time.Now()
+	response, cached := w.cached(input, now)
+	if !cached {
+		var err error
+		response, err = w.call(ctx, input)
+		if err != nil {
+			w.logger.Error(
+				"authorization webhook failed",
+				zap.String("user_id", input.User),
+				zap.Bool("fail_open", w.config.FailOpen),
+				zap.Error(err),
+			)
+			if w.config.FailOpen {
+				return optionals.None[DenyReason](), ""
+			}
+			return optionals.Some(DenyWebhookUnavailable), ""
+		}
+		w.store(input, response, now)
+	}
+
+	if !response.Allow {
+		return optionals.Some(DenyWebhook), response.Reason
+	}
+	return optionals.None[DenyReason](), ""
+}
+
+// Determines whether the service's denials are enforced for requests in the
+// given mode.
+func (w *authzWebhook) enforces(mode handlerMode) bool {
+	return mode != hmCleanup || w.config.EnforceOnCleanup
+}
+
+// Sends the given request to the policy service.
+func (w *authzWebhook) call(
+	ctx context.Context,
+	input authzWebhookRequest,
+) (authzWebhookResponse, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return authzWebhookResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		w.config.URL,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return authzWebhookResponse{}, err
+	}
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return authzWebhookResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return authzWebhookResponse{}, fmt.Errorf(
+			"got HTTP status %d",
+			resp.StatusCode,
+		)
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxAuthzWebhookResponseSize))
+	if err != nil {
+		return authzWebhookResponse{}, err
+	}
+	var result authzWebhookResponse
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return authzWebhookResponse{}, fmt.Errorf("unable to parse response: %w", err)
+	}
+	return result, nil
+}
+
+// Returns the cached decision for the given request, if any.
+func (w *authzWebhook) cached(
+	input authzWebhookRequest,
+	now time.Time,
+) (authzWebhookResponse, bool) {
+	if w.cache == nil {
+		return authzWebhookResponse{}, false
+	}
+
+	w.cache.mu.Lock()
+	defer w.cache.mu.Unlock()
+	entry, exists := w.cache.entries[input]
+	if !exists || !now.Before(entry.expires) {
+		return authzWebhookResponse{}, false
+	}
+	return entry.response, true
+}
+
+// Caches the given decision.
+func (w *authzWebhook) store(
+	input authzWebhookRequest,
+	response authzWebhookResponse,
+	now time.Time,
+) {
+	if w.cache == nil {
+		return
+	}
+
+	w.cache.mu.Lock()
+	defer w.cache.mu.Unlock()
+	if len(w.cache.entries) > authzWebhookCacheSweepThreshold {
+		for key, entry := range w.cache.entries {
+			if !now.Before(entry.expires) {
+				delete(w.cache.entries, key)
+			}
+		}
+	}
+	w.cache.entries[input] = authzWebhookCacheEntry{
+		response: response,
+		expires:  now.Add(time.Duration(w.config.CacheTTL)),
+	}
+}
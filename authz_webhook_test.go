@@ -0,0 +1,250 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/liujed/goutil/optionals"
+	"go.uber.org/zap"
+)
+
+var testAuthzWebhookRequest = authzWebhookRequest{
+	User:     "alice",
+	FQDN:     "_acme-challenge.www.example.com.",
+	Domain:   "www.example.com",
+	Zone:     "example.com",
+	ClientIP: "192.0.2.1",
+	Mode:     hmPresent,
+}
+
+// Starts a policy service that answers with the given handler, and returns a
+// webhook for it along with a count of the calls made to the service.
+func newTestAuthzWebhook(
+	t *testing.T,
+	config AuthzWebhookConfig,
+	handler http.HandlerFunc,
+) (*authzWebhook, *atomic.Int32) {
+	t.Helper()
+	calls := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			handler(w, r)
+		},
+	))
+	t.Cleanup(server.Close)
+
+	config.URL = server.URL
+	webhook, err := config.provision(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { webhook.release() })
+	return webhook, calls
+}
+
+// Returns a handler that responds with the given decision.
+func respondWith(response authzWebhookResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func TestAuthzWebhookAllow(t *testing.T) {
+	webhook, _ := newTestAuthzWebhook(
+		t,
+		AuthzWebhookConfig{Headers: map[string]string{"Authorization": "Bearer secret"}},
+		func(w http.ResponseWriter, r *http.Request) {
+			var input authzWebhookRequest
+			err := json.NewDecoder(r.Body).Decode(&input)
+			if err != nil || input != testAuthzWebhookRequest {
+				t.Errorf("got request %+v, error %v", input, err)
+			}
+			if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+				t.Errorf("got Authorization header %q", got)
+			}
+			respondWith(authzWebhookResponse{Allow: true})(w, r)
+		},
+	)
+
+	got, reason := webhook.authorize(context.Background(), testAuthzWebhookRequest)
+	expectDenyReason(t, got, optionals.None[DenyReason]())
+	if reason != "" {
+		t.Errorf("got reason %q for an allowed request", reason)
+	}
+}
+
+func TestAuthzWebhookDeny(t *testing.T) {
+	webhook, _ := newTestAuthzWebhook(
+		t,
+		AuthzWebhookConfig{},
+		respondWith(authzWebhookResponse{Reason: "change freeze"}),
+	)
+
+	got, reason := webhook.authorize(context.Background(), testAuthzWebhookRequest)
+	expectDenyReason(t, got, optionals.Some(DenyWebhook))
+	if reason != "change freeze" {
+		t.Errorf("got reason %q, want %q", reason, "change freeze")
+	}
+}
+
+func TestAuthzWebhookFailures(t *testing.T) {
+	// Unblocks the slow policy services so that they can be shut down.
+	release := make(chan struct{})
+	defer close(release)
+
+	failures := map[string]http.HandlerFunc{
+		"timeout": func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		},
+		"error status": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "oops", http.StatusInternalServerError)
+		},
+		"bad response": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("allow"))
+		},
+	}
+	for name, handler := range failures {
+		for _, failOpen := range []bool{false, true} {
+			webhook, _ := newTestAuthzWebhook(
+				t,
+				AuthzWebhookConfig{
+					Timeout:  caddy.Duration(50 * time.Millisecond),
+					FailOpen: failOpen,
+				},
+				handler,
+			)
+
+			want := optionals.Some(DenyWebhookUnavailable)
+			if failOpen {
+				want = optionals.None[DenyReason]()
+			}
+			got, _ := webhook.authorize(context.Background(), testAuthzWebhookRequest)
+			gotReason, gotDenied := got.Get()
+			wantReason, wantDenied := want.Get()
+			if gotDenied != wantDenied || gotReason != wantReason {
+				t.Errorf("%s, fail open %v: got deny reason %q (%v)",
+					name, failOpen, gotReason, gotDenied)
+			}
+		}
+	}
+}
+
+func TestAuthzWebhookCache(t *testing.T) {
+	webhook, calls := newTestAuthzWebhook(
+		t,
+		AuthzWebhookConfig{CacheTTL: caddy.Duration(time.Minute)},
+		respondWith(authzWebhookResponse{Allow: true}),
+	)
+
+	for range 3 {
+		webhook.authorize(context.Background(), testAuthzWebhookRequest)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("got %d calls for repeated requests, want 1", got)
+	}
+
+	other := testAuthzWebhookRequest
+	other.Domain = "api.example.com"
+	webhook.authorize(context.Background(), other)
+	if got := calls.Load(); got != 2 {
+		t.Errorf("got %d calls after a different request, want 2", got)
+	}
+}
+
+func TestAuthzWebhookCacheShared(t *testing.T) {
+	config := AuthzWebhookConfig{CacheTTL: caddy.Duration(time.Minute)}
+	webhook, calls := newTestAuthzWebhook(t, config, respondWith(authzWebhookResponse{Allow: true}))
+
+	// Another handler that consults the same service uses the same cache.
+	config.URL = webhook.config.URL
+	other, err := config.provision(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.release()
+
+	webhook.authorize(context.Background(), testAuthzWebhookRequest)
+	other.authorize(context.Background(), testAuthzWebhookRequest)
+	if got := calls.Load(); got != 1 {
+		t.Errorf("got %d calls across handlers, want 1", got)
+	}
+}
+
+func TestAuthzWebhookFailuresNotCached(t *testing.T) {
+	fail := atomic.Bool{}
+	fail.Store(true)
+	webhook, calls := newTestAuthzWebhook(
+		t,
+		AuthzWebhookConfig{CacheTTL: caddy.Duration(time.Minute)},
+		func(w http.ResponseWriter, r *http.Request) {
+			if fail.Load() {
+				http.Error(w, "oops", http.StatusBadGateway)
+				return
+			}
+			respondWith(authzWebhookResponse{Allow: true})(w, r)
+		},
+	)
+
+	got, _ := webhook.authorize(context.Background(), testAuthzWebhookRequest)
+	expectDenyReason(t, got, optionals.Some(DenyWebhookUnavailable))
+
+	fail.Store(false)
+	got, _ = webhook.authorize(context.Background(), testAuthzWebhookRequest)
+	expectDenyReason(t, got, optionals.None[DenyReason]())
+	if got := calls.Load(); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+}
+
+func TestAuthzWebhookCleanups(t *testing.T) {
+	var gotMode atomic.Value
+	webhook, _ := newTestAuthzWebhook(
+		t,
+		AuthzWebhookConfig{},
+		func(w http.ResponseWriter, r *http.Request) {
+			var input authzWebhookRequest
+			json.NewDecoder(r.Body).Decode(&input)
+			gotMode.Store(input.Mode)
+			respondWith(authzWebhookResponse{Allow: false})(w, r)
+		},
+	)
+
+	// Cleanups are sent to the service, which sees their mode.
+	input := testAuthzWebhookRequest
+	input.Mode = hmCleanup
+	got, _ := webhook.authorize(context.Background(), input)
+	expectDenyReason(t, got, optionals.Some(DenyWebhook))
+	if mode := gotMode.Load(); mode != hmCleanup {
+		t.Errorf("got mode %v, want %q", mode, hmCleanup)
+	}
+
+	// Denials of cleanups are enforced only if configured.
+	if !webhook.enforces(hmPresent) || webhook.enforces(hmCleanup) {
+		t.Error("expected only denials of presents to be enforced by default")
+	}
+	webhook.config.EnforceOnCleanup = true
+	if !webhook.enforces(hmCleanup) {
+		t.Error("expected denials of cleanups to be enforced")
+	}
+}
+
+func TestAuthzWebhookConfigErrors(t *testing.T) {
+	if _, err := (&AuthzWebhookConfig{}).provision(zap.NewNop()); err == nil {
+		t.Error("expected an error for a missing URL")
+	}
+
+	config := &AuthzWebhookConfig{URL: "http://localhost"}
+	if _, err := config.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(config.Timeout) != defaultAuthzWebhookTimeout {
+		t.Errorf("got timeout %s, want %s", time.Duration(config.Timeout), defaultAuthzWebhookTimeout)
+	}
+}
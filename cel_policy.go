@@ -0,0 +1,101 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+)
+
+// The maximum cost of evaluating a CEL policy, to guard against runaway
+// expressions. See cel.CostLimit.
+const celCostLimit = 100000
+
+// The environment in which CEL policies are compiled. The variables are:
+//
+//   - `user_id`: the authenticated user's ID.
+//   - `domain`: the requested domain, without the `_acme-challenge.` prefix or
+//     a trailing dot.
+//   - `zone`: the requested domain's DNS zone, without a trailing dot.
+//   - `client_ip`: the client's IP address, as determined by the server's
+//     trusted proxies configuration. Empty for Unix socket connections.
+//   - `time`: the time of the request.
+//   - `headers`: the request headers, keyed by lowercase header name. Multiple
+//     values of a header are joined with ", ".
+//
+// The CEL strings extension is also available, e.g., `domain.split(".")`.
+var celEnvOptions = []cel.EnvOption{
+	ext.Strings(),
+	cel.Variable("user_id", cel.StringType),
+	cel.Variable("domain", cel.StringType),
+	cel.Variable("zone", cel.StringType),
+	cel.Variable("client_ip", cel.StringType),
+	cel.Variable("time", cel.TimestampType),
+	cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+}
+
+// A compiled CEL policy expression.
+type celPolicy struct {
+	program cel.Program
+}
+
+// Compiles the given CEL expression, which must evaluate to a bool.
+func newCELPolicy(expr string) (*celPolicy, error) {
+	env, err := cel.NewEnv(celEnvOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create CEL environment: %w", err)
+	}
+
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("unable to compile CEL policy: %w", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf(
+			"CEL policy must evaluate to a bool, not %s",
+			ast.OutputType(),
+		)
+	}
+
+	program, err := env.Program(ast, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile CEL policy: %w", err)
+	}
+	return &celPolicy{program: program}, nil
+}
+
+// The inputs to a CEL policy.
+type celPolicyInput struct {
+	userID   string
+	domain   string
+	zone     string
+	clientIP string
+	time     time.Time
+	headers  http.Header
+}
+
+// Evaluates the policy. Returns whether the request is allowed.
+func (p *celPolicy) allows(ctx context.Context, input celPolicyInput) (bool, error) {
+	headers := make(map[string]string, len(input.headers))
+	for name, values := range input.headers {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+
+	result, _, err := p.program.ContextEval(ctx, map[string]any{
+		"user_id":   input.userID,
+		"domain":    input.domain,
+		"zone":      input.zone,
+		"client_ip": input.clientIP,
+		"time":      input.time,
+		"headers":   headers,
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to evaluate CEL policy: %w", err)
+	}
+	return result == types.True, nil
+}
@@ -0,0 +1,81 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCELPolicy(t *testing.T) {
+	input := celPolicyInput{
+		userID:   "alice",
+		domain:   "www.example.com",
+		zone:     "example.com",
+		clientIP: "192.0.2.1",
+		time:     time.Date(2026, time.March, 2, 10, 0, 0, 0, time.UTC),
+		headers:  http.Header{"X-Team": {"web", "ops"}},
+	}
+
+	for _, test := range []struct {
+		expr string
+		want bool
+	}{
+		{`domain == user_id + ".example.com"`, false},
+		{`domain.endsWith("." + zone)`, true},
+		{`domain.split(".")[0] == "www"`, true},
+		{`client_ip.startsWith("192.0.2.")`, true},
+		{`time.getHours() < 9`, false},
+		{`headers["x-team"] == "web, ops"`, true},
+		{`"x-missing" in headers`, false},
+	} {
+		policy, err := newCELPolicy(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		got, err := policy.allows(context.Background(), input)
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %v, %v; want %v", test.expr, got, err, test.want)
+		}
+	}
+}
+
+func TestCELPolicyErrors(t *testing.T) {
+	for _, expr := range []string{
+		`domain ==`,
+		`domain`,
+		`unknown_variable == "x"`,
+	} {
+		if _, err := newCELPolicy(expr); err == nil {
+			t.Errorf("%s: expected a compile error", expr)
+		}
+	}
+
+	// A missing header is an evaluation error, which denies the request.
+	policy, err := newCELPolicy(`headers["x-missing"] == "x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := policy.allows(context.Background(), celPolicyInput{})
+	if err == nil || allowed {
+		t.Errorf("got allowed %v, error %v; want an evaluation error", allowed, err)
+	}
+
+	// Runaway expressions hit the cost limit.
+	policy, err = newCELPolicy(
+		`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(a, ` +
+			`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(b, ` +
+			`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(c, ` +
+			`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(d, ` +
+			`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(e, ` +
+			`domain.size() >= 0)))))`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err = policy.allows(context.Background(), celPolicyInput{})
+	if err == nil || allowed {
+		t.Errorf("got allowed %v, error %v; want a cost limit error", allowed, err)
+	}
+}
@@ -0,0 +1,167 @@
+package caddydns01proxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// Configures authentication by TLS client certificates. Each certificate is
+// mapped to a user ID by one of its identities.
+type ClientCertAuthConfig struct {
+	// PEM files containing the certificates of the CAs that are trusted to issue
+	// client certificates.
+	TrustedCACertPEMFiles []string `json:"trusted_ca_cert_pem_files"`
+
+	// Which of the certificate's identities is used as the user ID. One of:
+	//
+	//   - `cn`: the subject's common name.
+	//   - `dns_san`: a DNS subject alternative name.
+	//   - `spiffe`: a SPIFFE ID (a URI subject alternative name with the
+	//     `spiffe` scheme), e.g. `spiffe://example.com/host/web42`.
+	//
+	// Defaults to `cn`. If a certificate has several identities of the
+	// configured kind, then the first one that is a known user ID is used.
+	Identity string `json:"identity,omitempty"`
+}
+
+const (
+	certIdentityCN     = "cn"
+	certIdentityDNSSAN = "dns_san"
+	certIdentitySPIFFE = "spiffe"
+)
+
+// Authenticates clients by their TLS client certificates.
+type clientCertAuthenticator struct {
+	roots    *x509.CertPool
+	identity string
+
+	// Used for choosing among a certificate's identities.
+	registry *ClientRegistry
+}
+
+var _ caddyauth.Authenticator = (*clientCertAuthenticator)(nil)
+
+func (c *ClientCertAuthConfig) provision(
+	registry *ClientRegistry,
+) (*clientCertAuthenticator, error) {
+	if len(c.TrustedCACertPEMFiles) == 0 {
+		return nil, fmt.Errorf("must configure at least one trusted CA certificate")
+	}
+
+	switch c.Identity {
+	case "":
+		c.Identity = certIdentityCN
+	case certIdentityCN, certIdentityDNSSAN, certIdentitySPIFFE:
+	default:
+		return nil, fmt.Errorf("unknown client certificate identity: %q", c.Identity)
+	}
+
+	roots := x509.NewCertPool()
+	for _, path := range c.TrustedCACertPEMFiles {
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificates: %w", err)
+		}
+
+		found := false
+		for {
+			var block *pem.Block
+			block, pemBytes = pem.Decode(pemBytes)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"unable to parse CA certificate in %q: %w",
+					path,
+					err,
+				)
+			}
+			roots.AddCert(cert)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("no CA certificates found in %q", path)
+		}
+	}
+
+	return &clientCertAuthenticator{
+		roots:    roots,
+		identity: c.Identity,
+		registry: registry,
+	}, nil
+}
+
+func (a *clientCertAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return caddyauth.User{}, false, nil
+	}
+
+	// Verify the certificate chain, regardless of what the TLS server has done.
+	leaf := req.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return caddyauth.User{}, false, nil
+	}
+
+	// Map the certificate to a user ID. Prefer known users. Otherwise, use the
+	// first identity, so that the denial gets logged against it.
+	identities := a.identities(leaf)
+	if len(identities) == 0 {
+		return caddyauth.User{}, false, nil
+	}
+	userID := identities[0]
+	for _, identity := range identities {
+		if _, known := a.registry.Policy(identity); known {
+			userID = identity
+			break
+		}
+	}
+
+	return caddyauth.User{ID: userID}, true, nil
+}
+
+// Returns the certificate's identities of the configured kind.
+func (a *clientCertAuthenticator) identities(cert *x509.Certificate) []string {
+	switch a.identity {
+	case certIdentityCN:
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return []string{cert.Subject.CommonName}
+
+	case certIdentityDNSSAN:
+		return cert.DNSNames
+
+	case certIdentitySPIFFE:
+		var result []string
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" {
+				result = append(result, uri.String())
+			}
+		}
+		return result
+	}
+
+	return nil
+}
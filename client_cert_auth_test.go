@@ -0,0 +1,209 @@
+package caddydns01proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A CA for issuing test client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	// A PEM file containing the CA certificate.
+	pemFile string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(
+		pemFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0o600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pemFile: pemFile}
+}
+
+// Issues a client certificate with the given identities.
+func (ca *testCA) issue(
+	t *testing.T,
+	commonName string,
+	dnsNames []string,
+	uris []string,
+) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, rawURI := range uris {
+		uri, err := url.Parse(rawURI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func requestWithClientCert(cert *x509.Certificate) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/present", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return req
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+	registry := &ClientRegistry{clients: map[string]*ClientPolicy{
+		"web42.example.com":               {},
+		"spiffe://example.com/host/web42": {},
+	}}
+
+	for _, test := range []struct {
+		identity string
+		cert     *x509.Certificate
+		wantUser string
+	}{
+		{
+			identity: certIdentityCN,
+			cert:     ca.issue(t, "alice", nil, nil),
+			wantUser: "alice",
+		},
+		{
+			identity: certIdentityDNSSAN,
+			cert: ca.issue(
+				t,
+				"alice",
+				[]string{"unknown.example.com", "web42.example.com"},
+				nil,
+			),
+			wantUser: "web42.example.com",
+		},
+		{
+			identity: certIdentityDNSSAN,
+			cert:     ca.issue(t, "alice", []string{"unknown.example.com"}, nil),
+			wantUser: "unknown.example.com",
+		},
+		{
+			identity: certIdentitySPIFFE,
+			cert: ca.issue(
+				t,
+				"alice",
+				nil,
+				[]string{"https://example.com", "spiffe://example.com/host/web42"},
+			),
+			wantUser: "spiffe://example.com/host/web42",
+		},
+	} {
+		config := &ClientCertAuthConfig{
+			TrustedCACertPEMFiles: []string{ca.pemFile},
+			Identity:              test.identity,
+		}
+		a, err := config.provision(registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user, authed, err := a.Authenticate(
+			httptest.NewRecorder(),
+			requestWithClientCert(test.cert),
+		)
+		if err != nil || !authed {
+			t.Fatalf("%s: got authed %v, error %v", test.identity, authed, err)
+		}
+		if user.ID != test.wantUser {
+			t.Errorf("%s: got user %q, want %q", test.identity, user.ID, test.wantUser)
+		}
+	}
+}
+
+func TestClientCertAuthRejects(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	config := &ClientCertAuthConfig{TrustedCACertPEMFiles: []string{ca.pemFile}}
+	a, err := config.provision(&ClientRegistry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, cert := range map[string]*x509.Certificate{
+		"no certificate":   nil,
+		"untrusted issuer": otherCA.issue(t, "alice", nil, nil),
+		"no identity":      ca.issue(t, "", nil, nil),
+	} {
+		_, authed, err := a.Authenticate(httptest.NewRecorder(), requestWithClientCert(cert))
+		if err != nil || authed {
+			t.Errorf("%s: got authed %v, error %v", name, authed, err)
+		}
+	}
+}
+
+func TestClientCertAuthConfigErrors(t *testing.T) {
+	ca := newTestCA(t)
+	for name, config := range map[string]*ClientCertAuthConfig{
+		"no CAs":           {},
+		"unknown identity": {TrustedCACertPEMFiles: []string{ca.pemFile}, Identity: "email"},
+		"missing file":     {TrustedCACertPEMFiles: []string{filepath.Join(t.TempDir(), "x")}},
+	} {
+		if _, err := config.provision(&ClientRegistry{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
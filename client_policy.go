@@ -2,6 +2,9 @@ package caddydns01proxy
 
 import (
 	"fmt"
+	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	x509policy "github.com/smallstep/certificates/authority/policy"
@@ -11,59 +14,307 @@ import (
 // The policy configuration for a user. Specifies the domains at which the user
 // is allowed to answer DNS-01 challenges.
 type ClientPolicy struct {
-	// Identifies the client to which this policy applies.
+	// Identifies the client to which this policy applies. The user ID `*`
+	// denotes the default account, whose policy applies to authenticated users
+	// that don't have an account of their own, e.g., users authenticated by a
+	// reverse proxy or an earlier handler. The default account requires
+	// [Handler.DefaultAccountFallback], can't have credentials, and its limits
+	// are shared by all users that fall back to it. User IDs that contain `/`
+	// are reserved for delegated accounts.
 	UserID string `json:"user_id"`
 
+	// Whether the account is disabled. Requests from disabled accounts are
+	// denied, so that an account can be offboarded without removing it. Like
+	// expired accounts and accounts outside their active hours, disabled
+	// accounts can still clean up records.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// When the account becomes usable. Optional. If omitted, then the account is
+	// usable immediately.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+
+	// When the account expires. Optional. If omitted, then the account does not
+	// expire.
+	NotAfter *time.Time `json:"not_after,omitempty"`
+
+	// Weekly windows during which the account can be used. Optional. If
+	// omitted, then the account can be used at any time.
+	ActiveHours []ActiveHoursWindow `json:"active_hours,omitempty"`
+
+	// Whether the user can present records during the server's freeze windows.
+	FreezeOverride bool `json:"freeze_override,omitempty"`
+
 	// Determines the domains for which the user can get TLS certificates. This
 	// largely follows Smallstep's domain name rules:
 	// https://smallstep.com/docs/step-ca/policies/#domain-names
 	//
 	// Due to a limitation in ACME and DNS-01, allowing a domain also allows
 	// wildcard certificates for that domain.
+	//
+	// The domains can contain the placeholders `{user}`, for the authenticated
+	// user's ID, and `{header.<name>}`, for the value of a request header, e.g.,
+	// `{user}.hosts.example.com`. These are filled in for each request. A value
+	// that is missing or is not a single DNS label causes the request to be
+	// denied. Headers are used only if the request came from a trusted proxy, as
+	// configured by the server's `trusted_proxies` option. Otherwise, they are
+	// treated as missing.
 	AllowDomainsRaw []string `json:"allow_domains,omitempty"`
 	DenyDomainsRaw  []string `json:"deny_domains,omitempty"`
 
+	// Regular expressions for domains that the user can get TLS certificates
+	// for, and for domains that they can't, for rules that [AllowDomainsRaw] and
+	// [DenyDomainsRaw] can't express. Optional. Each pattern must match the
+	// whole domain, in lowercase and without a trailing dot, e.g.,
+	// `[a-z0-9-]+\.k8s\.example\.com`. A domain is allowed if it matches an
+	// allowed domain or pattern, and doesn't match a denied domain or pattern.
+	AllowPatternsRaw []string `json:"allow_patterns,omitempty"`
+	DenyPatternsRaw  []string `json:"deny_patterns,omitempty"`
+
+	// The maximum number of labels that a requested domain can have below its
+	// DNS zone. For example, in the zone `example.com`, `www.example.com` has a
+	// depth of 1, and `a.k8s.example.com` has a depth of 2. Optional. If
+	// omitted, then the depth is not limited.
+	MaxSubdomainDepth int `json:"max_subdomain_depth,omitempty"`
+
+	// Whether the user can create, rotate and delete delegated accounts through
+	// the `/delegation` endpoints. A delegated account's allowed domains must
+	// fall within the user's, and it is also bound by the user's domain policy
+	// and restrictions, and shares the user's limits. The user's domain policy
+	// can't have placeholders or patterns.
+	Delegator bool `json:"delegator,omitempty"`
+
+	// The names of groups whose domain policies the user inherits. Optional. The
+	// user can get TLS certificates for the union of their own and their groups'
+	// allowed domains, minus the union of the denied domains.
+	Groups []string `json:"groups,omitempty"`
+
+	// The IP ranges, in CIDR notation, from which the user can make requests.
+	// Single IP addresses are also accepted. Optional. If omitted, then requests
+	// can come from anywhere. The client IP is determined by the server's
+	// trusted proxies configuration.
+	AllowedNetworksRaw []string `json:"allowed_networks,omitempty"`
+
+	// Additionally requires that a requested domain currently resolves to the
+	// client's IP address. Optional. Combines with [AllowDomainsRaw] and
+	// [DenyDomainsRaw]: a requested domain must satisfy both. Applies only to
+	// presents, so that records can be cleaned up after the domain moves.
+	BindToClientIP *ClientIPBinding `json:"bind_to_client_ip,omitempty"`
+
+	// A CEL expression that must evaluate to true for a request to be allowed.
+	// Optional. Evaluated after the domain policy, for rules that the domain
+	// policy can't express. The expression can use the variables `user_id`,
+	// `domain`, `zone`, `client_ip`, `time` and `headers`. For example,
+	// `time.getDayOfWeek("UTC") in [1, 2, 3, 4, 5]`. Requests for which the
+	// expression fails to evaluate, e.g., because it uses a header that wasn't
+	// sent, are denied.
+	CEL string `json:"cel,omitempty"`
+
+	// Report-only versions of [AllowDomainsRaw], [DenyDomainsRaw] and [CEL],
+	// for trying out a policy change before making it. These are evaluated on
+	// each request without being enforced. Whenever one of them would have
+	// decided differently from the policy that it shadows, this is noted in the
+	// access log: `shadow_deny_reason` gives the reason for a denial that the
+	// shadow policy would have made, and `shadow_allowed` notes a denial that
+	// it would not have made. Optional. A shadow list that is omitted falls back
+	// to the enforced list, and the shadow lists inherit the user's groups and
+	// patterns in the same way as the enforced lists.
+	ShadowAllowDomainsRaw []string `json:"shadow_allow_domains,omitempty"`
+	ShadowDenyDomainsRaw  []string `json:"shadow_deny_domains,omitempty"`
+	ShadowCEL             string   `json:"shadow_cel,omitempty"`
+
+	// Limits how often the user can make requests. Optional. If omitted, then
+	// the user is not limited.
+	Limits *AccountLimits `json:"limits,omitempty"`
+
+	// The TTL to use in DNS TXT records for this user. Optional. Overrides the
+	// global and zone TTLs.
+	TTL *caddy.Duration `json:"ttl,omitempty"`
+
+	// The range of TTLs that the user can request. Optional. If either bound is
+	// given, then a TTL requested by the user is honoured, after being clamped to
+	// fit this range. Otherwise, requested TTLs are ignored.
+	MinTTL *caddy.Duration `json:"min_ttl,omitempty"`
+	MaxTTL *caddy.Duration `json:"max_ttl,omitempty"`
+
 	// The policy to be applied to the DNS domains for answering DNS-01
-	// challenges.
+	// challenges. Nil if the domain policy has placeholders.
 	DomainPolicy x509policy.X509Policy `json:"-"`
+
+	// The domain policy, if it has placeholders. Optional.
+	domainTemplates *domainTemplates
+
+	// The compiled versions of [AllowPatternsRaw] and [DenyPatternsRaw].
+	// Optional.
+	domainPatterns *domainPatterns
+
+	// The provisioned version of [AllowedNetworksRaw]. Empty if requests can come
+	// from anywhere.
+	allowedNetworks []netip.Prefix
+
+	// The compiled version of [CEL]. Optional.
+	celPolicy *celPolicy
+
+	// The provisioned versions of the shadow policies. Optional.
+	shadow *shadowPolicy
+
+	// Maps the name of each of the user's scoped API tokens to the policy for
+	// the token's scope.
+	tokenScopes map[string]x509policy.X509Policy
+
+	// For a delegated account, the user ID of the delegator that created it.
+	// Empty otherwise.
+	delegatedBy string
+
+	// For a delegated account, the user ID of the configured account whose
+	// limits it shares. Empty otherwise.
+	limitsUserID string
 }
 
 var _ caddy.Provisioner = (*ClientPolicy)(nil)
 
 func (c *ClientPolicy) Provision(ctx caddy.Context) error {
-	domainPolicyOpts := provisioner.X509Options{}
+	// The Smallstep library returns a nil policy engine when given an empty
+	// policy. Detect this here to avoid a nil dereference later, when the policy
+	// gets used.
+	if len(c.AllowDomainsRaw) == 0 && len(c.DenyDomainsRaw) == 0 &&
+		len(c.AllowPatternsRaw) == 0 && len(c.DenyPatternsRaw) == 0 {
+		return fmt.Errorf("empty or missing domain policy given for client %q", c.UserID)
+	}
+	if c.MaxSubdomainDepth < 0 {
+		return fmt.Errorf("max subdomain depth for client %q must not be negative", c.UserID)
+	}
 
-	provisionX509NameOptions := func(raw *[]string) *x509policy.X509NameOptions {
-		// Allow the raw version to be GC'd.
-		defer func() {
-			*raw = nil
-		}()
+	if c.Limits != nil {
+		if c.Limits.RequestsPerMinute < 0 || c.Limits.Burst < 0 ||
+			c.Limits.PresentsPerDay < 0 || c.Limits.MaxOutstandingRecords < 0 {
+			return fmt.Errorf("limits for client %q must not be negative", c.UserID)
+		}
+	}
 
-		if len(*raw) > 0 {
-			return &x509policy.X509NameOptions{
-				DNSDomains: *raw,
-			}
+	err := validateTTLRange(c.MinTTL, c.MaxTTL)
+	if err != nil {
+		return fmt.Errorf("invalid TTL range for client %q: %w", c.UserID, err)
+	}
+
+	if c.NotBefore != nil && c.NotAfter != nil && !c.NotBefore.Before(*c.NotAfter) {
+		return fmt.Errorf("validity period for client %q is empty", c.UserID)
+	}
+	for i := range c.ActiveHours {
+		err := c.ActiveHours[i].provision()
+		if err != nil {
+			return fmt.Errorf(
+				"invalid active hours window %d for client %q: %w",
+				i,
+				c.UserID,
+				err,
+			)
 		}
-		return nil
 	}
 
-	// Ingest the allow/deny lists.
-	domainPolicyOpts.AllowedNames = provisionX509NameOptions(&c.AllowDomainsRaw)
-	domainPolicyOpts.DeniedNames = provisionX509NameOptions(&c.DenyDomainsRaw)
+	for _, networkRaw := range c.AllowedNetworksRaw {
+		network, err := parseNetwork(networkRaw)
+		if err != nil {
+			return fmt.Errorf("invalid allowed network for client %q: %w", c.UserID, err)
+		}
+		c.allowedNetworks = append(c.allowedNetworks, network)
+	}
 
-	// The Smallstep library returns a nil policy engine when given an empty
-	// policy. Detect this here to avoid a nil dereference later, when the policy
-	// gets used.
-	if domainPolicyOpts.AllowedNames == nil && domainPolicyOpts.DeniedNames == nil {
-		return fmt.Errorf("empty or missing domain policy given for client %q", c.UserID)
+	if c.CEL != "" {
+		c.celPolicy, err = newCELPolicy(c.CEL)
+		if err != nil {
+			return fmt.Errorf("invalid CEL policy for client %q: %w", c.UserID, err)
+		}
 	}
 
-	// Instantiate the domain policy.
-	var err error
-	c.DomainPolicy, err = x509policy.NewX509PolicyEngine(&domainPolicyOpts)
+	// Instantiate the domain policy. If it has placeholders, then it is
+	// instantiated for each request instead.
+	c.domainTemplates, err = newDomainTemplates(c.AllowDomainsRaw, c.DenyDomainsRaw)
 	if err != nil {
 		return fmt.Errorf("unable to provision domain policy: %w", err)
 	}
+	if c.domainTemplates == nil {
+		c.DomainPolicy, err = newDomainPolicy(c.AllowDomainsRaw, c.DenyDomainsRaw)
+		if err != nil {
+			return fmt.Errorf("unable to provision domain policy: %w", err)
+		}
+	}
+	c.domainPatterns, err = newDomainPatterns(c.AllowPatternsRaw, c.DenyPatternsRaw)
+	if err != nil {
+		return fmt.Errorf("invalid domain pattern for client %q: %w", c.UserID, err)
+	}
+	if c.Delegator && (c.domainTemplates != nil || c.domainPatterns != nil) {
+		return fmt.Errorf(
+			"domain policy for delegator %q cannot have placeholders or patterns",
+			c.UserID,
+		)
+	}
+	c.shadow, err = c.provisionShadow()
+	if err != nil {
+		return fmt.Errorf("invalid shadow policy for client %q: %w", c.UserID, err)
+	}
+
+	// Allow the raw versions to be GC'd. The allow and deny lists are still
+	// needed when they are combined with patterns, and for checking delegated
+	// accounts.
+	if c.domainPatterns == nil && !c.Delegator {
+		c.AllowDomainsRaw = nil
+		c.DenyDomainsRaw = nil
+	}
+	c.AllowPatternsRaw = nil
+	c.DenyPatternsRaw = nil
+	c.ShadowAllowDomainsRaw = nil
+	c.ShadowDenyDomainsRaw = nil
+	c.AllowedNetworksRaw = nil
 
 	return nil
 }
+
+// Parses an IP range in CIDR notation, or a single IP address.
+func parseNetwork(networkRaw string) (netip.Prefix, error) {
+	if strings.Contains(networkRaw, "/") {
+		network, err := netip.ParsePrefix(networkRaw)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return network.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(networkRaw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Determines whether the user can make requests from the given client IP
+// address.
+func (c *ClientPolicy) allowsClientIP(clientIP netip.Addr) bool {
+	if len(c.allowedNetworks) == 0 {
+		return true
+	}
+	clientIP = clientIP.Unmap().WithZone("")
+	for _, network := range c.allowedNetworks {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Instantiates a policy engine from the given allow and deny lists, which
+// follow Smallstep's domain name rules. Returns nil if both lists are empty.
+func newDomainPolicy(allow, deny []string) (x509policy.X509Policy, error) {
+	nameOptions := func(domains []string) *x509policy.X509NameOptions {
+		if len(domains) > 0 {
+			return &x509policy.X509NameOptions{
+				DNSDomains: domains,
+			}
+		}
+		return nil
+	}
+
+	return x509policy.NewX509PolicyEngine(&provisioner.X509Options{
+		AllowedNames: nameOptions(allow),
+		DeniedNames:  nameOptions(deny),
+	})
+}
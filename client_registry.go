@@ -2,12 +2,18 @@ package caddydns01proxy
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/liujed/goutil/optionals"
+	x509policy "github.com/smallstep/certificates/authority/policy"
 	"github.com/smallstep/certificates/policy"
+	"go.uber.org/zap"
 )
 
 type DenyReason string
@@ -17,14 +23,107 @@ const (
 	// the client registry.
 	DenyUnknownUser DenyReason = "unknown user"
 
+	// Indicates that authorization failed because the user's account is
+	// disabled.
+	DenyAccountDisabled DenyReason = "account disabled"
+
+	// Indicates that authorization failed because the user's account is not yet
+	// valid.
+	DenyAccountNotYetValid DenyReason = "account not yet valid"
+
+	// Indicates that authorization failed because the user's account has
+	// expired.
+	DenyAccountExpired DenyReason = "account expired"
+
+	// Indicates that authorization failed because the request was made outside
+	// the user's active hours.
+	DenyOutsideActiveHours DenyReason = "outside account's active hours"
+
 	// Indicates that authorization failed because the user is not authorized to
 	// answer challenges for the requested domain.
 	DenyDomainNotAllowed DenyReason = "requested domain denied by policy"
 
+	// Indicates that authorization failed because the request came from a client
+	// IP address outside the user's allowed networks.
+	DenyNetworkNotAllowed DenyReason = "client network denied by policy"
+
+	// Indicates that authorization failed because the requested domain does not
+	// resolve to the client's IP address.
+	DenyDomainNotBound DenyReason = "requested domain does not resolve to client IP"
+
+	// Indicates that authorization failed because a placeholder in the user's
+	// domain policy could not be filled in, e.g., because a request header was
+	// missing.
+	DenyDomainTemplate DenyReason = "domain policy placeholder could not be filled in"
+
 	// Indicates that authorization failed because the user requested an invalid
 	// domain.
 	DenyInvalidDomain DenyReason = "requested domain not valid"
 
+	// Indicates that authorization failed because the requested domain has more
+	// labels below its DNS zone than the user's policy allows.
+	DenySubdomainTooDeep DenyReason = "requested domain too deep below its DNS zone"
+
+	// Indicates that authorization failed because the requested domain's DNS
+	// zone is not allowed by the server-wide zone guardrails.
+	DenyZoneNotAllowed DenyReason = "DNS zone denied by server policy"
+
+	// Indicates that a record was not presented because a freeze window is in
+	// effect.
+	DenyFreezeWindow DenyReason = "change freeze in effect"
+
+	// Indicates that the request is awaiting approval. The client should retry
+	// it later.
+	DenyApprovalPending DenyReason = "awaiting approval"
+
+	// Indicates that an approver rejected the request.
+	DenyApprovalRejected DenyReason = "request rejected by approver"
+
+	// Indicates that the request was not approved in time.
+	DenyApprovalTimedOut DenyReason = "approval timed out"
+
+	// Indicates that the user tried to decide a pending request without being
+	// an approver.
+	DenyNotApprover DenyReason = "user is not an approver"
+
+	// Indicates that the user tried to decide their own pending request.
+	DenySelfApproval DenyReason = "users cannot decide their own requests"
+
+	// Indicates that the user tried to administer delegated accounts without
+	// being a delegator.
+	DenyNotDelegator DenyReason = "user is not a delegator"
+
+	// Indicates that the user tried to create a delegated account whose allowed
+	// domains fall outside their own.
+	DenyOutsideDelegation DenyReason = "domains outside user's delegation"
+
+	// Indicates that authorization failed because the delegator of the user's
+	// delegated account no longer exists, is no longer a delegator, or can't
+	// currently be used.
+	DenyDelegationRevoked DenyReason = "delegation revoked"
+
+	// Indicates that the user has exceeded their request rate limit.
+	DenyRateLimited DenyReason = "request rate limit exceeded"
+
+	// Indicates that the user has used up their daily quota of presented
+	// records.
+	DenyQuotaExceeded DenyReason = "daily quota exceeded"
+
+	// Indicates that the user has too many presented records that have not yet
+	// been cleaned up.
+	DenyTooManyOutstanding DenyReason = "too many outstanding records"
+
+	// Indicates that authorization failed because the user's CEL policy
+	// evaluated to false.
+	DenyCELPolicy DenyReason = "request denied by CEL policy"
+
+	// Indicates that the external authorization webhook denied the request.
+	DenyWebhook DenyReason = "request denied by authorization webhook"
+
+	// Indicates that the external authorization webhook could not be consulted,
+	// and that it is configured to fail closed.
+	DenyWebhookUnavailable DenyReason = "authorization webhook unavailable"
+
 	// Indicates that an error occurred during authorization.
 	DenyError DenyReason = "an error occurred"
 )
@@ -32,16 +131,52 @@ const (
 // DNS names for answering DNS-01 challenges are expected to have this prefix.
 const challengeDomainPrefix = "_acme-challenge."
 
+// The user ID of the default account, whose policy applies to authenticated
+// users that don't have an account of their own, if fallbacks are enabled.
+const defaultAccountUserID = "*"
+
 // A registry of known users and their corresponding policy configuration.
 type ClientRegistry struct {
 	// Maps each client's user ID to its policy configuration.
 	clients map[string]*ClientPolicy
+
+	// Whether users without an account of their own fall back to the default
+	// account.
+	defaultAccountFallback bool
+
+	// Policy engines for the domains that users are allowed by their JWT claims.
+	jwtPolicies *policyCache
+
+	// Policy engines that are built at request time for domain policies with
+	// placeholders or patterns, keyed by their allow and deny lists.
+	domainPolicies *policyCache
+
+	// Used for checking that requested domains resolve to client IP addresses.
+	resolver *net.Resolver
+
+	// The accounts that delegators have created. Optional.
+	delegated *delegationStore
 }
 
 func (c *ClientRegistry) Provision(
 	ctx caddy.Context,
 	accountsRaw []RawAccount,
+	groupsRaw []RawGroup,
+	defaultAccountFallback bool,
+	resolvers []string,
+	delegated *delegationStore,
 ) error {
+	c.defaultAccountFallback = defaultAccountFallback
+	c.jwtPolicies = &policyCache{}
+	c.domainPolicies = &policyCache{}
+	c.resolver = newResolver(resolvers)
+	c.delegated = delegated
+
+	groups, err := indexGroups(groupsRaw)
+	if err != nil {
+		return err
+	}
+
 	// Convert accountsRaw into a map keyed on user ID.
 	c.clients = map[string]*ClientPolicy{}
 	for i, rawAccount := range accountsRaw {
@@ -53,12 +188,67 @@ func (c *ClientRegistry) Provision(
 			)
 		}
 
+		// User IDs that contain the separator are reserved for delegated accounts.
+		if strings.Contains(rawAccount.UserID, delegatedAccountSeparator) {
+			return fmt.Errorf(
+				"account %d: user ID %q cannot contain %q, which is reserved for delegated accounts",
+				i,
+				rawAccount.UserID,
+				delegatedAccountSeparator,
+			)
+		}
+
+		// The default account must be opted into, and can't be authenticated as.
+		if rawAccount.UserID == defaultAccountUserID {
+			if !defaultAccountFallback {
+				return fmt.Errorf(
+					"the default account %q requires default_account_fallback to be enabled",
+					rawAccount.UserID,
+				)
+			}
+			if rawAccount.hasCredentials() {
+				return fmt.Errorf("the default account %q cannot have credentials", rawAccount.UserID)
+			}
+		}
+
 		c.clients[rawAccount.UserID] = &rawAccount.ClientPolicy
+
+		// Provision the scopes of the user's API tokens.
+		for _, token := range rawAccount.Tokens {
+			if len(token.Scope) == 0 {
+				continue
+			}
+			scope, err := newDomainPolicy(token.Scope, nil)
+			if err != nil {
+				return fmt.Errorf(
+					"unable to provision scope of API token %q for user ID %q: %w",
+					token.Name,
+					rawAccount.UserID,
+					err,
+				)
+			}
+			if rawAccount.tokenScopes == nil {
+				rawAccount.tokenScopes = map[string]x509policy.X509Policy{}
+			}
+			rawAccount.tokenScopes[token.Name] = scope
+		}
 	}
 
-	// Provision the ClientPolicy instances.
+	// Provision the ClientPolicy instances, after merging in the users' groups.
 	for userID, ca := range c.clients {
-		err := ca.Provision(ctx)
+		err := ca.inheritGroups(groups)
+		if err != nil {
+			return err
+		}
+		ctx.Logger().Info(
+			"effective domain policy",
+			zap.String("user_id", userID),
+			zap.Strings("groups", ca.Groups),
+			zap.Strings("allow_domains", ca.AllowDomainsRaw),
+			zap.Strings("deny_domains", ca.DenyDomainsRaw),
+		)
+
+		err = ca.Provision(ctx)
 		if err != nil {
 			return fmt.Errorf(
 				"unable to provision client policy for user ID %q: %w",
@@ -71,41 +261,243 @@ func (c *ClientRegistry) Provision(
 	return nil
 }
 
-// Determines whether the current authenticated user is allowed to answer a
-// DNS-01 challenge at the given challenge domain. Returns None on success.
-// Otherwise, returns the reason for denial.
-func (r *ClientRegistry) AuthorizeUserChallengeDomain(
-	req *http.Request,
-	challengeDomain string,
-) (optionals.Optional[DenyReason], error) {
-	// Get the authenticated user ID from the context.
+// Returns the policy configuration for the given user, if the user is known.
+// Delegated accounts are looked up after configured ones, and are bound by the
+// restrictions of the configured account that they descend from. If fallbacks
+// are enabled, users without an account of their own get the default account's
+// policy, if there is one.
+func (r *ClientRegistry) Policy(userID string) (*ClientPolicy, bool) {
+	policy, exists := r.clients[userID]
+	if !exists && r.delegated != nil {
+		policy, exists = r.delegated.policy(userID)
+		if exists {
+			// If the delegation has been revoked, then the account is left as is,
+			// and requests are denied when its delegators are checked.
+			if inherited, ok := r.delegatedPolicy(policy); ok {
+				policy = inherited
+			}
+		}
+	}
+	if !exists && r.defaultAccountFallback {
+		policy, exists = r.clients[defaultAccountUserID]
+	}
+	return policy, exists
+}
+
+// Returns the ID of the authenticated user for the given request.
+func authenticatedUserID(req *http.Request) (string, error) {
 	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 	userID, exists := repl.GetString("http.auth.user.id")
 	if !exists {
 		// Authentication not configured?
-		return optionals.Some(DenyError),
-			fmt.Errorf("unable to determine user ID (is authentication configured?)")
-	}
-
-	config, exists := r.clients[userID]
-	if !exists {
-		return optionals.Some(DenyUnknownUser), nil
+		return "", fmt.Errorf("unable to determine user ID (is authentication configured?)")
 	}
+	return userID, nil
+}
 
-	// Deny if the challenge domain doesn't have the expected prefix.
+// Returns the domain for which a certificate is being requested, given the
+// challenge domain. Returns false if the challenge domain is invalid.
+func requestedDomain(challengeDomain string) (string, bool) {
+	// The challenge domain must have the expected prefix.
 	if !strings.HasPrefix(challengeDomain, challengeDomainPrefix) {
-		return optionals.Some(DenyInvalidDomain), nil
+		return "", false
 	}
 
 	// Strip off the prefix and remove any trailing dot. If the result starts with
-	// a dot, then the requested domain is invalid. Otherwise, check the result
-	// against the domain policy.
+	// a dot, then the requested domain is invalid.
 	domain := strings.TrimPrefix(challengeDomain, challengeDomainPrefix)
 	domain = strings.TrimSuffix(domain, ".")
 	if strings.HasPrefix(domain, ".") {
+		return "", false
+	}
+	return domain, true
+}
+
+// Returns the client IP address of the given request, as determined by the
+// server's trusted proxies configuration.
+func requestClientIP(req *http.Request) (netip.Addr, error) {
+	clientIPRaw, _ := caddyhttp.GetVar(
+		req.Context(),
+		caddyhttp.ClientIPVarKey,
+	).(string)
+	clientIP, err := netip.ParseAddr(clientIPRaw)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("unable to determine client IP address: %w", err)
+	}
+	return clientIP, nil
+}
+
+// Determines whether the current authenticated user is allowed to answer a
+// DNS-01 challenge at the given challenge domain, or to clean up after one,
+// according to the given mode. Returns None on success. Otherwise, returns the
+// reason for denial.
+func (r *ClientRegistry) AuthorizeUserChallengeDomain(
+	req *http.Request,
+	mode handlerMode,
+	challengeDomain string,
+) (optionals.Optional[DenyReason], error) {
+	userID, err := authenticatedUserID(req)
+	if err != nil {
+		return optionals.Some(DenyError), err
+	}
+
+	// If the user's allowed domains were derived from their JWT claims, then
+	// those take the place of the user's account.
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	jwtDomains, fromJWT := repl.GetString(
+		"http.auth.user." + jwtAllowDomainsMetadataKey,
+	)
+
+	config, exists := r.Policy(userID)
+	if !exists && !fromJWT {
+		return optionals.Some(DenyUnknownUser), nil
+	}
+	if exists && config.UserID != userID {
+		addLogField(req, zap.String(logFallbackAccount, config.UserID))
+	}
+
+	// Deny if the user's account is disabled, expired, or outside its active
+	// hours. Cleanups are exempt, so that records presented just before the
+	// account stopped being usable aren't left behind.
+	if exists && mode != hmCleanup {
+		denyReasonOpt := config.checkLifecycle(time.Now())
+		if denyReasonOpt.IsSome() {
+			return denyReasonOpt, nil
+		}
+	}
+
+	// Deny if the request comes from outside the user's allowed networks.
+	if exists && len(config.allowedNetworks) > 0 {
+		clientIP, err := requestClientIP(req)
+		if err != nil || !config.allowsClientIP(clientIP) {
+			return optionals.Some(DenyNetworkNotAllowed), nil
+		}
+	}
+
+	// Deny if the challenge domain is invalid. Otherwise, check the requested
+	// domain against the domain policy.
+	domain, valid := requestedDomain(challengeDomain)
+	if !valid {
 		return optionals.Some(DenyInvalidDomain), nil
 	}
-	err := config.DomainPolicy.IsDNSAllowed(domain)
+	if fromJWT {
+		engine, err := r.jwtPolicies.get(strings.Fields(jwtDomains), nil)
+		if err != nil {
+			return optionals.Some(DenyError),
+				fmt.Errorf("unable to build domain policy from JWT claims: %w", err)
+		}
+		if engine == nil {
+			return optionals.Some(DenyDomainNotAllowed), nil
+		}
+		return checkDomainPolicy(engine, domain)
+	}
+	denyReasonOpt, err := r.checkUserDomainPolicy(req, userID, config, domain)
+	if err != nil {
+		return denyReasonOpt, err
+	}
+	r.checkShadowDomainPolicy(req, userID, config, domain, denyReasonOpt)
+	if denyReasonOpt.IsSome() {
+		return denyReasonOpt, nil
+	}
+
+	// A delegated account is also bound by its delegators' domain policies.
+	denyReasonOpt, err = r.checkDelegatorDomainPolicies(config, domain)
+	if err != nil || denyReasonOpt.IsSome() {
+		return denyReasonOpt, err
+	}
+
+	// If the user is bound to their IP address, then the domain must resolve to
+	// the client's IP address. Cleanups are exempt, since a host that presented a
+	// record must be able to remove it even if its address has since changed.
+	if config.BindToClientIP != nil && mode != hmCleanup {
+		clientIP, err := requestClientIP(req)
+		if err != nil {
+			return optionals.Some(DenyDomainNotBound), nil
+		}
+		denyReasonOpt, err := config.BindToClientIP.check(
+			req.Context(),
+			r.resolver,
+			domain,
+			clientIP,
+		)
+		if err != nil || denyReasonOpt.IsSome() {
+			return denyReasonOpt, err
+		}
+	}
+
+	// If the user authenticated with a scoped API token, then the domain must
+	// also be within the token's scope.
+	tokenName, usedToken := repl.GetString("http.auth.user." + tokenMetadataKey)
+	if scope, scoped := config.tokenScopes[tokenName]; usedToken && scoped {
+		return checkDomainPolicy(scope, domain)
+	}
+
+	return optionals.None[DenyReason](), nil
+}
+
+// Checks the given domain against the domain policy of the given user's
+// account. Returns None if the domain is allowed. Otherwise, returns the reason
+// for denial.
+func (r *ClientRegistry) checkUserDomainPolicy(
+	req *http.Request,
+	userID string,
+	config *ClientPolicy,
+	domain string,
+) (optionals.Optional[DenyReason], error) {
+	return r.checkDomainLists(
+		req,
+		userID,
+		config.DomainPolicy,
+		config.domainTemplates,
+		config.domainPatterns,
+		config.AllowDomainsRaw,
+		config.DenyDomainsRaw,
+		domain,
+	)
+}
+
+// Checks the given domain against a domain policy, given by either a policy
+// engine or templates, and optionally combined with patterns and the allow and
+// deny lists that the engine was built from. Returns None if the domain is
+// allowed. Otherwise, returns the reason for denial.
+func (r *ClientRegistry) checkDomainLists(
+	req *http.Request,
+	userID string,
+	engine x509policy.X509Policy,
+	templates *domainTemplates,
+	patterns *domainPatterns,
+	allow []string,
+	deny []string,
+	domain string,
+) (optionals.Optional[DenyReason], error) {
+	if templates != nil {
+		var err error
+		allow, deny, err = templates.expand(userID, trustedHeaders(req))
+		if err != nil {
+			return optionals.Some(DenyDomainTemplate), nil
+		}
+		if patterns == nil {
+			engine, err = r.domainPolicies.get(allow, deny)
+			if err != nil {
+				return optionals.Some(DenyError),
+					fmt.Errorf("unable to build domain policy from templates: %w", err)
+			}
+		}
+	}
+
+	if patterns != nil {
+		return patterns.check(r.domainPolicies, allow, deny, domain)
+	}
+	return checkDomainPolicy(engine, domain)
+}
+
+// Checks the given domain against the given policy engine. Returns None if the
+// domain is allowed. Otherwise, returns the reason for denial.
+func checkDomainPolicy(
+	engine x509policy.X509Policy,
+	domain string,
+) (optionals.Optional[DenyReason], error) {
+	err := engine.IsDNSAllowed(domain)
 	if err != nil {
 		if npe, ok := err.(*policy.NamePolicyError); ok {
 			switch npe.Reason {
@@ -0,0 +1,155 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/liujed/goutil/optionals"
+)
+
+func newTestContext(t *testing.T) caddy.Context {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func newTestRegistry(
+	t *testing.T,
+	accounts []RawAccount,
+	groups []RawGroup,
+) *ClientRegistry {
+	t.Helper()
+	registry := &ClientRegistry{}
+	err := registry.Provision(newTestContext(t), accounts, groups, true, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+// Returns a request that has been authenticated as the given user, from the
+// given client IP address.
+func authedRequest(
+	userID string,
+	clientIP string,
+	metadata map[string]string,
+) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/present", nil)
+	repl := caddy.NewReplacer()
+	repl.Set("http.auth.user.id", userID)
+	for key, value := range metadata {
+		repl.Set("http.auth.user."+key, value)
+	}
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{
+		caddyhttp.ClientIPVarKey: clientIP,
+	})
+	ctx = context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields))
+	return req.WithContext(ctx)
+}
+
+// Checks the result of authorizing the given user for the given domain. The
+// request's path gives the mode.
+func expectAuthorization(
+	t *testing.T,
+	registry *ClientRegistry,
+	req *http.Request,
+	domain string,
+	want optionals.Optional[DenyReason],
+) {
+	t.Helper()
+	got, err := registry.AuthorizeUserChallengeDomain(
+		req,
+		handlerMode(strings.TrimPrefix(req.URL.Path, "/")),
+		challengeDomainPrefix+domain+".",
+	)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", domain, err)
+	}
+	gotReason, gotDenied := got.Get()
+	wantReason, wantDenied := want.Get()
+	if gotDenied != wantDenied || gotReason != wantReason {
+		t.Errorf("%s: got deny reason %q (%v), want %q (%v)",
+			domain, gotReason, gotDenied, wantReason, wantDenied)
+	}
+}
+
+func TestAuthorizeDomainPolicy(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID:          "alice",
+			AllowDomainsRaw: []string{"*.example.com"},
+			DenyDomainsRaw:  []string{"secret.example.com"},
+		},
+	}}, nil)
+
+	req := authedRequest("alice", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "www.example.com", optionals.None[DenyReason]())
+	expectAuthorization(t, registry, req, "secret.example.com", optionals.Some(DenyDomainNotAllowed))
+	expectAuthorization(t, registry, req, "example.org", optionals.Some(DenyDomainNotAllowed))
+
+	expectAuthorization(
+		t,
+		registry,
+		authedRequest("mallory", "192.0.2.1", nil),
+		"www.example.com",
+		optionals.Some(DenyUnknownUser),
+	)
+
+	got, err := registry.AuthorizeUserChallengeDomain(req, hmPresent, "www.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDenyReason(t, got, optionals.Some(DenyInvalidDomain))
+}
+
+func TestAuthorizeAllowedNetworks(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID:             "alice",
+			AllowDomainsRaw:    []string{"example.com"},
+			AllowedNetworksRaw: []string{"192.0.2.0/24", "2001:db8::1"},
+		},
+	}}, nil)
+
+	for _, test := range []struct {
+		clientIP string
+		want     optionals.Optional[DenyReason]
+	}{
+		{"192.0.2.7", optionals.None[DenyReason]()},
+		{"::ffff:192.0.2.7", optionals.None[DenyReason]()},
+		{"2001:db8::1", optionals.None[DenyReason]()},
+		{"2001:db8::2", optionals.Some(DenyNetworkNotAllowed)},
+		{"198.51.100.1", optionals.Some(DenyNetworkNotAllowed)},
+		// For example, a request over a Unix socket.
+		{"", optionals.Some(DenyNetworkNotAllowed)},
+	} {
+		req := authedRequest("alice", test.clientIP, nil)
+		expectAuthorization(t, registry, req, "example.com", test.want)
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	for raw, want := range map[string]string{
+		"192.0.2.7/24": "192.0.2.0/24",
+		"192.0.2.7":    "192.0.2.7/32",
+		"2001:db8::1":  "2001:db8::1/128",
+	} {
+		got, err := parseNetwork(raw)
+		if err != nil || got != netip.MustParsePrefix(want) {
+			t.Errorf("parseNetwork(%q) = %v, %v; want %s", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "192.0.2.0/33", "example.com"} {
+		if _, err := parseNetwork(raw); err == nil {
+			t.Errorf("parseNetwork(%q): expected an error", raw)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// The authentication methods, in the order in which they are tried. Methods
+// whose credentials are verified by the kernel or by TLS come first, then
+// signatures and bearer tokens, then passwords, and finally the identity header
+// from a trusted proxy.
+const (
+	authMethodPeerCred       = "peer_cred"
+	authMethodClientCert     = "client_cert"
+	authMethodSignedRequest  = "signed_request"
+	authMethodToken          = "token"
+	authMethodDelegatedToken = "delegated_token"
+	authMethodJWT            = "jwt"
+	authMethodPassword       = "password"
+	authMethodHeader         = "header"
+)
+
+var authMethodOrder = []string{
+	authMethodPeerCred,
+	authMethodClientCert,
+	authMethodSignedRequest,
+	authMethodToken,
+	authMethodDelegatedToken,
+	authMethodJWT,
+	authMethodPassword,
+	authMethodHeader,
+}
+
+// Tries each configured authentication method in the order given by
+// authMethodOrder. A request that carries credentials for several methods is
+// only authenticated if they all identify the same user.
+//
+// Caddy's authentication handler tries its providers in an unspecified order
+// and stops at the first that succeeds, so this is registered with it as the
+// only provider.
+type compositeAuthenticator struct {
+	// Keyed by method name.
+	methods map[string]caddyauth.Authenticator
+}
+
+var _ caddyauth.Authenticator = (*compositeAuthenticator)(nil)
+
+// Adds the given authentication method.
+func (a *compositeAuthenticator) add(
+	method string,
+	authenticator caddyauth.Authenticator,
+) {
+	if a.methods == nil {
+		a.methods = map[string]caddyauth.Authenticator{}
+	}
+	a.methods[method] = authenticator
+}
+
+func (a *compositeAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	// Headers set by methods that fail, such as a password prompt, are only sent
+	// if no method succeeds.
+	recorder := &authHeaderRecorder{ResponseWriter: w, header: http.Header{}}
+
+	var result caddyauth.User
+	resultMethod := ""
+	for _, method := range authMethodOrder {
+		authenticator, exists := a.methods[method]
+		if !exists {
+			continue
+		}
+
+		user, authed, err := authenticator.Authenticate(recorder, req)
+		if err != nil {
+			return caddyauth.User{}, false,
+				fmt.Errorf("%s authentication failed: %w", method, err)
+		}
+		if !authed {
+			continue
+		}
+
+		if resultMethod == "" {
+			result = user
+			resultMethod = method
+			continue
+		}
+		if user.ID != result.ID {
+			return caddyauth.User{}, false, fmt.Errorf(
+				"conflicting credentials: %s authentication gave user ID %q, but %s authentication gave user ID %q",
+				resultMethod,
+				result.ID,
+				method,
+				user.ID,
+			)
+		}
+
+		// The earlier method's metadata takes precedence.
+		if len(user.Metadata) > 0 {
+			metadata := maps.Clone(user.Metadata)
+			maps.Copy(metadata, result.Metadata)
+			result.Metadata = metadata
+		}
+	}
+
+	if resultMethod == "" {
+		for name, values := range recorder.header {
+			w.Header()[name] = values
+		}
+		return caddyauth.User{}, false, nil
+	}
+	return result, true, nil
+}
+
+// Collects the response headers that an authentication method sets, so that
+// they can be dropped if another method succeeds.
+type authHeaderRecorder struct {
+	http.ResponseWriter
+	header http.Header
+}
+
+func (r *authHeaderRecorder) Header() http.Header {
+	return r.header
+}
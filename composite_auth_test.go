@@ -0,0 +1,125 @@
+package caddydns01proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// An authentication method that always gives the same result.
+type fixedAuthenticator struct {
+	user   caddyauth.User
+	authed bool
+	err    error
+
+	// A header to set when authentication fails. Optional.
+	failureHeader string
+
+	calls int
+}
+
+func (a *fixedAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	a.calls++
+	if !a.authed && a.failureHeader != "" {
+		w.Header().Set(a.failureHeader, "prompt")
+	}
+	return a.user, a.authed, a.err
+}
+
+func authedAs(userID string, metadata map[string]string) *fixedAuthenticator {
+	return &fixedAuthenticator{
+		user:   caddyauth.User{ID: userID, Metadata: metadata},
+		authed: true,
+	}
+}
+
+func TestCompositeAuthenticatorOrder(t *testing.T) {
+	a := &compositeAuthenticator{}
+	a.add(authMethodPassword, authedAs("alice", map[string]string{"k": "password"}))
+	a.add(authMethodClientCert, authedAs("alice", map[string]string{"k": "cert"}))
+
+	// Run this a few times, since map iteration order is random.
+	for range 20 {
+		user, authed, err := a.Authenticate(
+			httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodPost, "/present", nil),
+		)
+		if err != nil || !authed {
+			t.Fatalf("got authed %v, error %v", authed, err)
+		}
+		if user.Metadata["k"] != "cert" {
+			t.Fatalf("got metadata from %q, want from the client certificate", user.Metadata["k"])
+		}
+	}
+}
+
+func TestCompositeAuthenticatorConflict(t *testing.T) {
+	a := &compositeAuthenticator{}
+	a.add(authMethodToken, authedAs("alice", nil))
+	a.add(authMethodHeader, authedAs("bob", nil))
+
+	_, authed, err := a.Authenticate(
+		httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/present", nil),
+	)
+	if authed || err == nil {
+		t.Fatalf("got authed %v, error %v; want a conflict error", authed, err)
+	}
+}
+
+func TestCompositeAuthenticatorFailureHeaders(t *testing.T) {
+	prompt := &fixedAuthenticator{failureHeader: "WWW-Authenticate"}
+
+	// When another method succeeds, the prompt is dropped.
+	a := &compositeAuthenticator{}
+	a.add(authMethodPassword, prompt)
+	a.add(authMethodToken, authedAs("alice", nil))
+	w := httptest.NewRecorder()
+	_, authed, err := a.Authenticate(
+		w,
+		httptest.NewRequest(http.MethodPost, "/present", nil),
+	)
+	if err != nil || !authed {
+		t.Fatalf("got authed %v, error %v", authed, err)
+	}
+	if w.Header().Get("WWW-Authenticate") != "" {
+		t.Error("password prompt sent despite successful authentication")
+	}
+
+	// When nothing succeeds, the prompt is sent.
+	a = &compositeAuthenticator{}
+	a.add(authMethodPassword, prompt)
+	a.add(authMethodToken, &fixedAuthenticator{})
+	w = httptest.NewRecorder()
+	_, authed, err = a.Authenticate(
+		w,
+		httptest.NewRequest(http.MethodPost, "/present", nil),
+	)
+	if err != nil || authed {
+		t.Fatalf("got authed %v, error %v", authed, err)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("password prompt not sent")
+	}
+}
+
+func TestCompositeAuthenticatorError(t *testing.T) {
+	methodErr := errors.New("broken")
+	a := &compositeAuthenticator{}
+	a.add(authMethodClientCert, authedAs("alice", nil))
+	a.add(authMethodPassword, &fixedAuthenticator{err: methodErr})
+
+	_, authed, err := a.Authenticate(
+		httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/present", nil),
+	)
+	if authed || !errors.Is(err, methodErr) {
+		t.Fatalf("got authed %v, error %v; want %v", authed, err, methodErr)
+	}
+}
@@ -0,0 +1,148 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Limits the number of DNS provider operations in flight at once.
+type ConcurrencyConfig struct {
+	// The maximum number of DNS provider operations in flight at once.
+	MaxInFlight int `json:"max_in_flight"`
+
+	// The maximum number of requests that can wait for an in-flight operation to
+	// finish. Requests beyond this are rejected with HTTP 429. Defaults to 0,
+	// meaning that requests are rejected whenever the in-flight limit is
+	// reached.
+	MaxQueued int `json:"max_queued,omitempty"`
+
+	// The maximum time that a request can wait in the queue before being
+	// rejected with HTTP 429. Optional. If omitted, then requests wait until the
+	// client gives up.
+	MaxWait caddy.Duration `json:"max_wait,omitempty"`
+
+	// The value of the `Retry-After` header sent with rejected requests.
+	// Defaults to 1s.
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+}
+
+const defaultConcurrencyRetryAfter = time.Second
+
+// Returned when a request is rejected because the concurrency limiter is
+// saturated.
+var errOverloaded = errors.New("too many DNS provider operations in progress")
+
+// Holds the concurrency limiters, keyed by their configuration, so that handlers
+// with the same configuration, such as those serving the dns01proxy app's
+// network and Unix socket listeners, share one limit, and so that operations in
+// flight still count after a configuration reload.
+var concurrencyLimiterPool = caddy.NewUsagePool()
+
+// Limits concurrency according to a ConcurrencyConfig. Safe for concurrent use.
+type concurrencyLimiter struct {
+	config ConcurrencyConfig
+
+	// The key under which this is held in concurrencyLimiterPool.
+	poolKey string
+
+	// Holds a token for each in-flight operation.
+	slots chan struct{}
+
+	// The number of requests waiting for a slot.
+	queued atomic.Int64
+}
+
+var _ caddy.Destructor = (*concurrencyLimiter)(nil)
+
+// Returns the shared limiter for the given configuration, creating it if
+// needed. The limiter must be released when it is no longer used.
+func loadConcurrencyLimiter(config ConcurrencyConfig) (*concurrencyLimiter, error) {
+	limiter := newConcurrencyLimiter(config)
+	shared, _, err := concurrencyLimiterPool.LoadOrNew(
+		limiter.poolKey,
+		func() (caddy.Destructor, error) {
+			return limiter, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return shared.(*concurrencyLimiter), nil
+}
+
+// Releases a reference to a limiter that was obtained from
+// loadConcurrencyLimiter.
+func (l *concurrencyLimiter) release() error {
+	_, err := concurrencyLimiterPool.Delete(l.poolKey)
+	return err
+}
+
+func (l *concurrencyLimiter) Destruct() error {
+	return nil
+}
+
+func newConcurrencyLimiter(config ConcurrencyConfig) *concurrencyLimiter {
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = caddy.Duration(defaultConcurrencyRetryAfter)
+	}
+	return &concurrencyLimiter{
+		config: config,
+		poolKey: fmt.Sprintf(
+			"%d/%d/%s/%s",
+			config.MaxInFlight,
+			config.MaxQueued,
+			time.Duration(config.MaxWait),
+			time.Duration(config.RetryAfter),
+		),
+		slots: make(chan struct{}, config.MaxInFlight),
+	}
+}
+
+// Waits for a slot for an operation. On success, returns a function that must
+// be called to release the slot. Also returns the queue depth that the request
+// encountered on arrival and how long it waited.
+//
+// Returns errOverloaded if the request was rejected. Otherwise, returns an
+// error if ctx is done before a slot becomes available.
+func (l *concurrencyLimiter) acquire(
+	ctx context.Context,
+) (release func(), queueDepth int, waited time.Duration, err error) {
+	release = func() { <-l.slots }
+
+	// Fast path: a slot is available.
+	select {
+	case l.slots <- struct{}{}:
+		return release, 0, 0, nil
+	default:
+	}
+
+	// Join the queue, if there is room.
+	depth := l.queued.Add(1)
+	defer l.queued.Add(-1)
+	queueDepth = int(depth - 1)
+	if depth > int64(l.config.MaxQueued) {
+		return nil, queueDepth, 0, errOverloaded
+	}
+
+	var timeout <-chan time.Time
+	if l.config.MaxWait > 0 {
+		timer := time.NewTimer(time.Duration(l.config.MaxWait))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		return release, queueDepth, time.Since(start), nil
+	case <-timeout:
+		return nil, queueDepth, time.Since(start), errOverloaded
+	case <-ctx.Done():
+		return nil, queueDepth, time.Since(start), ctx.Err()
+	}
+}
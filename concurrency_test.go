@@ -0,0 +1,142 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestConcurrencyLimiterShedsWithoutQueue(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyConfig{MaxInFlight: 1})
+
+	release, _, _, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _, _, err = l.acquire(context.Background())
+	if !errors.Is(err, errOverloaded) {
+		t.Fatalf("got error %v, want errOverloaded", err)
+	}
+
+	release()
+	release, _, _, err = l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error after release: %v", err)
+	}
+	release()
+}
+
+func TestConcurrencyLimiterQueues(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyConfig{MaxInFlight: 1, MaxQueued: 1})
+
+	release, _, _, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		release, _, _, err := l.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+
+	// Wait for the goroutine to join the queue, then check that the queue is
+	// full.
+	for l.queued.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, queueDepth, _, err := l.acquire(context.Background())
+	if !errors.Is(err, errOverloaded) {
+		t.Fatalf("got error %v, want errOverloaded", err)
+	}
+	if queueDepth != 1 {
+		t.Errorf("got queue depth %d, want 1", queueDepth)
+	}
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("queued request failed: %v", err)
+	}
+}
+
+func TestConcurrencyLimiterMaxWait(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyConfig{
+		MaxInFlight: 1,
+		MaxQueued:   1,
+		MaxWait:     caddy.Duration(10 * time.Millisecond),
+	})
+
+	release, _, _, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+
+	_, _, waited, err := l.acquire(context.Background())
+	if !errors.Is(err, errOverloaded) {
+		t.Fatalf("got error %v, want errOverloaded", err)
+	}
+	if waited < 10*time.Millisecond {
+		t.Errorf("waited %s, want at least 10ms", waited)
+	}
+}
+
+func TestConcurrencyLimiterContextDone(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyConfig{MaxInFlight: 1, MaxQueued: 1})
+
+	release, _, _, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err = l.acquire(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestConcurrencyLimiterShared(t *testing.T) {
+	config := ConcurrencyConfig{MaxInFlight: 1, MaxQueued: 7}
+	first, err := loadConcurrencyLimiter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.release()
+	second, err := loadConcurrencyLimiter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.release()
+
+	// A slot taken through one handler's limiter is unavailable to the other's.
+	release, _, _, err := first.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err = second.acquire(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+
+	other, err := loadConcurrencyLimiter(ConcurrencyConfig{MaxInFlight: 2, MaxQueued: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.release()
+	if other == first {
+		t.Error("limiters with different configurations are shared")
+	}
+}
@@ -0,0 +1,805 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/caddyserver/certmagic"
+	"github.com/liujed/goutil/optionals"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// The key in Caddy storage at which delegated accounts are persisted.
+const delegatedAccountsStorageKey = "dns01proxy/delegated_accounts.json"
+
+// The user ID of a delegated account is its delegator's user ID, followed by
+// this separator and a name that matches delegatedAccountNameRegexp.
+const delegatedAccountSeparator = "/"
+
+var delegatedAccountNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// An account that a delegator created through the `/delegation` endpoints, as
+// persisted in Caddy storage and as listed by the `/delegation` endpoint.
+type DelegatedAccount struct {
+	UserID string `json:"user_id"`
+
+	// The user ID of the delegator that created the account.
+	Parent string `json:"parent"`
+
+	// The account's domain policy. These follow the same rules as
+	// [ClientPolicy.AllowDomainsRaw] and [ClientPolicy.DenyDomainsRaw], except
+	// that placeholders are not allowed.
+	AllowDomains []string `json:"allow_domains"`
+	DenyDomains  []string `json:"deny_domains,omitempty"`
+
+	// Whether the account can itself create delegated accounts.
+	Delegator bool `json:"delegator,omitempty"`
+
+	// The SHA-256 hash, hex-encoded, of the account's API token. Not listed.
+	TokenSHA256 string `json:"token_sha256,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+}
+
+// The body of a request to create a delegated account.
+type CreateDelegatedAccountRequest struct {
+	// The account's name. Its user ID will be the delegator's user ID, followed
+	// by a slash and this name. Can contain letters, digits, `-` and `_`.
+	Name string `json:"name"`
+
+	AllowDomains []string `json:"allow_domains"`
+	DenyDomains  []string `json:"deny_domains,omitempty"`
+	Delegator    bool     `json:"delegator,omitempty"`
+}
+
+// The body of a request to rotate the token of, or to delete, a delegated
+// account.
+type DelegatedAccountRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// The response to a request to create a delegated account or to rotate its
+// token. The token is not stored, so this is the only time that it is shown.
+type DelegatedAccountCredentials struct {
+	UserID string `json:"user_id"`
+	Token  string `json:"token"`
+}
+
+// Holds the delegated accounts, and authenticates them by their API tokens.
+// Shared by all handlers in the process, so that every handler sees a change as
+// soon as it is made. Changes made by other instances that share the storage
+// are picked up when the accounts are reloaded. Safe for concurrent use.
+type delegationStore struct {
+	mu      sync.RWMutex
+	ctx     caddy.Context
+	storage certmagic.Storage
+	logger  *zap.Logger
+
+	accounts map[string]*DelegatedAccount
+	policies map[string]*ClientPolicy
+
+	// Maps each token's SHA-256 hash to the user ID of its account.
+	tokens map[[sha256.Size]byte]string
+
+	// When the accounts were last loaded successfully.
+	loadedAt time.Time
+
+	// When the accounts were last loaded, successfully or not.
+	attemptedAt time.Time
+
+	// Ensures that concurrent requests share a single reload.
+	reloads singleflight.Group
+}
+
+var (
+	_ caddyauth.Authenticator = (*delegationStore)(nil)
+	_ caddy.Destructor        = (*delegationStore)(nil)
+)
+
+const (
+	// The key under which the delegationStore is held in delegationPool.
+	delegationStorePoolKey = "delegated_accounts"
+
+	// How long the delegated accounts are used before they are reloaded from
+	// storage, so that accounts deleted by other instances stop working.
+	delegatedAccountsRefresh = 30 * time.Second
+
+	// The minimum time between reloads, however often unknown tokens arrive.
+	minDelegatedAccountsReloadPeriod = 5 * time.Second
+)
+
+// Holds the delegationStore, shared across handlers and config reloads.
+var delegationPool = caddy.NewUsagePool()
+
+// Returns the delegationStore, creating it if needed, and loads the delegated
+// accounts from Caddy storage. The store is attached to the given context, so
+// that it uses the newest configuration's storage. The store must be released
+// when it is no longer used.
+func loadDelegationStore(ctx caddy.Context, logger *zap.Logger) (*delegationStore, error) {
+	shared, _, err := delegationPool.LoadOrNew(
+		delegationStorePoolKey,
+		func() (caddy.Destructor, error) {
+			return &delegationStore{}, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := shared.(*delegationStore)
+
+	result.mu.Lock()
+	result.ctx = ctx
+	result.storage = ctx.Storage()
+	result.logger = logger
+	result.mu.Unlock()
+
+	accounts, err := result.load(ctx)
+	if err != nil {
+		return nil, errors.Join(err, result.release())
+	}
+	result.index(accounts)
+	return result, nil
+}
+
+// Releases a reference to a store that was obtained from loadDelegationStore.
+func (s *delegationStore) release() error {
+	_, err := delegationPool.Delete(delegationStorePoolKey)
+	return err
+}
+
+func (s *delegationStore) Destruct() error {
+	return nil
+}
+
+// Reads the delegated accounts from storage.
+func (s *delegationStore) load(ctx context.Context) (map[string]*DelegatedAccount, error) {
+	s.mu.RLock()
+	storage := s.storage
+	s.mu.RUnlock()
+
+	accounts := map[string]*DelegatedAccount{}
+	accountsJSON, err := storage.Load(ctx, delegatedAccountsStorageKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return accounts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load delegated accounts: %w", err)
+	}
+
+	var accountList []*DelegatedAccount
+	err = json.Unmarshal(accountsJSON, &accountList)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse delegated accounts: %w", err)
+	}
+	for _, account := range accountList {
+		accounts[account.UserID] = account
+	}
+	return accounts, nil
+}
+
+// Provisions the given accounts and makes them current. Accounts that fail to
+// provision are skipped.
+func (s *delegationStore) index(accounts map[string]*DelegatedAccount) {
+	s.mu.RLock()
+	ctx, logger := s.ctx, s.logger
+	s.mu.RUnlock()
+
+	policies := map[string]*ClientPolicy{}
+	tokens := map[[sha256.Size]byte]string{}
+	for userID, account := range accounts {
+		policy, err := account.provision(ctx)
+		if err != nil {
+			logger.Warn(
+				"skipping invalid delegated account",
+				zap.String("user_id", userID),
+				zap.Error(err),
+			)
+			continue
+		}
+		hashBytes, err := hex.DecodeString(account.TokenSHA256)
+		if err != nil || len(hashBytes) != sha256.Size {
+			logger.Warn(
+				"skipping delegated account without a valid token hash",
+				zap.String("user_id", userID),
+			)
+			continue
+		}
+		policies[userID] = policy
+		tokens[[sha256.Size]byte(hashBytes)] = userID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts = accounts
+	s.policies = policies
+	s.tokens = tokens
+	s.loadedAt = time.Now()
+	s.attemptedAt = s.loadedAt
+}
+
+// Reloads the accounts from storage if they are stale, or if forceReload is
+// true, subject to a minimum period between reloads. If the reload fails, then
+// the current accounts are kept.
+func (s *delegationStore) refresh(ctx context.Context, forceReload bool) {
+	s.mu.RLock()
+	shouldReload := s.shouldReloadLocked(forceReload, time.Now())
+	s.mu.RUnlock()
+	if !shouldReload {
+		return
+	}
+
+	s.reloads.Do("", func() (any, error) {
+		// Check again, in case another reload finished in the meantime.
+		s.mu.Lock()
+		if !s.shouldReloadLocked(forceReload, time.Now()) {
+			s.mu.Unlock()
+			return nil, nil
+		}
+		s.attemptedAt = time.Now()
+		logger := s.logger
+		s.mu.Unlock()
+
+		accounts, err := s.load(ctx)
+		if err != nil {
+			logger.Error("unable to reload delegated accounts", zap.Error(err))
+			return nil, nil
+		}
+		s.index(accounts)
+		return nil, nil
+	})
+}
+
+// Determines whether the accounts should be reloaded. Must be called with the
+// lock held.
+func (s *delegationStore) shouldReloadLocked(forceReload bool, now time.Time) bool {
+	stale := now.Sub(s.loadedAt) > delegatedAccountsRefresh
+	return (stale || forceReload) && now.Sub(s.attemptedAt) > minDelegatedAccountsReloadPeriod
+}
+
+// Returns the policy configuration for the given delegated account, if it
+// exists.
+func (s *delegationStore) policy(userID string) (*ClientPolicy, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policy, exists := s.policies[userID]
+	return policy, exists
+}
+
+// Applies the given change to the delegated accounts, and persists the result.
+// The accounts are reloaded from storage first, so that changes made by other
+// instances sharing the storage are not lost.
+func (s *delegationStore) update(
+	ctx context.Context,
+	change func(accounts map[string]*DelegatedAccount) error,
+) error {
+	s.mu.RLock()
+	storage, logger := s.storage, s.logger
+	s.mu.RUnlock()
+
+	err := storage.Lock(ctx, delegatedAccountsStorageKey)
+	if err != nil {
+		return fmt.Errorf("unable to lock delegated accounts: %w", err)
+	}
+	defer func() {
+		err := storage.Unlock(context.Background(), delegatedAccountsStorageKey)
+		if err != nil {
+			logger.Error("unable to unlock delegated accounts", zap.Error(err))
+		}
+	}()
+
+	accounts, err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+	err = change(accounts)
+	if err != nil {
+		return err
+	}
+
+	accountList := make([]*DelegatedAccount, 0, len(accounts))
+	for _, account := range accounts {
+		accountList = append(accountList, account)
+	}
+	sort.Slice(accountList, func(i, j int) bool {
+		return accountList[i].UserID < accountList[j].UserID
+	})
+	accountsJSON, err := json.Marshal(accountList)
+	if err != nil {
+		return fmt.Errorf("unable to marshal delegated accounts: %w", err)
+	}
+	err = storage.Store(ctx, delegatedAccountsStorageKey, accountsJSON)
+	if err != nil {
+		return fmt.Errorf("unable to store delegated accounts: %w", err)
+	}
+
+	s.index(accounts)
+	return nil
+}
+
+// Returns the delegated accounts that are descendants of the given user,
+// sorted by user ID.
+func (s *delegationStore) subtree(userID string) []DelegatedAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []DelegatedAccount{}
+	for _, account := range s.accounts {
+		if isDelegatedDescendant(s.accounts, account.UserID, userID) {
+			listed := *account
+			listed.TokenSHA256 = ""
+			result = append(result, listed)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UserID < result[j].UserID
+	})
+	return result
+}
+
+// Determines whether the given delegated account was created by the given
+// ancestor, directly or through other delegated accounts.
+func isDelegatedDescendant(
+	accounts map[string]*DelegatedAccount,
+	userID string,
+	ancestorID string,
+) bool {
+	// Bound the walk, in case the stored accounts have been edited into a cycle.
+	for range len(accounts) {
+		account, exists := accounts[userID]
+		if !exists {
+			return false
+		}
+		if account.Parent == ancestorID {
+			return true
+		}
+		userID = account.Parent
+	}
+	return false
+}
+
+func (s *delegationStore) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	const bearerPrefix = "Bearer "
+	authz := req.Header.Get("Authorization")
+	if len(authz) <= len(bearerPrefix) ||
+		!strings.EqualFold(authz[:len(bearerPrefix)], bearerPrefix) {
+		return caddyauth.User{}, false, nil
+	}
+
+	hash := sha256.Sum256([]byte(strings.TrimSpace(authz[len(bearerPrefix):])))
+	s.refresh(req.Context(), false)
+	userID, exists := s.tokenUserID(hash)
+	if !exists {
+		// The token may have been issued by another instance since the accounts
+		// were last loaded.
+		s.refresh(req.Context(), true)
+		userID, exists = s.tokenUserID(hash)
+	}
+	if !exists {
+		return caddyauth.User{}, false, nil
+	}
+	return caddyauth.User{ID: userID}, true, nil
+}
+
+// Returns the user ID of the account with the given token hash, if any.
+func (s *delegationStore) tokenUserID(hash [sha256.Size]byte) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	userID, exists := s.tokens[hash]
+	return userID, exists
+}
+
+// Builds the policy configuration for the given delegated account, in the
+// store's current context.
+func (s *delegationStore) provision(account *DelegatedAccount) (*ClientPolicy, error) {
+	s.mu.RLock()
+	ctx := s.ctx
+	s.mu.RUnlock()
+	return account.provision(ctx)
+}
+
+// Builds the policy configuration for the delegated account.
+func (a *DelegatedAccount) provision(ctx caddy.Context) (*ClientPolicy, error) {
+	if !strings.HasPrefix(a.UserID, a.Parent+delegatedAccountSeparator) {
+		return nil, fmt.Errorf("user ID is not below its delegator's")
+	}
+	for _, domain := range slices.Concat(a.AllowDomains, a.DenyDomains) {
+		if strings.ContainsAny(domain, "{}") {
+			return nil, fmt.Errorf("domain %q has a placeholder", domain)
+		}
+	}
+	if len(a.AllowDomains) == 0 {
+		return nil, fmt.Errorf("no allowed domains")
+	}
+
+	policy := &ClientPolicy{
+		UserID:          a.UserID,
+		Delegator:       a.Delegator,
+		AllowDomainsRaw: slices.Clone(a.AllowDomains),
+		DenyDomainsRaw:  slices.Clone(a.DenyDomains),
+		delegatedBy:     a.Parent,
+	}
+	err := policy.Provision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Checks that each of the given domains, which follow Smallstep's domain name
+// rules, is allowed by the delegator's domain policy.
+func (c *ClientPolicy) checkDelegatedDomains(domains []string) error {
+	for _, domain := range domains {
+		// A wildcard covers every name one label below the wildcard, so the
+		// delegator must allow the same wildcard, unless it allows everything.
+		if name, isWildcard := cutDomainWildcard(domain); isWildcard {
+			if len(c.AllowDomainsRaw) == 0 {
+				continue
+			}
+			allowed := slices.ContainsFunc(c.AllowDomainsRaw, func(allowed string) bool {
+				allowedName, allowedWildcard := cutDomainWildcard(allowed)
+				return allowedWildcard && strings.EqualFold(allowedName, name)
+			})
+			if !allowed {
+				return fmt.Errorf("domain %q is outside the delegation", domain)
+			}
+			continue
+		}
+
+		denyReasonOpt, err := checkDomainPolicy(c.DomainPolicy, domain)
+		if err != nil {
+			return err
+		}
+		if denyReasonOpt.IsSome() {
+			return fmt.Errorf("domain %q is outside the delegation", domain)
+		}
+	}
+	return nil
+}
+
+// Strips the subdomain marker, `*.` or `.`, from the given domain. Returns
+// whether there was one.
+func cutDomainWildcard(domain string) (string, bool) {
+	if name, found := strings.CutPrefix(domain, "*."); found {
+		return name, true
+	}
+	return strings.CutPrefix(domain, ".")
+}
+
+// Returns the given user's chain of delegators, starting with the user's own
+// delegator. Returns false if any of them no longer exists, is no longer a
+// delegator, or can't currently be used.
+func (r *ClientRegistry) delegators(config *ClientPolicy) ([]*ClientPolicy, bool) {
+	var result []*ClientPolicy
+	now := time.Now()
+	for parentID := config.delegatedBy; parentID != ""; {
+		parent, exists := r.clients[parentID]
+		if !exists && r.delegated != nil {
+			parent, exists = r.delegated.policy(parentID)
+		}
+		if !exists || !parent.Delegator || parent.checkLifecycle(now).IsSome() {
+			return nil, false
+		}
+		result = append(result, parent)
+		parentID = parent.delegatedBy
+	}
+	return result, true
+}
+
+// Returns the policy for the given delegated account, bound by the restrictions
+// of the configured account at the root of its delegation chain. Returns false
+// if the delegation has been revoked.
+func (r *ClientRegistry) delegatedPolicy(config *ClientPolicy) (*ClientPolicy, bool) {
+	delegators, ok := r.delegators(config)
+	if !ok || len(delegators) == 0 {
+		return nil, false
+	}
+	return config.withDelegatorRestrictions(delegators[len(delegators)-1]), true
+}
+
+// Returns a copy of this delegated account's policy that carries the given
+// configured account's restrictions: its lifecycle, allowed networks, IP
+// binding, subdomain depth, CEL policy, TTLs and limits. Delegated accounts have
+// none of these of their own. Usage is tracked against the configured account,
+// so that everything its delegated accounts do counts against its limits.
+func (c *ClientPolicy) withDelegatorRestrictions(root *ClientPolicy) *ClientPolicy {
+	result := *c
+	result.Disabled = root.Disabled
+	result.NotBefore = root.NotBefore
+	result.NotAfter = root.NotAfter
+	result.ActiveHours = root.ActiveHours
+	result.AllowedNetworksRaw = root.AllowedNetworksRaw
+	result.allowedNetworks = root.allowedNetworks
+	result.BindToClientIP = root.BindToClientIP
+	result.MaxSubdomainDepth = root.MaxSubdomainDepth
+	result.CEL = root.CEL
+	result.celPolicy = root.celPolicy
+	result.Limits = root.Limits
+	result.TTL = root.TTL
+	result.MinTTL = root.MinTTL
+	result.MaxTTL = root.MaxTTL
+	result.limitsUserID = root.UserID
+	return &result
+}
+
+// Returns the user ID of the account against whose limits the user's usage is
+// tracked.
+func (c *ClientPolicy) usageUserID() string {
+	if c.limitsUserID != "" {
+		return c.limitsUserID
+	}
+	return c.UserID
+}
+
+// Checks the given domain against the domain policies of the given user's
+// delegators, if any. Returns None if the domain is allowed. Otherwise, returns
+// the reason for denial.
+func (r *ClientRegistry) checkDelegatorDomainPolicies(
+	config *ClientPolicy,
+	domain string,
+) (optionals.Optional[DenyReason], error) {
+	if config.delegatedBy == "" {
+		return optionals.None[DenyReason](), nil
+	}
+	delegators, ok := r.delegators(config)
+	if !ok {
+		return optionals.Some(DenyDelegationRevoked), nil
+	}
+	for _, delegator := range delegators {
+		denyReasonOpt, err := checkDomainPolicy(delegator.DomainPolicy, domain)
+		if err != nil || denyReasonOpt.IsSome() {
+			return denyReasonOpt, err
+		}
+	}
+	return optionals.None[DenyReason](), nil
+}
+
+// Checks that the authenticated user is a delegator that can currently create
+// delegated accounts. Returns the user's policy if so.
+func (h *Handler) authorizeDelegator(req *http.Request) (*ClientPolicy, bool, error) {
+	userID, err := authenticatedUserID(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Users that fall back to the default account are not delegators.
+	policy, exists := h.ClientRegistry.Policy(userID)
+	if !exists || policy.UserID != userID || !policy.Delegator {
+		addLogField(req, zap.String(logAuthorizationFailure, string(DenyNotDelegator)))
+		return nil, false, nil
+	}
+	if denyReason, denied := policy.checkLifecycle(time.Now()).Get(); denied {
+		addLogField(req, zap.String(logAuthorizationFailure, string(denyReason)))
+		return nil, false, nil
+	}
+	if _, ok := h.ClientRegistry.delegators(policy); !ok {
+		addLogField(req, zap.String(logAuthorizationFailure, string(DenyDelegationRevoked)))
+		return nil, false, nil
+	}
+	return policy, true, nil
+}
+
+// Handles a request to list the delegated accounts that the user administers.
+func (h *Handler) serveDelegatedAccountList(w http.ResponseWriter, req *http.Request) error {
+	delegator, ok, err := h.authorizeDelegator(req)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(h.delegation.subtree(delegator.UserID))
+	if err != nil {
+		return fmt.Errorf("unable to write response body: %w", err)
+	}
+	return nil
+}
+
+// Handles a request to create a delegated account.
+func (h *Handler) serveCreateDelegatedAccount(
+	req *http.Request,
+	reqBody CreateDelegatedAccountRequest,
+	respHeader http.Header,
+) (int, optionals.Optional[DelegatedAccountCredentials], error) {
+	delegator, ok, err := h.authorizeDelegator(req)
+	if err != nil {
+		return 0, optionals.None[DelegatedAccountCredentials](), err
+	}
+	if !ok {
+		return http.StatusForbidden, optionals.None[DelegatedAccountCredentials](), nil
+	}
+
+	if !delegatedAccountNameRegexp.MatchString(reqBody.Name) {
+		return http.StatusBadRequest, optionals.None[DelegatedAccountCredentials](), nil
+	}
+	userID := delegator.UserID + delegatedAccountSeparator + reqBody.Name
+	addLogField(req, zap.String(logDelegatedUserID, userID))
+
+	// Check the new account's domain policy before anything is stored. Its
+	// allowed domains must fall within the delegator's.
+	account := &DelegatedAccount{
+		UserID:       userID,
+		Parent:       delegator.UserID,
+		AllowDomains: reqBody.AllowDomains,
+		DenyDomains:  reqBody.DenyDomains,
+		Delegator:    reqBody.Delegator,
+		CreatedAt:    time.Now(),
+	}
+	_, err = h.delegation.provision(account)
+	if err != nil {
+		return http.StatusBadRequest, optionals.None[DelegatedAccountCredentials](), nil
+	}
+	err = delegator.checkDelegatedDomains(reqBody.AllowDomains)
+	if err == nil {
+		err = h.zoneGuard.checkAllowDomains(fmt.Sprintf("user ID %q", userID), reqBody.AllowDomains)
+	}
+	if err != nil {
+		addLogField(req, zap.String(logAuthorizationFailure, string(DenyOutsideDelegation)))
+		return http.StatusForbidden, optionals.None[DelegatedAccountCredentials](), nil
+	}
+
+	token, tokenHash, err := newDelegatedAccountToken()
+	if err != nil {
+		return 0, optionals.None[DelegatedAccountCredentials](), err
+	}
+	account.TokenSHA256 = tokenHash
+
+	errConflict := errors.New("user ID is taken")
+	err = h.delegation.update(req.Context(), func(accounts map[string]*DelegatedAccount) error {
+		if _, exists := accounts[userID]; exists {
+			return errConflict
+		}
+		accounts[userID] = account
+		return nil
+	})
+	if errors.Is(err, errConflict) {
+		return http.StatusConflict, optionals.None[DelegatedAccountCredentials](), nil
+	}
+	if err != nil {
+		return 0, optionals.None[DelegatedAccountCredentials](), err
+	}
+
+	h.logger.Info(
+		"delegated account created",
+		zap.String("user_id", userID),
+		zap.String("delegator", delegator.UserID),
+		zap.Strings("allow_domains", account.AllowDomains),
+		zap.Strings("deny_domains", account.DenyDomains),
+	)
+	return http.StatusOK, optionals.Some(DelegatedAccountCredentials{
+		UserID: userID,
+		Token:  token,
+	}), nil
+}
+
+// Handles a request to replace a delegated account's API token.
+func (h *Handler) serveRotateDelegatedAccount(
+	req *http.Request,
+	reqBody DelegatedAccountRequest,
+	respHeader http.Header,
+) (int, optionals.Optional[DelegatedAccountCredentials], error) {
+	delegator, ok, err := h.authorizeDelegator(req)
+	if err != nil {
+		return 0, optionals.None[DelegatedAccountCredentials](), err
+	}
+	if !ok {
+		return http.StatusForbidden, optionals.None[DelegatedAccountCredentials](), nil
+	}
+	addLogField(req, zap.String(logDelegatedUserID, reqBody.UserID))
+
+	token, tokenHash, err := newDelegatedAccountToken()
+	if err != nil {
+		return 0, optionals.None[DelegatedAccountCredentials](), err
+	}
+
+	errNotFound := errors.New("delegated account not found")
+	err = h.delegation.update(req.Context(), func(accounts map[string]*DelegatedAccount) error {
+		if !isDelegatedDescendant(accounts, reqBody.UserID, delegator.UserID) {
+			return errNotFound
+		}
+		now := time.Now()
+		account := accounts[reqBody.UserID]
+		account.TokenSHA256 = tokenHash
+		account.RotatedAt = &now
+		return nil
+	})
+	if errors.Is(err, errNotFound) {
+		return http.StatusNotFound, optionals.None[DelegatedAccountCredentials](), nil
+	}
+	if err != nil {
+		return 0, optionals.None[DelegatedAccountCredentials](), err
+	}
+
+	h.logger.Info(
+		"delegated account token rotated",
+		zap.String("user_id", reqBody.UserID),
+		zap.String("delegator", delegator.UserID),
+	)
+	return http.StatusOK, optionals.Some(DelegatedAccountCredentials{
+		UserID: reqBody.UserID,
+		Token:  token,
+	}), nil
+}
+
+// Handles a request to delete a delegated account, along with any accounts
+// that it created.
+func (h *Handler) serveDeleteDelegatedAccount(
+	req *http.Request,
+	reqBody DelegatedAccountRequest,
+	respHeader http.Header,
+) (int, optionals.Optional[struct{}], error) {
+	delegator, ok, err := h.authorizeDelegator(req)
+	if err != nil {
+		return 0, optionals.None[struct{}](), err
+	}
+	if !ok {
+		return http.StatusForbidden, optionals.None[struct{}](), nil
+	}
+	addLogField(req, zap.String(logDelegatedUserID, reqBody.UserID))
+
+	errNotFound := errors.New("delegated account not found")
+	var deleted []string
+	err = h.delegation.update(req.Context(), func(accounts map[string]*DelegatedAccount) error {
+		if !isDelegatedDescendant(accounts, reqBody.UserID, delegator.UserID) {
+			return errNotFound
+		}
+		for userID := range accounts {
+			if userID == reqBody.UserID ||
+				isDelegatedDescendant(accounts, userID, reqBody.UserID) {
+				deleted = append(deleted, userID)
+			}
+		}
+		for _, userID := range deleted {
+			delete(accounts, userID)
+		}
+		return nil
+	})
+	if errors.Is(err, errNotFound) {
+		return http.StatusNotFound, optionals.None[struct{}](), nil
+	}
+	if err != nil {
+		return 0, optionals.None[struct{}](), err
+	}
+
+	sort.Strings(deleted)
+	h.logger.Info(
+		"delegated accounts deleted",
+		zap.Strings("user_ids", deleted),
+		zap.String("delegator", delegator.UserID),
+	)
+	return http.StatusNoContent, optionals.None[struct{}](), nil
+}
+
+// Generates an API token for a delegated account. Returns the token and its
+// SHA-256 hash, hex-encoded.
+func newDelegatedAccountToken() (string, string, error) {
+	var tokenBytes [32]byte
+	_, err := rand.Read(tokenBytes[:])
+	if err != nil {
+		return "", "", fmt.Errorf("unable to generate API token: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes[:])
+	hash := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,346 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/liujed/goutil/optionals"
+	"go.uber.org/zap"
+)
+
+// Returns a delegation store backed by the given storage, with its accounts
+// loaded.
+func newTestDelegationStore(t *testing.T, storage certmagic.Storage) *delegationStore {
+	t.Helper()
+	store := &delegationStore{
+		ctx:     newTestContext(t),
+		storage: storage,
+		logger:  zap.NewNop(),
+	}
+	accounts, err := store.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.index(accounts)
+	return store
+}
+
+// Stores the given accounts, with the given tokens.
+func putDelegatedAccounts(
+	t *testing.T,
+	store *delegationStore,
+	tokens map[string]string,
+	accounts ...*DelegatedAccount,
+) {
+	t.Helper()
+	err := store.update(context.Background(), func(stored map[string]*DelegatedAccount) error {
+		for _, account := range accounts {
+			account.TokenSHA256 = tokenHash(tokens[account.UserID])
+			stored[account.UserID] = account
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectDelegatedUser(t *testing.T, store *delegationStore, token string, want string) {
+	t.Helper()
+	user, authenticated, err := store.Authenticate(nil, requestWithBearer(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticated != (want != "") || user.ID != want {
+		t.Errorf("got user %q (%v), want %q", user.ID, authenticated, want)
+	}
+}
+
+// Makes the store's accounts stale, and allows them to be reloaded.
+func ageDelegationStore(store *delegationStore) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.loadedAt = store.loadedAt.Add(-delegatedAccountsRefresh - time.Second)
+	store.attemptedAt = store.attemptedAt.Add(-delegatedAccountsRefresh - time.Second)
+}
+
+func TestDelegatedAccountsReload(t *testing.T) {
+	// Two instances share the storage.
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	local := newTestDelegationStore(t, storage)
+	remote := newTestDelegationStore(t, storage)
+
+	tokens := map[string]string{"alice/ci": "ci-token"}
+	putDelegatedAccounts(t, remote, tokens, &DelegatedAccount{
+		UserID:       "alice/ci",
+		Parent:       "alice",
+		AllowDomains: []string{"ci.example.com"},
+	})
+	expectDelegatedUser(t, remote, "ci-token", "alice/ci")
+
+	// An unknown token makes the other instance reload, but not more often than
+	// minDelegatedAccountsReloadPeriod.
+	expectDelegatedUser(t, local, "ci-token", "")
+	local.mu.Lock()
+	local.attemptedAt = local.attemptedAt.Add(-minDelegatedAccountsReloadPeriod - time.Second)
+	local.mu.Unlock()
+	expectDelegatedUser(t, local, "ci-token", "alice/ci")
+
+	// A deleted account keeps working only until the accounts are stale.
+	err := remote.update(context.Background(), func(accounts map[string]*DelegatedAccount) error {
+		delete(accounts, "alice/ci")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDelegatedUser(t, local, "ci-token", "alice/ci")
+	ageDelegationStore(local)
+	expectDelegatedUser(t, local, "ci-token", "")
+	if _, exists := local.policy("alice/ci"); exists {
+		t.Error("deleted account still has a policy")
+	}
+}
+
+func TestDelegatedAccountsSkipInvalid(t *testing.T) {
+	store := newTestDelegationStore(t, &certmagic.FileStorage{Path: t.TempDir()})
+	tokens := map[string]string{"alice/ci": "ci-token", "bob/ci": "bob-token"}
+	putDelegatedAccounts(t, store, tokens,
+		&DelegatedAccount{
+			UserID:       "alice/ci",
+			Parent:       "alice",
+			AllowDomains: []string{"ci.example.com"},
+		},
+		// Not below its delegator's user ID.
+		&DelegatedAccount{
+			UserID:       "bob/ci",
+			Parent:       "alice",
+			AllowDomains: []string{"ci.example.com"},
+		},
+	)
+	expectDelegatedUser(t, store, "ci-token", "alice/ci")
+	expectDelegatedUser(t, store, "bob-token", "")
+}
+
+// Returns a registry whose delegator, alice, has created alice/ci, which has
+// in turn created alice/ci/build. Alice's account has the given restrictions.
+func newTestDelegationRegistry(t *testing.T, delegator ClientPolicy) *ClientRegistry {
+	t.Helper()
+	store := newTestDelegationStore(t, &certmagic.FileStorage{Path: t.TempDir()})
+	putDelegatedAccounts(t, store, map[string]string{},
+		&DelegatedAccount{
+			UserID:       "alice/ci",
+			Parent:       "alice",
+			AllowDomains: []string{"ci.example.com", "build.example.com", "secret.example.com"},
+			Delegator:    true,
+		},
+		&DelegatedAccount{
+			UserID:       "alice/ci/build",
+			Parent:       "alice/ci",
+			AllowDomains: []string{"build.example.com"},
+		},
+	)
+
+	delegator.UserID = "alice"
+	delegator.Delegator = true
+	delegator.AllowDomainsRaw = []string{"*.example.com", "example.com"}
+	registry := &ClientRegistry{}
+	err := registry.Provision(
+		newTestContext(t),
+		[]RawAccount{{ClientPolicy: delegator}},
+		nil,
+		false,
+		nil,
+		store,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestDelegatedAccountDomainPolicy(t *testing.T) {
+	registry := newTestDelegationRegistry(t, ClientPolicy{
+		DenyDomainsRaw: []string{"secret.example.com"},
+	})
+
+	req := authedRequest("alice/ci", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "ci.example.com", optionals.None[DenyReason]())
+	expectAuthorization(t, registry, req, "www.example.com", optionals.Some(DenyDomainNotAllowed))
+
+	// The delegator's denials apply to the accounts that it created.
+	expectAuthorization(t, registry, req, "secret.example.com", optionals.Some(DenyDomainNotAllowed))
+
+	req = authedRequest("alice/ci/build", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "build.example.com", optionals.None[DenyReason]())
+	expectAuthorization(t, registry, req, "ci.example.com", optionals.Some(DenyDomainNotAllowed))
+}
+
+func TestDelegatedAccountInheritsRestrictions(t *testing.T) {
+	registry := newTestDelegationRegistry(t, ClientPolicy{
+		AllowedNetworksRaw: []string{"192.0.2.0/24"},
+		CEL:                `zone == "example.com"`,
+		Limits:             &AccountLimits{PresentsPerDay: 1},
+		MinTTL:             durationPtr(time.Minute),
+		MaxTTL:             durationPtr(time.Hour),
+	})
+	alice, _ := registry.Policy("alice")
+
+	for _, userID := range []string{"alice/ci", "alice/ci/build"} {
+		policy, exists := registry.Policy(userID)
+		if !exists {
+			t.Fatalf("%s: no policy", userID)
+		}
+		if policy.UserID != userID {
+			t.Errorf("%s: got user ID %q", userID, policy.UserID)
+		}
+		if len(policy.allowedNetworks) != 1 {
+			t.Errorf("%s: allowed networks not inherited", userID)
+		}
+		if policy.celPolicy != alice.celPolicy {
+			t.Errorf("%s: CEL policy not inherited", userID)
+		}
+		if policy.Limits != alice.Limits || policy.usageUserID() != "alice" {
+			t.Errorf("%s: limits not shared with the delegator", userID)
+		}
+		ttl := (&DNSConfig{}).recordTTL(policy, "example.com.", intPtr(1))
+		if ttl != time.Minute {
+			t.Errorf("%s: got TTL %s, want 1m", userID, ttl)
+		}
+	}
+
+	// The stored policies are left alone.
+	stored, _ := registry.delegated.policy("alice/ci")
+	if stored.Limits != nil || stored.limitsUserID != "" {
+		t.Error("stored policy was modified")
+	}
+
+	req := authedRequest("alice/ci", "198.51.100.1", nil)
+	expectAuthorization(t, registry, req, "ci.example.com", optionals.Some(DenyNetworkNotAllowed))
+	req = authedRequest("alice/ci/build", "198.51.100.1", nil)
+	expectAuthorization(t, registry, req, "build.example.com", optionals.Some(DenyNetworkNotAllowed))
+}
+
+func TestDelegatedAccountUsageChargedToDelegator(t *testing.T) {
+	registry := newTestDelegationRegistry(t, ClientPolicy{
+		Limits: &AccountLimits{PresentsPerDay: 1},
+	})
+	usage := &usageTracker{}
+	err := usage.Provision(newTestContext(t), registry, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { usage.Cleanup() })
+
+	reserve := func(userID string, value string) optionals.Optional[DenyReason] {
+		policy, _ := registry.Policy(userID)
+		denyReasonOpt, commit := usage.Reserve(
+			policy.usageUserID(),
+			policy.Limits,
+			hmPresent,
+			testRequestBody(value),
+		)
+		if denyReasonOpt.IsNone() {
+			commit(true)
+		}
+		return denyReasonOpt
+	}
+
+	// The delegated account's present uses up the delegator's daily quota.
+	expectDenyReason(t, reserve("alice/ci/build", "a"), optionals.None[DenyReason]())
+	expectDenyReason(t, reserve("alice/ci", "b"), optionals.Some(DenyQuotaExceeded))
+	expectDenyReason(t, reserve("alice", "c"), optionals.Some(DenyQuotaExceeded))
+}
+
+func TestDelegatedAccountRevoked(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	registry := newTestDelegationRegistry(t, ClientPolicy{NotAfter: &past})
+
+	req := authedRequest("alice/ci", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "ci.example.com", optionals.Some(DenyDelegationRevoked))
+	req = authedRequest("alice/ci/build", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "build.example.com", optionals.Some(DenyDelegationRevoked))
+
+	policy, _ := registry.Policy("alice/ci")
+	if policy.limitsUserID != "" {
+		t.Error("revoked account was given its delegator's limits")
+	}
+}
+
+func TestDelegatedUserIDsReserved(t *testing.T) {
+	registry := &ClientRegistry{}
+	err := registry.Provision(
+		newTestContext(t),
+		[]RawAccount{{
+			ClientPolicy: ClientPolicy{
+				UserID:          "alice/ci",
+				AllowDomainsRaw: []string{"ci.example.com"},
+			},
+		}},
+		nil,
+		false,
+		nil,
+		nil,
+	)
+	if err == nil {
+		t.Error("expected an error for a user ID in the delegated namespace")
+	}
+}
+
+func TestIsDelegatedDescendant(t *testing.T) {
+	accounts := map[string]*DelegatedAccount{
+		"alice/ci":       {UserID: "alice/ci", Parent: "alice"},
+		"alice/ci/build": {UserID: "alice/ci/build", Parent: "alice/ci"},
+
+		// Edited into a cycle.
+		"bob/a": {UserID: "bob/a", Parent: "bob/b"},
+		"bob/b": {UserID: "bob/b", Parent: "bob/a"},
+	}
+	for _, test := range []struct {
+		userID   string
+		ancestor string
+		want     bool
+	}{
+		{"alice/ci", "alice", true},
+		{"alice/ci/build", "alice", true},
+		{"alice/ci/build", "alice/ci", true},
+		{"alice/ci", "alice/ci", false},
+		{"alice/ci", "alice/ci/build", false},
+		{"alice/other", "alice", false},
+		{"bob/a", "bob", false},
+	} {
+		got := isDelegatedDescendant(accounts, test.userID, test.ancestor)
+		if got != test.want {
+			t.Errorf("%s below %s: got %v, want %v", test.userID, test.ancestor, got, test.want)
+		}
+	}
+}
+
+func TestCheckDelegatedDomains(t *testing.T) {
+	delegator := &ClientPolicy{
+		UserID:          "alice",
+		Delegator:       true,
+		AllowDomainsRaw: []string{"*.example.com", "example.com"},
+		DenyDomainsRaw:  []string{"secret.example.com"},
+	}
+	if err := delegator.Provision(newTestContext(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for domain, wantErr := range map[string]bool{
+		"www.example.com":    false,
+		"*.example.com":      false,
+		".example.com":       false,
+		"example.com":        false,
+		"secret.example.com": true,
+		"*.www.example.com":  true,
+		"www.example.net":    true,
+	} {
+		err := delegator.checkDelegatedDomains([]string{domain})
+		if (err != nil) != wantErr {
+			t.Errorf("%s: got error %v, want error: %v", domain, err, wantErr)
+		}
+	}
+}
@@ -18,11 +18,25 @@ type DNSConfig struct {
 	// usually needed.
 	TTL *caddy.Duration `json:"ttl,omitempty"`
 
+	// Configuration for individual DNS zones, keyed by zone name. Optional.
+	Zones map[string]*ZoneConfig `json:"zones,omitempty"`
+
 	// Custom DNS resolvers to prefer over system or built-in defaults. Set this
 	// to a public resolver if you are using split-horizon DNS. Remember to also
 	// configure your ACME clients' resolvers, since both the ACME client and
 	// dns01proxy need to find your domain's SOA record.
 	Resolvers []string `json:"resolvers,omitempty"`
+
+	// Retries calls to the DNS provider that fail transiently. Optional. If
+	// omitted, then failed calls are not retried.
+	Retries *RetryConfig `json:"retries,omitempty"`
+
+	// Stops calling the DNS provider after repeated failures, so that clients
+	// are turned away quickly instead of piling onto a failing API. Optional.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// The provisioned version of [CircuitBreaker]. Optional.
+	breaker *circuitBreaker
 }
 
 var _ caddy.Provisioner = (*Handler)(nil)
@@ -32,11 +46,67 @@ func (d *DNSConfig) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("must configure a DNS provider")
 	}
 
+	// Normalize and validate the zone configuration.
+	zones := map[string]*ZoneConfig{}
+	for zone, zoneConfig := range d.Zones {
+		err := zoneConfig.validate()
+		if err != nil {
+			return fmt.Errorf("invalid configuration for zone %q: %w", zone, err)
+		}
+		zones[normalizeZone(zone)] = zoneConfig
+	}
+	d.Zones = zones
+
 	module, err := ctx.LoadModule(d, "ProviderRaw")
 	if err != nil {
 		return fmt.Errorf("unable to load DNS provider: %w", err)
 	}
 	d.Provider = module.(certmagic.DNSProvider)
 
+	// Wrap the provider with retries and a circuit breaker, if configured.
+	if d.Retries != nil || d.CircuitBreaker != nil {
+		provider := &resilientProvider{
+			provider: d.Provider,
+		}
+
+		if d.Retries != nil {
+			if d.Retries.MaxAttempts <= 0 {
+				d.Retries.MaxAttempts = defaultRetryMaxAttempts
+			}
+			if d.Retries.InitialBackoff <= 0 {
+				d.Retries.InitialBackoff = caddy.Duration(defaultRetryInitialBackoff)
+			}
+			if d.Retries.MaxBackoff <= 0 {
+				d.Retries.MaxBackoff = caddy.Duration(defaultRetryMaxBackoff)
+			}
+			provider.retries = d.Retries
+		}
+
+		if d.CircuitBreaker != nil {
+			config := *d.CircuitBreaker
+			if config.FailureThreshold <= 0 {
+				config.FailureThreshold = defaultCircuitBreakerFailureThreshold
+			}
+			if config.Cooldown <= 0 {
+				config.Cooldown = caddy.Duration(defaultCircuitBreakerCooldown)
+			}
+			d.breaker, err = loadCircuitBreaker(d.ProviderRaw, config)
+			if err != nil {
+				return fmt.Errorf("unable to load circuit breaker: %w", err)
+			}
+			provider.breaker = d.breaker
+		}
+
+		d.Provider = provider
+	}
+
 	return nil
 }
+
+// Releases the shared state that was loaded during provisioning.
+func (d *DNSConfig) Cleanup() error {
+	if d.breaker == nil {
+		return nil
+	}
+	return d.breaker.release()
+}
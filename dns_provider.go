@@ -0,0 +1,414 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+)
+
+// Configures retries of DNS provider calls that fail transiently: timeouts,
+// network errors, and HTTP 5xx and 429 responses. Other failures, such as
+// authentication failures and invalid zones, are returned right away. Since
+// appending a record isn't idempotent, an append that might have taken effect
+// before failing, e.g., one that timed out, is only retried if the DNS provider
+// can list records, and the record turns out not to be there.
+type RetryConfig struct {
+	// The maximum number of attempts for each DNS provider call, including the
+	// first. Defaults to 3.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// The delay before the first retry. The delay doubles with each subsequent
+	// retry, and random jitter is applied. Defaults to 1s.
+	InitialBackoff caddy.Duration `json:"initial_backoff,omitempty"`
+
+	// The maximum delay between retries. Defaults to 30s.
+	MaxBackoff caddy.Duration `json:"max_backoff,omitempty"`
+}
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = time.Second
+	defaultRetryMaxBackoff     = 30 * time.Second
+)
+
+// Configures a circuit breaker that stops calls to the DNS provider after
+// repeated failures.
+type CircuitBreakerConfig struct {
+	// The number of consecutive DNS provider calls that fail transiently after
+	// which the circuit breaker trips. Other failures, such as authentication
+	// failures, show that the DNS provider is up, and don't count. Defaults to 5.
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+
+	// How long the circuit breaker stays open before a single call is let
+	// through to test whether the DNS provider has recovered. Defaults to 1m.
+	Cooldown caddy.Duration `json:"cooldown,omitempty"`
+}
+
+const (
+	defaultCircuitBreakerFailureThreshold = 5
+	defaultCircuitBreakerCooldown         = time.Minute
+)
+
+// Returned when a DNS provider call is rejected because the circuit breaker is
+// open.
+type circuitOpenError struct {
+	// How long until the circuit breaker lets calls through again.
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf(
+		"DNS provider circuit breaker is open; retry after %s",
+		e.retryAfter,
+	)
+}
+
+// Wraps a DNS provider with retries and a circuit breaker.
+type resilientProvider struct {
+	provider certmagic.DNSProvider
+
+	// Optional.
+	retries *RetryConfig
+
+	// Optional.
+	breaker *circuitBreaker
+}
+
+var _ certmagic.DNSProvider = (*resilientProvider)(nil)
+
+func (p *resilientProvider) AppendRecords(
+	ctx context.Context,
+	zone string,
+	recs []libdns.Record,
+) ([]libdns.Record, error) {
+	// Appending isn't idempotent, so an append that might have taken effect is
+	// only retried if the records turn out not to be there.
+	applied := func() (bool, bool) {
+		return p.recordsPresent(ctx, zone, recs)
+	}
+	return p.call(ctx, applied, func() ([]libdns.Record, error) {
+		return p.provider.AppendRecords(ctx, zone, recs)
+	})
+}
+
+func (p *resilientProvider) DeleteRecords(
+	ctx context.Context,
+	zone string,
+	recs []libdns.Record,
+) ([]libdns.Record, error) {
+	return p.call(ctx, nil, func() ([]libdns.Record, error) {
+		return p.provider.DeleteRecords(ctx, zone, recs)
+	})
+}
+
+// Runs the given DNS provider call through the circuit breaker, retrying as
+// configured. See retry for the meaning of applied.
+func (p *resilientProvider) call(
+	ctx context.Context,
+	applied func() (bool, bool),
+	f func() ([]libdns.Record, error),
+) ([]libdns.Record, error) {
+	if p.breaker != nil {
+		err := p.breaker.allow()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := p.retry(ctx, applied, f)
+
+	if p.breaker != nil {
+		if ctx.Err() != nil {
+			// Cancellations are the client's doing and say nothing about the health
+			// of the DNS provider.
+			p.breaker.abandon()
+		} else if err == nil {
+			p.breaker.record(true)
+		} else if transient, _ := classifyProviderError(err); transient {
+			p.breaker.record(false)
+		} else {
+			// The DNS provider answered, so it is up, even though it refused the
+			// call.
+			p.breaker.record(true)
+		}
+	}
+
+	return result, err
+}
+
+// Calls f, retrying transient failures with exponential backoff and jitter.
+// Other failures are returned right away. If applied is non-nil, then f isn't
+// idempotent, and before a failure that might have taken effect is retried,
+// applied is called to find out whether it did. It returns whether f took
+// effect, and whether that could be determined. If f took effect, then the
+// call succeeds. If that couldn't be determined, then the failure is returned.
+func (p *resilientProvider) retry(
+	ctx context.Context,
+	applied func() (bool, bool),
+	f func() ([]libdns.Record, error),
+) ([]libdns.Record, error) {
+	if p.retries == nil {
+		return f()
+	}
+
+	backoff := time.Duration(p.retries.InitialBackoff)
+	for attempt := 1; ; attempt++ {
+		result, err := f()
+		if err == nil || attempt >= p.retries.MaxAttempts || ctx.Err() != nil {
+			return result, err
+		}
+		transient, ambiguous := classifyProviderError(err)
+		if !transient {
+			return result, err
+		}
+		if ambiguous && applied != nil {
+			took, known := applied()
+			if !known {
+				return result, err
+			}
+			if took {
+				return result, nil
+			}
+		}
+
+		// Wait for half the backoff, plus a random amount up to the other half.
+		delay := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		backoff = min(2*backoff, time.Duration(p.retries.MaxBackoff))
+	}
+}
+
+// Matches HTTP status codes for transient failures in error messages, for DNS
+// providers that report them only as text, e.g., "HTTP 503" or "status code:
+// 429".
+var transientStatusRegexp = regexp.MustCompile(`(?i)\b(?:http|status|code)\D{0,16}\b(429|5\d\d)\b`)
+
+// Classifies an error from a DNS provider call. Returns whether the failure is
+// transient, i.e., timeouts, network errors, HTTP 5xx responses and HTTP 429
+// responses, so that retrying could succeed. For transient failures, also
+// returns whether the call might have taken effect anyway.
+func classifyProviderError(err error) (transient bool, ambiguous bool) {
+	if errors.Is(err, context.Canceled) {
+		return false, false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true, true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		// The request never reached the DNS provider.
+		return true, false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, true
+	}
+
+	status := 0
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		status = statusErr.StatusCode()
+	} else if match := transientStatusRegexp.FindStringSubmatch(err.Error()); match != nil {
+		status, _ = strconv.Atoi(match[1])
+	}
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		// The DNS provider turned the request away.
+		return true, false
+	case status >= 500 && status <= 599:
+		return true, true
+	}
+	return false, false
+}
+
+// Determines whether all of the given records are in the zone. Also returns
+// whether that could be determined, which requires the DNS provider to be able
+// to list records.
+func (p *resilientProvider) recordsPresent(
+	ctx context.Context,
+	zone string,
+	recs []libdns.Record,
+) (bool, bool) {
+	getter, ok := p.provider.(libdns.RecordGetter)
+	if !ok {
+		return false, false
+	}
+	existing, err := getter.GetRecords(ctx, zone)
+	if err != nil {
+		return false, false
+	}
+	for _, rec := range recs {
+		want := rec.RR()
+		found := slices.ContainsFunc(existing, func(have libdns.Record) bool {
+			return sameRecord(have.RR(), want, zone)
+		})
+		if !found {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// Determines whether the given records have the same name, type and data. TXT
+// data is compared without surrounding quotes, which providers differ on.
+func sameRecord(a libdns.RR, b libdns.RR, zone string) bool {
+	return strings.EqualFold(
+		libdns.AbsoluteName(a.Name, zone),
+		libdns.AbsoluteName(b.Name, zone),
+	) &&
+		strings.EqualFold(a.Type, b.Type) &&
+		strings.Trim(a.Data, `"`) == strings.Trim(b.Data, `"`)
+}
+
+type circuitState int
+
+const (
+	// Calls are let through.
+	csClosed circuitState = iota
+
+	// Calls are rejected until the cooldown elapses.
+	csOpen
+
+	// A single trial call has been let through, and other calls are rejected
+	// until it completes.
+	csHalfOpen
+)
+
+// Holds the circuit breakers, keyed by the DNS provider's configuration and the
+// circuit breaker's, so that every handler calling the same DNS provider, such
+// as those serving the dns01proxy app's network and Unix socket listeners, sees
+// the same state, and so that an open circuit stays open across configuration
+// reloads.
+var circuitBreakerPool = caddy.NewUsagePool()
+
+// A circuit breaker. Safe for concurrent use.
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+
+	// The key under which this is held in circuitBreakerPool.
+	poolKey string
+
+	mu                  sync.Mutex
+	state               circuitState
+	consecutiveFailures int
+	openedAt            time.Time
+}
+
+var _ caddy.Destructor = (*circuitBreaker)(nil)
+
+// Returns the shared circuit breaker for the DNS provider with the given
+// configuration, creating it if needed. The circuit breaker must be released
+// when it is no longer used.
+func loadCircuitBreaker(
+	providerRaw json.RawMessage,
+	config CircuitBreakerConfig,
+) (*circuitBreaker, error) {
+	// The provider's configuration can hold credentials, so only its hash is
+	// kept.
+	providerHash := sha256.Sum256(providerRaw)
+	breaker := &circuitBreaker{
+		config: config,
+		poolKey: fmt.Sprintf(
+			"%x/%d/%s",
+			providerHash,
+			config.FailureThreshold,
+			time.Duration(config.Cooldown),
+		),
+	}
+	shared, _, err := circuitBreakerPool.LoadOrNew(
+		breaker.poolKey,
+		func() (caddy.Destructor, error) {
+			return breaker, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return shared.(*circuitBreaker), nil
+}
+
+// Releases a reference to a circuit breaker that was obtained from
+// loadCircuitBreaker.
+func (b *circuitBreaker) release() error {
+	_, err := circuitBreakerPool.Delete(b.poolKey)
+	return err
+}
+
+func (b *circuitBreaker) Destruct() error {
+	return nil
+}
+
+// Returns a circuitOpenError if a call should not be made at this time.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case csOpen:
+		elapsed := time.Since(b.openedAt)
+		cooldown := time.Duration(b.config.Cooldown)
+		if elapsed < cooldown {
+			return &circuitOpenError{retryAfter: cooldown - elapsed}
+		}
+
+		// Cooldown elapsed. Let a trial call through.
+		b.state = csHalfOpen
+		return nil
+
+	case csHalfOpen:
+		return &circuitOpenError{retryAfter: time.Duration(b.config.Cooldown)}
+	}
+
+	return nil
+}
+
+// Records the outcome of a call that was allowed through.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = csClosed
+		b.consecutiveFailures = 0
+		return
+	}
+
+	b.consecutiveFailures++
+	if b.state == csHalfOpen ||
+		b.consecutiveFailures >= b.config.FailureThreshold {
+		b.state = csOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Indicates that the outcome of a call that was allowed through is
+// inconclusive.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// If this was a trial call, then let another one through.
+	if b.state == csHalfOpen {
+		b.state = csOpen
+	}
+}
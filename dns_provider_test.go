@@ -0,0 +1,360 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/libdns/libdns"
+)
+
+// A DNS provider whose calls fail a given number of times before succeeding.
+// Fails with err if set, or else with a transient failure.
+type flakyProvider struct {
+	failures int
+	calls    int
+	err      error
+}
+
+func (p *flakyProvider) AppendRecords(
+	ctx context.Context,
+	zone string,
+	recs []libdns.Record,
+) ([]libdns.Record, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		if p.err != nil {
+			return nil, p.err
+		}
+		return nil, errors.New("HTTP 503: Service Unavailable")
+	}
+	return recs, nil
+}
+
+func (p *flakyProvider) DeleteRecords(
+	ctx context.Context,
+	zone string,
+	recs []libdns.Record,
+) ([]libdns.Record, error) {
+	return p.AppendRecords(ctx, zone, recs)
+}
+
+// A flaky DNS provider that can list records, and that has the given records.
+type listingProvider struct {
+	flakyProvider
+	records []libdns.Record
+}
+
+func (p *listingProvider) GetRecords(
+	ctx context.Context,
+	zone string,
+) ([]libdns.Record, error) {
+	return p.records, nil
+}
+
+func testRetryConfig(maxAttempts int) *RetryConfig {
+	return &RetryConfig{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: caddy.Duration(time.Millisecond),
+		MaxBackoff:     caddy.Duration(2 * time.Millisecond),
+	}
+}
+
+func TestRetrySucceedsAfterFailures(t *testing.T) {
+	inner := &flakyProvider{failures: 2}
+	p := &resilientProvider{provider: inner, retries: testRetryConfig(3)}
+
+	_, err := p.AppendRecords(context.Background(), "example.com.", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if inner.calls != 3 {
+		t.Errorf("got %d calls, want 3", inner.calls)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	inner := &flakyProvider{failures: 10}
+	p := &resilientProvider{provider: inner, retries: testRetryConfig(3)}
+
+	_, err := p.DeleteRecords(context.Background(), "example.com.", nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if inner.calls != 3 {
+		t.Errorf("got %d calls, want 3", inner.calls)
+	}
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+	inner := &flakyProvider{failures: 10}
+	p := &resilientProvider{
+		provider: inner,
+		retries: &RetryConfig{
+			MaxAttempts:    5,
+			InitialBackoff: caddy.Duration(time.Hour),
+			MaxBackoff:     caddy.Duration(time.Hour),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := p.AppendRecords(ctx, "example.com.", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+	if inner.calls != 1 {
+		t.Errorf("got %d calls, want 1", inner.calls)
+	}
+}
+
+func TestRetrySkipsPermanentFailures(t *testing.T) {
+	inner := &flakyProvider{failures: 10, err: errors.New("HTTP 403: Forbidden")}
+	p := &resilientProvider{provider: inner, retries: testRetryConfig(3)}
+
+	_, err := p.DeleteRecords(context.Background(), "example.com.", nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if inner.calls != 1 {
+		t.Errorf("got %d calls, want 1", inner.calls)
+	}
+}
+
+func TestClassifyProviderError(t *testing.T) {
+	cases := []struct {
+		err       error
+		transient bool
+		ambiguous bool
+	}{
+		{errors.New("invalid zone"), false, false},
+		{errors.New("HTTP 401: Unauthorized"), false, false},
+		{errors.New("unexpected status code: 429"), true, false},
+		{errors.New("HTTP 503: Service Unavailable"), true, false},
+		{errors.New("HTTP 502: Bad Gateway"), true, true},
+		{fmt.Errorf("unable to append: %w", context.DeadlineExceeded), true, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, false},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, true, true},
+		{context.Canceled, false, false},
+	}
+	for _, c := range cases {
+		transient, ambiguous := classifyProviderError(c.err)
+		if transient != c.transient || ambiguous != c.ambiguous {
+			t.Errorf("%v: got transient %v, ambiguous %v", c.err, transient, ambiguous)
+		}
+	}
+}
+
+func TestRetryAmbiguousAppend(t *testing.T) {
+	rec := libdns.TXT{
+		Name: "_acme-challenge.www",
+		TTL:  time.Minute,
+		Text: "\"token\"",
+	}
+	ambiguous := errors.New("HTTP 504: Gateway Timeout")
+
+	// Without a way to list records, the append isn't retried, because it might
+	// have taken effect.
+	inner := &flakyProvider{failures: 1, err: ambiguous}
+	p := &resilientProvider{provider: inner, retries: testRetryConfig(3)}
+	_, err := p.AppendRecords(context.Background(), "example.com.", []libdns.Record{rec})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if inner.calls != 1 {
+		t.Errorf("got %d calls, want 1", inner.calls)
+	}
+
+	// If the record is missing, the append is retried.
+	listing := &listingProvider{flakyProvider: flakyProvider{failures: 1, err: ambiguous}}
+	p = &resilientProvider{provider: listing, retries: testRetryConfig(3)}
+	_, err = p.AppendRecords(context.Background(), "example.com.", []libdns.Record{rec})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if listing.calls != 2 {
+		t.Errorf("got %d calls, want 2", listing.calls)
+	}
+
+	// If the record is there, the append took effect and isn't repeated.
+	listing = &listingProvider{
+		flakyProvider: flakyProvider{failures: 1, err: ambiguous},
+		records: []libdns.Record{libdns.TXT{
+			Name: "_acme-challenge.WWW",
+			TTL:  time.Minute,
+			Text: "token",
+		}},
+	}
+	p = &resilientProvider{provider: listing, retries: testRetryConfig(3)}
+	_, err = p.AppendRecords(context.Background(), "example.com.", []libdns.Record{rec})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if listing.calls != 1 {
+		t.Errorf("got %d calls, want 1", listing.calls)
+	}
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	inner := &flakyProvider{failures: 10}
+	p := &resilientProvider{
+		provider: inner,
+		breaker: &circuitBreaker{config: CircuitBreakerConfig{
+			FailureThreshold: 2,
+			Cooldown:         caddy.Duration(time.Hour),
+		}},
+	}
+
+	for range 2 {
+		_, err := p.AppendRecords(context.Background(), "example.com.", nil)
+		var openErr *circuitOpenError
+		if err == nil || errors.As(err, &openErr) {
+			t.Fatalf("got error %v, want a provider error", err)
+		}
+	}
+
+	_, err := p.AppendRecords(context.Background(), "example.com.", nil)
+	var openErr *circuitOpenError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("got error %v, want circuitOpenError", err)
+	}
+	if openErr.retryAfter <= 0 || openErr.retryAfter > time.Hour {
+		t.Errorf("got retryAfter %s", openErr.retryAfter)
+	}
+	if inner.calls != 2 {
+		t.Errorf("got %d calls, want 2", inner.calls)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := &circuitBreaker{config: CircuitBreakerConfig{
+		FailureThreshold: 1,
+		Cooldown:         caddy.Duration(time.Hour),
+	}}
+	b.record(false)
+	if b.allow() == nil {
+		t.Fatal("breaker let a call through while open")
+	}
+
+	// Pretend that the cooldown has elapsed.
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker rejected the trial call: %v", err)
+	}
+	if b.allow() == nil {
+		t.Fatal("breaker let a second call through while half-open")
+	}
+
+	// A failed trial reopens the breaker.
+	b.record(false)
+	if b.state != csOpen {
+		t.Fatalf("got state %d after failed trial, want open", b.state)
+	}
+
+	// A successful trial closes it.
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker rejected the trial call: %v", err)
+	}
+	b.record(true)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker rejected a call after recovering: %v", err)
+	}
+}
+
+func TestCircuitBreakerAbandonedTrial(t *testing.T) {
+	b := &circuitBreaker{config: CircuitBreakerConfig{
+		FailureThreshold: 1,
+		Cooldown:         caddy.Duration(time.Hour),
+	}}
+	b.record(false)
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker rejected the trial call: %v", err)
+	}
+
+	// An abandoned trial lets another trial through, without restarting the
+	// cooldown.
+	b.abandon()
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker rejected a trial call after abandonment: %v", err)
+	}
+}
+
+func TestCircuitBreakerIgnoresPermanentFailures(t *testing.T) {
+	inner := &flakyProvider{failures: 10, err: errors.New("HTTP 403: Forbidden")}
+	p := &resilientProvider{
+		provider: inner,
+		breaker: &circuitBreaker{config: CircuitBreakerConfig{
+			FailureThreshold: 1,
+			Cooldown:         caddy.Duration(time.Hour),
+		}},
+	}
+
+	for range 3 {
+		_, err := p.AppendRecords(context.Background(), "example.com.", nil)
+		var openErr *circuitOpenError
+		if err == nil || errors.As(err, &openErr) {
+			t.Fatalf("got error %v, want a provider error", err)
+		}
+	}
+	if p.breaker.state != csClosed {
+		t.Errorf("got state %d after permanent failures, want closed", p.breaker.state)
+	}
+}
+
+func TestCircuitBreakerIgnoresCancellation(t *testing.T) {
+	inner := &flakyProvider{failures: 10}
+	p := &resilientProvider{
+		provider: inner,
+		breaker: &circuitBreaker{config: CircuitBreakerConfig{
+			FailureThreshold: 1,
+			Cooldown:         caddy.Duration(time.Hour),
+		}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _ = p.AppendRecords(ctx, "example.com.", nil)
+	if p.breaker.state != csClosed {
+		t.Errorf("got state %d after cancelled call, want closed", p.breaker.state)
+	}
+}
+
+func TestCircuitBreakerShared(t *testing.T) {
+	config := CircuitBreakerConfig{
+		FailureThreshold: 1,
+		Cooldown:         caddy.Duration(time.Hour),
+	}
+	providerRaw := json.RawMessage(`{"name":"test","token":"shared"}`)
+	first, err := loadCircuitBreaker(providerRaw, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.release()
+	second, err := loadCircuitBreaker(providerRaw, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.release()
+
+	// A breaker tripped through one handler is open for the other.
+	first.record(false)
+	if second.allow() == nil {
+		t.Error("breaker let a call through while open")
+	}
+
+	other, err := loadCircuitBreaker(json.RawMessage(`{"name":"other"}`), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.release()
+	if err := other.allow(); err != nil {
+		t.Errorf("breaker for another provider rejected a call: %v", err)
+	}
+}
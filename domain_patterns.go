@@ -0,0 +1,107 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/liujed/goutil/optionals"
+)
+
+// Regular expressions that requested domains are matched against, for rules
+// that Smallstep's domain name rules can't express.
+type domainPatterns struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// Compiles the given patterns. Returns nil if there are none.
+func newDomainPatterns(allowRaw, denyRaw []string) (*domainPatterns, error) {
+	if len(allowRaw) == 0 && len(denyRaw) == 0 {
+		return nil, nil
+	}
+
+	compileAll := func(patterns []string) ([]*regexp.Regexp, error) {
+		result := make([]*regexp.Regexp, 0, len(patterns))
+		for _, pattern := range patterns {
+			// Anchor the pattern, so that it must match the whole domain.
+			re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("unable to compile %q: %w", pattern, err)
+			}
+			result = append(result, re)
+		}
+		return result, nil
+	}
+
+	allow, err := compileAll(allowRaw)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := compileAll(denyRaw)
+	if err != nil {
+		return nil, err
+	}
+	return &domainPatterns{allow: allow, deny: deny}, nil
+}
+
+// Checks the given domain against the patterns and against the given allow and
+// deny lists, which follow Smallstep's domain name rules. The domain is allowed
+// if it matches an allowed domain or pattern, and doesn't match a denied domain
+// or pattern. If there are no allowed domains or patterns, then all domains are
+// allowed, except denied ones. Returns None if the domain is allowed.
+// Otherwise, returns the reason for denial.
+func (p *domainPatterns) check(
+	policies *policyCache,
+	allow []string,
+	deny []string,
+	domain string,
+) (optionals.Optional[DenyReason], error) {
+	name := strings.ToLower(domain)
+
+	// Check the denials first.
+	for _, re := range p.deny {
+		if re.MatchString(name) {
+			return optionals.Some(DenyDomainNotAllowed), nil
+		}
+	}
+	if len(deny) > 0 {
+		engine, err := policies.get(nil, deny)
+		if err != nil {
+			return optionals.Some(DenyError),
+				fmt.Errorf("unable to build domain policy: %w", err)
+		}
+		denyReasonOpt, err := checkDomainPolicy(engine, domain)
+		if err != nil || denyReasonOpt.IsSome() {
+			return denyReasonOpt, err
+		}
+	}
+
+	if len(allow) == 0 && len(p.allow) == 0 {
+		return optionals.None[DenyReason](), nil
+	}
+	for _, re := range p.allow {
+		if re.MatchString(name) {
+			return optionals.None[DenyReason](), nil
+		}
+	}
+	if len(allow) > 0 {
+		engine, err := policies.get(allow, nil)
+		if err != nil {
+			return optionals.Some(DenyError),
+				fmt.Errorf("unable to build domain policy: %w", err)
+		}
+		return checkDomainPolicy(engine, domain)
+	}
+	return optionals.Some(DenyDomainNotAllowed), nil
+}
+
+// Returns the number of labels that the given domain has below the given zone.
+func subdomainDepth(domain string, zone string) int {
+	domain = normalizeZone(domain)
+	zone = normalizeZone(zone)
+	if domain == zone {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(domain, "."+zone), ".") + 1
+}
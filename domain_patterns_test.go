@@ -0,0 +1,92 @@
+package caddydns01proxy
+
+import (
+	"testing"
+
+	"github.com/liujed/goutil/optionals"
+)
+
+func TestAuthorizeDomainPatterns(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{
+		{
+			ClientPolicy: ClientPolicy{
+				UserID:           "alice",
+				AllowDomainsRaw:  []string{"example.org"},
+				AllowPatternsRaw: []string{`web[0-9]+\.example\.com`},
+				DenyPatternsRaw:  []string{`web9[0-9]\.example\.com`},
+			},
+		},
+		{
+			ClientPolicy: ClientPolicy{
+				UserID:          "bob",
+				DenyDomainsRaw:  []string{"admin.example.com"},
+				DenyPatternsRaw: []string{`.*\.internal\.example\.com`},
+			},
+		},
+	}, nil)
+
+	alice := authedRequest("alice", "192.0.2.1", nil)
+	for domain, want := range map[string]optionals.Optional[DenyReason]{
+		"web1.example.com":      optionals.None[DenyReason](),
+		"WEB42.example.com":     optionals.None[DenyReason](),
+		"example.org":           optionals.None[DenyReason](),
+		"web95.example.com":     optionals.Some(DenyDomainNotAllowed),
+		"web.example.com":       optionals.Some(DenyDomainNotAllowed),
+		"xweb1.example.com":     optionals.Some(DenyDomainNotAllowed), // Patterns are anchored.
+		"web1.example.com.evil": optionals.Some(DenyDomainNotAllowed),
+	} {
+		expectAuthorization(t, registry, alice, domain, want)
+	}
+
+	// With only denials, everything else is allowed.
+	bob := authedRequest("bob", "192.0.2.1", nil)
+	for domain, want := range map[string]optionals.Optional[DenyReason]{
+		"www.example.com":         optionals.None[DenyReason](),
+		"admin.example.com":       optionals.Some(DenyDomainNotAllowed),
+		"db.internal.example.com": optionals.Some(DenyDomainNotAllowed),
+	} {
+		expectAuthorization(t, registry, bob, domain, want)
+	}
+}
+
+func TestNewDomainPatternsErrors(t *testing.T) {
+	patterns, err := newDomainPatterns(nil, nil)
+	if err != nil || patterns != nil {
+		t.Errorf("got %v, %v; want nil for no patterns", patterns, err)
+	}
+	if _, err := newDomainPatterns([]string{`web(`}, nil); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestSubdomainDepth(t *testing.T) {
+	for _, test := range []struct {
+		domain string
+		zone   string
+		want   int
+	}{
+		{"example.com", "example.com.", 0},
+		{"www.example.com", "example.com", 1},
+		{"a.b.example.com.", "example.com.", 2},
+		{"A.B.Example.COM", "example.com", 2},
+	} {
+		if got := subdomainDepth(test.domain, test.zone); got != test.want {
+			t.Errorf("subdomainDepth(%q, %q) = %d, want %d",
+				test.domain, test.zone, got, test.want)
+		}
+	}
+}
+
+func TestMaxSubdomainDepthConfig(t *testing.T) {
+	err := (&ClientRegistry{}).Provision(
+		newTestContext(t),
+		[]RawAccount{{ClientPolicy: ClientPolicy{UserID: "alice", MaxSubdomainDepth: -1}}},
+		nil,
+		false,
+		nil,
+		nil,
+	)
+	if err == nil {
+		t.Error("expected an error for a negative maximum subdomain depth")
+	}
+}
@@ -0,0 +1,131 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Values substituted into domain templates must be a single DNS label, so that
+// a user can't reach into another user's part of the namespace, or inject
+// wildcards or other syntax.
+var domainLabelRegexp = regexp.MustCompile(
+	`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`,
+)
+
+// A domain policy whose allow and deny lists contain placeholders, which are
+// filled in for each request. The placeholders are:
+//
+//   - `{user}`: the authenticated user's ID.
+//   - `{header.<name>}`: the value of the named request header. Only headers of
+//     requests from trusted proxies are used, since otherwise clients could
+//     choose their own domains.
+type domainTemplates struct {
+	allow []string
+	deny  []string
+}
+
+// Checks the given allow and deny lists for placeholders. Returns nil if there
+// are none. Otherwise, returns the lists as templates, after checking that they
+// are well-formed.
+func newDomainTemplates(allow, deny []string) (*domainTemplates, error) {
+	hasPlaceholders := func(domains []string) bool {
+		for _, domain := range domains {
+			if strings.ContainsAny(domain, "{}") {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasPlaceholders(allow) && !hasPlaceholders(deny) {
+		return nil, nil
+	}
+
+	result := &domainTemplates{allow: allow, deny: deny}
+
+	// Check that the policy is valid once the placeholders are filled in.
+	sampleAllow, sampleDeny, err := result.expand(
+		"x",
+		func(string) string { return "x" },
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = newDomainPolicy(sampleAllow, sampleDeny)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Fills in the templates for the given user. The given function returns the
+// value of a request header. Returns an error if a placeholder is unknown, or
+// if its value is missing or is not a single DNS label.
+func (t *domainTemplates) expand(
+	userID string,
+	headerValue func(name string) string,
+) ([]string, []string, error) {
+	var badValueErr error
+	repl := caddy.NewEmptyReplacer()
+	repl.Map(func(key string) (any, bool) {
+		var value string
+		if key == "user" {
+			value = userID
+		} else if name, isHeader := strings.CutPrefix(key, "header."); isHeader {
+			value = headerValue(name)
+		} else {
+			return nil, false
+		}
+		if value != "" && !domainLabelRegexp.MatchString(value) {
+			badValueErr = fmt.Errorf("value of {%s} is not a DNS label", key)
+		}
+		return value, value != ""
+	})
+
+	expandAll := func(templates []string) ([]string, error) {
+		result := make([]string, 0, len(templates))
+		for _, template := range templates {
+			domain, err := repl.ReplaceOrErr(template, true, true)
+			if err != nil {
+				return nil, err
+			}
+			if badValueErr != nil {
+				return nil, badValueErr
+			}
+			if strings.ContainsAny(domain, "{}") {
+				return nil, fmt.Errorf("unbalanced braces in domain: %q", template)
+			}
+			result = append(result, strings.ToLower(domain))
+		}
+		return result, nil
+	}
+
+	allow, err := expandAll(t.allow)
+	if err != nil {
+		return nil, nil, err
+	}
+	deny, err := expandAll(t.deny)
+	if err != nil {
+		return nil, nil, err
+	}
+	return allow, deny, nil
+}
+
+// Returns a function that gives the value of a header of the given request, for
+// filling in templates. Unless the request came from a trusted proxy, which
+// vouches for the headers, every header is treated as missing.
+func trustedHeaders(req *http.Request) func(name string) string {
+	trusted, _ := caddyhttp.GetVar(
+		req.Context(),
+		caddyhttp.TrustedProxyVarKey,
+	).(bool)
+	if !trusted {
+		return func(string) string { return "" }
+	}
+	return req.Header.Get
+}
@@ -0,0 +1,129 @@
+package caddydns01proxy
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/liujed/goutil/optionals"
+)
+
+func TestDomainTemplatesExpand(t *testing.T) {
+	templates, err := newDomainTemplates(
+		[]string{"{user}.hosts.example.com", "*.{header.x-site}.example.com"},
+		[]string{"db.{user}.hosts.example.com"},
+	)
+	if err != nil || templates == nil {
+		t.Fatalf("got %v, %v", templates, err)
+	}
+
+	headers := http.Header{"X-Site": {"Paris"}}
+	allow, deny, err := templates.expand("web42", headers.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAllow := []string{"web42.hosts.example.com", "*.paris.example.com"}
+	if !slices.Equal(allow, wantAllow) {
+		t.Errorf("got allow %q, want %q", allow, wantAllow)
+	}
+	if want := []string{"db.web42.hosts.example.com"}; !slices.Equal(deny, want) {
+		t.Errorf("got deny %q, want %q", deny, want)
+	}
+
+	for name, test := range map[string]struct {
+		userID  string
+		headers http.Header
+	}{
+		"missing header":     {"web42", http.Header{}},
+		"multi-label user":   {"web42.evil", headers},
+		"wildcard in header": {"web42", http.Header{"X-Site": {"*"}}},
+	} {
+		if _, _, err := templates.expand(test.userID, test.headers.Get); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestNewDomainTemplates(t *testing.T) {
+	templates, err := newDomainTemplates([]string{"example.com"}, nil)
+	if err != nil || templates != nil {
+		t.Errorf("got %v, %v; want nil for domains without placeholders", templates, err)
+	}
+
+	for _, allow := range []string{
+		"{unknown}.example.com",
+		"{user.example.com",
+		"{user}}.example.com",
+	} {
+		if _, err := newDomainTemplates([]string{allow}, nil); err == nil {
+			t.Errorf("%q: expected an error", allow)
+		}
+	}
+}
+
+func TestAuthorizeDomainTemplates(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID: defaultAccountUserID,
+			AllowDomainsRaw: []string{
+				"{user}.hosts.example.com",
+				"*.{user}.hosts.example.com",
+			},
+		},
+	}}, nil)
+
+	req := authedRequest("web42", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "web42.hosts.example.com", optionals.None[DenyReason]())
+	expectAuthorization(t, registry, req, "www.web42.hosts.example.com", optionals.None[DenyReason]())
+	expectAuthorization(t, registry, req, "web43.hosts.example.com", optionals.Some(DenyDomainNotAllowed))
+
+	// User IDs that aren't a single DNS label can't fill in the templates.
+	expectAuthorization(
+		t,
+		registry,
+		authedRequest("web42.web43", "192.0.2.1", nil),
+		"web42.web43.hosts.example.com",
+		optionals.Some(DenyDomainTemplate),
+	)
+}
+
+func TestAuthorizeDomainTemplateHeaders(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID:          defaultAccountUserID,
+			AllowDomainsRaw: []string{"{header.x-site}.example.com"},
+		},
+	}}, nil)
+
+	// Headers from untrusted connections are treated as missing, so that
+	// clients can't choose their own domains.
+	req := authedRequest("web42", "192.0.2.1", nil)
+	req.Header.Set("X-Site", "paris")
+	expectAuthorization(t, registry, req, "paris.example.com", optionals.Some(DenyDomainTemplate))
+
+	caddyhttp.SetVar(req.Context(), caddyhttp.TrustedProxyVarKey, true)
+	expectAuthorization(t, registry, req, "paris.example.com", optionals.None[DenyReason]())
+	expectAuthorization(t, registry, req, "london.example.com", optionals.Some(DenyDomainNotAllowed))
+}
+
+func TestDefaultAccountFallback(t *testing.T) {
+	accounts := []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID:          defaultAccountUserID,
+			AllowDomainsRaw: []string{"example.com"},
+		},
+	}}
+
+	// The default account must be opted into.
+	err := (&ClientRegistry{}).Provision(newTestContext(t), accounts, nil, false, nil, nil)
+	if err == nil {
+		t.Error("expected an error for a default account without fallbacks enabled")
+	}
+
+	registry := newTestRegistry(t, accounts, nil)
+	policy, exists := registry.Policy("alice")
+	if !exists || policy.UserID != defaultAccountUserID {
+		t.Errorf("got policy %v, %v; want the default account", policy, exists)
+	}
+}
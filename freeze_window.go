@@ -0,0 +1,255 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// A period during which no new records can be presented, except by accounts
+// with [ClientPolicy.FreezeOverride] set. Cleanups are always allowed. A window
+// is given either by explicit start and end times, or by a cron schedule and a
+// duration.
+type FreezeWindow struct {
+	// Identifies the window in logs.
+	Name string `json:"name"`
+
+	// When the window starts and ends.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+
+	// A cron schedule, in the standard five-field format (minute, hour, day of
+	// month, month, day of week), at which the window starts. For example,
+	// `0 0 15 3,6,9,12 *` starts a window at midnight on the 15th of the last
+	// month of each quarter.
+	Cron string `json:"cron,omitempty"`
+
+	// How long the window lasts after each time that the cron schedule fires.
+	Duration caddy.Duration `json:"duration,omitempty"`
+
+	// The IANA time zone in which the cron schedule is evaluated. Defaults to
+	// UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	// The provisioned versions of [Cron] and [Timezone].
+	schedule *cronSchedule
+	location *time.Location
+}
+
+func (w *FreezeWindow) provision() error {
+	if w.Name == "" {
+		return fmt.Errorf("must have a name")
+	}
+
+	if w.Cron == "" {
+		if w.Start == nil || w.End == nil {
+			return fmt.Errorf("must have either a start and an end, or a cron schedule")
+		}
+		if !w.Start.Before(*w.End) {
+			return fmt.Errorf("must start before it ends")
+		}
+		if w.Duration != 0 || w.Timezone != "" {
+			return fmt.Errorf("duration and time zone are only used with a cron schedule")
+		}
+		return nil
+	}
+
+	if w.Start != nil || w.End != nil {
+		return fmt.Errorf("cannot have both a cron schedule and a start or an end")
+	}
+	if w.Duration <= 0 {
+		return fmt.Errorf("must have a positive duration")
+	}
+	var err error
+	w.schedule, err = parseCronSchedule(w.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid cron schedule: %w", err)
+	}
+	w.location = time.UTC
+	if w.Timezone != "" {
+		w.location, err = time.LoadLocation(w.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone: %w", err)
+		}
+	}
+	return nil
+}
+
+// Determines whether the window is in effect at the given time.
+func (w *FreezeWindow) contains(t time.Time) bool {
+	if w.schedule == nil {
+		return !t.Before(*w.Start) && t.Before(*w.End)
+	}
+
+	// The window is in effect if the schedule last fired within the last
+	// Duration.
+	t = t.In(w.location)
+	_, fired := w.schedule.lastFiring(t, t.Add(-time.Duration(w.Duration)))
+	return fired
+}
+
+// Returns the first of the given windows that is in effect at the given time,
+// if any.
+func activeFreezeWindow(windows []FreezeWindow, t time.Time) (*FreezeWindow, bool) {
+	for i := range windows {
+		if windows[i].contains(t) {
+			return &windows[i], true
+		}
+	}
+	return nil, false
+}
+
+// A parsed cron schedule. Each field is a set of allowed values.
+type cronSchedule struct {
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+
+	// Whether the day-of-month and day-of-week fields are restricted. Following
+	// the usual cron convention, if both are, then a day matches if either
+	// matches.
+	domRestricted bool
+	dowRestricted bool
+}
+
+// Parses a standard five-field cron schedule. Each field can be `*`, a number,
+// a range `a-b`, any of these with a step `/n`, or a comma-separated list of
+// these. In the day-of-week field, both 0 and 7 mean Sunday.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	var result cronSchedule
+	var err error
+	if result.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if result.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if result.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if result.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if result.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if result.daysOfWeek[7] {
+		result.daysOfWeek[0] = true
+	}
+	result.domRestricted = !strings.HasPrefix(fields[2], "*")
+	result.dowRestricted = !strings.HasPrefix(fields[4], "*")
+	return &result, nil
+}
+
+// Parses a single cron field, whose values must be in the range [low, high].
+func parseCronField(field string, low, high int) (map[int]bool, error) {
+	result := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rangeRaw, stepRaw, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepRaw)
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step: %q", part)
+			}
+		}
+
+		first, last := low, high
+		if rangeRaw != "*" {
+			firstRaw, lastRaw, isRange := strings.Cut(rangeRaw, "-")
+			var err error
+			first, err = strconv.Atoi(firstRaw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value: %q", part)
+			}
+			last = first
+			if isRange {
+				last, err = strconv.Atoi(lastRaw)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value: %q", part)
+				}
+			} else if hasStep {
+				last = high
+			}
+		}
+		if first < low || last > high || first > last {
+			return nil, fmt.Errorf("value out of range: %q", part)
+		}
+
+		for value := first; value <= last; value += step {
+			result[value] = true
+		}
+	}
+	return result, nil
+}
+
+// Determines whether the schedule fires on the day of the given time.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if !s.months[int(t.Month())] {
+		return false
+	}
+	domMatches := s.daysOfMonth[t.Day()]
+	dowMatches := s.daysOfWeek[int(t.Weekday())]
+	if s.domRestricted && s.dowRestricted {
+		return domMatches || dowMatches
+	}
+	return domMatches && dowMatches
+}
+
+// Returns the last time, no later than t, at which the schedule fires, if that
+// is after the given time. Days on which the schedule doesn't fire are skipped,
+// and on the others, the hour and minute are found directly.
+func (s *cronSchedule) lastFiring(t time.Time, after time.Time) (time.Time, bool) {
+	loc := t.Location()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	hourLimit, minuteLimit := t.Hour(), t.Minute()
+	for time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, loc).After(after) {
+		if s.matchesDay(day) {
+			if fired, ok := s.lastTimeOfDay(day, hourLimit, minuteLimit); ok {
+				return fired, fired.After(after)
+			}
+		}
+		day = time.Date(day.Year(), day.Month(), day.Day()-1, 0, 0, 0, 0, loc)
+		hourLimit, minuteLimit = 23, 59
+	}
+	return time.Time{}, false
+}
+
+// Returns the last time on the given day, no later than the given hour and
+// minute, at which the schedule fires, if any.
+func (s *cronSchedule) lastTimeOfDay(
+	day time.Time,
+	hourLimit int,
+	minuteLimit int,
+) (time.Time, bool) {
+	for hour := hourLimit; hour >= 0; hour-- {
+		if !s.hours[hour] {
+			continue
+		}
+		limit := 59
+		if hour == hourLimit {
+			limit = minuteLimit
+		}
+		for minute := limit; minute >= 0; minute-- {
+			if s.minutes[minute] {
+				return time.Date(
+					day.Year(), day.Month(), day.Day(),
+					hour, minute, 0, 0,
+					day.Location(),
+				), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,179 @@
+package caddydns01proxy
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func newTestFreezeWindow(t *testing.T, cron string, duration time.Duration, timezone string) *FreezeWindow {
+	t.Helper()
+	window := &FreezeWindow{
+		Name:     "test",
+		Cron:     cron,
+		Duration: caddy.Duration(duration),
+		Timezone: timezone,
+	}
+	if err := window.provision(); err != nil {
+		t.Fatal(err)
+	}
+	return window
+}
+
+func TestFreezeWindowFixed(t *testing.T) {
+	start := time.Date(2026, time.December, 20, 0, 0, 0, 0, time.UTC)
+	end := start.Add(14 * 24 * time.Hour)
+	window := &FreezeWindow{Name: "holidays", Start: &start, End: &end}
+	if err := window.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	for when, want := range map[time.Time]bool{
+		start.Add(-time.Second): false,
+		start:                   true,
+		end.Add(-time.Second):   true,
+		end:                     false,
+	} {
+		if got := window.contains(when); got != want {
+			t.Errorf("%s: got %v, want %v", when, got, want)
+		}
+	}
+}
+
+func TestFreezeWindowCron(t *testing.T) {
+	// A week starting at midnight on the 25th of each quarter's last month.
+	quarterly := newTestFreezeWindow(t, "0 0 25 3,6,9,12 *", 7*24*time.Hour, "")
+	for when, want := range map[time.Time]bool{
+		time.Date(2026, time.March, 24, 23, 59, 0, 0, time.UTC):   false,
+		time.Date(2026, time.March, 25, 0, 0, 0, 0, time.UTC):     true,
+		time.Date(2026, time.March, 31, 23, 59, 0, 0, time.UTC):   true,
+		time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC):      false,
+		time.Date(2026, time.April, 25, 12, 0, 0, 0, time.UTC):    false,
+		time.Date(2026, time.December, 31, 23, 0, 0, 0, time.UTC): true,
+	} {
+		if got := quarterly.contains(when); got != want {
+			t.Errorf("quarterly, %s: got %v, want %v", when, got, want)
+		}
+	}
+
+	// Two hours from 17:30 on weekdays, in New York.
+	evenings := newTestFreezeWindow(t, "30 17 * * 1-5", 2*time.Hour, "America/New_York")
+	newYork, _ := time.LoadLocation("America/New_York")
+	for when, want := range map[time.Time]bool{
+		time.Date(2026, time.March, 2, 17, 29, 0, 0, newYork): false, // Monday.
+		time.Date(2026, time.March, 2, 17, 30, 0, 0, newYork): true,
+		time.Date(2026, time.March, 2, 23, 0, 0, 0, time.UTC): true, // 18:00 in New York.
+		time.Date(2026, time.March, 2, 19, 30, 0, 0, newYork): false,
+		time.Date(2026, time.March, 7, 18, 0, 0, 0, newYork):  false, // Saturday.
+	} {
+		if got := evenings.contains(when); got != want {
+			t.Errorf("evenings, %s: got %v, want %v", when, got, want)
+		}
+	}
+}
+
+// Checks the window boundaries against a scan of every minute in the window's
+// duration.
+func TestFreezeWindowCronMatchesScan(t *testing.T) {
+	scan := func(w *FreezeWindow, t time.Time) bool {
+		t = t.In(w.location)
+		m := t.Truncate(time.Minute)
+		for ; m.After(t.Add(-time.Duration(w.Duration))); m = m.Add(-time.Minute) {
+			if w.schedule.matchesDay(m) && w.schedule.hours[m.Hour()] && w.schedule.minutes[m.Minute()] {
+				return true
+			}
+		}
+		return false
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	base := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, window := range []*FreezeWindow{
+		newTestFreezeWindow(t, "0 0 25 3,6,9,12 *", 7*24*time.Hour, ""),
+		newTestFreezeWindow(t, "*/20 9-17 * * 1-5", 10*time.Minute, "Europe/London"),
+		newTestFreezeWindow(t, "45 23 1,15 * 0", 90*time.Minute, "Asia/Tokyo"),
+	} {
+		for range 500 {
+			when := base.Add(time.Duration(rng.Int64N(int64(365 * 24 * time.Hour))))
+			if got, want := window.contains(when), scan(window, when); got != want {
+				t.Errorf("%s at %s: got %v, want %v", window.Cron, when, got, want)
+			}
+		}
+	}
+}
+
+func TestActiveFreezeWindow(t *testing.T) {
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	windows := []FreezeWindow{
+		{Name: "first", Start: &start, End: &end},
+		{Name: "second", Cron: "0 0 * * *", Duration: caddy.Duration(time.Hour)},
+	}
+	for i := range windows {
+		if err := windows[i].provision(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if window, frozen := activeFreezeWindow(windows, start); !frozen || window.Name != "first" {
+		t.Errorf("got %v, %v; want the first window", window, frozen)
+	}
+	if window, frozen := activeFreezeWindow(windows, end); !frozen || window.Name != "second" {
+		t.Errorf("got %v, %v; want the second window", window, frozen)
+	}
+	if _, frozen := activeFreezeWindow(windows, end.Add(time.Hour)); frozen {
+		t.Error("frozen outside every window")
+	}
+}
+
+func TestFreezeWindowConfigErrors(t *testing.T) {
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	for name, window := range map[string]FreezeWindow{
+		"no name":             {Start: &start, End: &end},
+		"no end":              {Name: "x", Start: &start},
+		"ends before start":   {Name: "x", Start: &end, End: &start},
+		"fixed with duration": {Name: "x", Start: &start, End: &end, Duration: caddy.Duration(time.Hour)},
+		"cron and start":      {Name: "x", Cron: "0 0 * * *", Start: &start, Duration: caddy.Duration(time.Hour)},
+		"cron, no duration":   {Name: "x", Cron: "0 0 * * *"},
+		"four fields":         {Name: "x", Cron: "0 0 * *", Duration: caddy.Duration(time.Hour)},
+		"minute out of range": {Name: "x", Cron: "60 0 * * *", Duration: caddy.Duration(time.Hour)},
+		"backwards range":     {Name: "x", Cron: "0 5-3 * * *", Duration: caddy.Duration(time.Hour)},
+		"named day":           {Name: "x", Cron: "0 0 * * mon", Duration: caddy.Duration(time.Hour)},
+		"zero step":           {Name: "x", Cron: "*/0 0 * * *", Duration: caddy.Duration(time.Hour)},
+		"bad time zone":       {Name: "x", Cron: "0 0 * * *", Duration: caddy.Duration(time.Hour), Timezone: "Mars/Olympus"},
+	} {
+		if err := window.provision(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCronScheduleDayMatching(t *testing.T) {
+	// With both day fields restricted, either can match: the 1st of the month,
+	// or any Monday.
+	schedule, err := parseCronSchedule("0 0 1 * 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for when, want := range map[time.Time]bool{
+		time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC): true, // Wednesday.
+		time.Date(2026, time.March, 2, 0, 0, 0, 0, time.UTC): true, // Monday.
+		time.Date(2026, time.March, 3, 0, 0, 0, 0, time.UTC): false,
+	} {
+		if got := schedule.matchesDay(when); got != want {
+			t.Errorf("%s: got %v, want %v", when, got, want)
+		}
+	}
+
+	// Both 0 and 7 mean Sunday.
+	schedule, err = parseCronSchedule("0 0 * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !schedule.matchesDay(time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("7 doesn't match Sunday")
+	}
+}
@@ -0,0 +1,72 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A named set of domain policies that accounts can inherit, so that common
+// policies don't need to be repeated in every account.
+type RawGroup struct {
+	// Identifies the group. Accounts refer to groups by this name.
+	Name string `json:"name"`
+
+	// Domains that members of the group can get TLS certificates for, and
+	// domains that they can't. These follow the same rules as
+	// [ClientPolicy.AllowDomainsRaw] and [ClientPolicy.DenyDomainsRaw].
+	AllowDomainsRaw []string `json:"allow_domains,omitempty"`
+	DenyDomainsRaw  []string `json:"deny_domains,omitempty"`
+
+	// Whether members of the group can present records during the server's
+	// freeze windows. See [ClientPolicy.FreezeOverride].
+	FreezeOverride bool `json:"freeze_override,omitempty"`
+}
+
+// Indexes the given groups by name.
+func indexGroups(groups []RawGroup) (map[string]*RawGroup, error) {
+	result := map[string]*RawGroup{}
+	for i := range groups {
+		group := &groups[i]
+		if group.Name == "" {
+			return nil, fmt.Errorf("group %d has no name", i)
+		}
+		if _, exists := result[group.Name]; exists {
+			return nil, fmt.Errorf("group name is not unique: %q", group.Name)
+		}
+		result[group.Name] = group
+	}
+	return result, nil
+}
+
+// Merges the domain policies of the user's groups into the user's own. The
+// result allows the union of the allowed domains, minus the union of the
+// denied domains. The same applies to the user's shadow lists, if given. The
+// user can also override freeze windows if any of their groups can.
+func (c *ClientPolicy) inheritGroups(groups map[string]*RawGroup) error {
+	for _, name := range c.Groups {
+		group, exists := groups[name]
+		if !exists {
+			return fmt.Errorf("unknown group for client %q: %q", c.UserID, name)
+		}
+		c.AllowDomainsRaw = appendUnique(c.AllowDomainsRaw, group.AllowDomainsRaw)
+		c.DenyDomainsRaw = appendUnique(c.DenyDomainsRaw, group.DenyDomainsRaw)
+		if len(c.ShadowAllowDomainsRaw) > 0 {
+			c.ShadowAllowDomainsRaw = appendUnique(c.ShadowAllowDomainsRaw, group.AllowDomainsRaw)
+		}
+		if len(c.ShadowDenyDomainsRaw) > 0 {
+			c.ShadowDenyDomainsRaw = appendUnique(c.ShadowDenyDomainsRaw, group.DenyDomainsRaw)
+		}
+		c.FreezeOverride = c.FreezeOverride || group.FreezeOverride
+	}
+	return nil
+}
+
+// Appends the elements of src to dst that aren't already in dst.
+func appendUnique(dst []string, src []string) []string {
+	for _, s := range src {
+		if !slices.Contains(dst, s) {
+			dst = append(dst, s)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,95 @@
+package caddydns01proxy
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/liujed/goutil/optionals"
+)
+
+func TestInheritGroups(t *testing.T) {
+	groups, err := indexGroups([]RawGroup{
+		{
+			Name:            "web",
+			AllowDomainsRaw: []string{"*.example.com", "example.com"},
+			DenyDomainsRaw:  []string{"admin.example.com"},
+		},
+		{
+			Name:            "ops",
+			AllowDomainsRaw: []string{"*.example.net"},
+			FreezeOverride:  true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := ClientPolicy{
+		UserID:                "alice",
+		Groups:                []string{"web", "ops"},
+		AllowDomainsRaw:       []string{"example.com"},
+		ShadowAllowDomainsRaw: []string{"example.org"},
+	}
+	if err := policy.inheritGroups(groups); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"allow", policy.AllowDomainsRaw, []string{"example.com", "*.example.com", "*.example.net"}},
+		{"deny", policy.DenyDomainsRaw, []string{"admin.example.com"}},
+		{"shadow allow", policy.ShadowAllowDomainsRaw, []string{"example.org", "*.example.com", "example.com", "*.example.net"}},
+		// The user has no shadow deny list, so none is made for them.
+		{"shadow deny", policy.ShadowDenyDomainsRaw, nil},
+	} {
+		if !slices.Equal(test.got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, test.got, test.want)
+		}
+	}
+	if !policy.FreezeOverride {
+		t.Error("freeze override not inherited")
+	}
+
+	unknown := ClientPolicy{UserID: "bob", Groups: []string{"db"}}
+	if err := unknown.inheritGroups(groups); err == nil {
+		t.Error("expected an error for an unknown group")
+	}
+}
+
+func TestIndexGroupsErrors(t *testing.T) {
+	for name, groups := range map[string][]RawGroup{
+		"no name":        {{AllowDomainsRaw: []string{"example.com"}}},
+		"duplicate name": {{Name: "web"}, {Name: "web"}},
+	} {
+		if _, err := indexGroups(groups); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAuthorizeGroupPolicy(t *testing.T) {
+	registry := newTestRegistry(
+		t,
+		[]RawAccount{{
+			ClientPolicy: ClientPolicy{
+				UserID:          "alice",
+				Groups:          []string{"web"},
+				AllowDomainsRaw: []string{"admin.example.com"},
+			},
+		}},
+		[]RawGroup{{
+			Name:            "web",
+			AllowDomainsRaw: []string{"*.example.com"},
+			DenyDomainsRaw:  []string{"admin.example.com"},
+		}},
+	)
+
+	req := authedRequest("alice", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "www.example.com", optionals.None[DenyReason]())
+
+	// A group's denials apply even to domains that the user allows.
+	expectAuthorization(t, registry, req, "admin.example.com", optionals.Some(DenyDomainNotAllowed))
+}
@@ -1,8 +1,13 @@
 package caddydns01proxy
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -41,9 +46,45 @@ type Handler struct {
 	// [ClientRegistry].)
 	AccountsRaw []RawAccount `json:"accounts"`
 
+	// Named sets of domain policies that accounts can inherit. Optional.
+	//
+	// (During provisioning, this is used to fill in [ClientRegistry].)
+	GroupsRaw []RawGroup `json:"groups,omitempty"`
+
+	// Whether authenticated users that don't have an account of their own fall
+	// back to the default account (user ID `*`). Required for the default
+	// account to be configured, so that it can't grant access by accident.
+	// Fallbacks are noted in the access logs.
+	DefaultAccountFallback bool `json:"default_account_fallback,omitempty"`
+
+	// Authenticates clients by their TLS client certificates. Optional. The TLS
+	// server must be configured to request client certificates.
+	ClientCertAuth *ClientCertAuthConfig `json:"client_cert_auth,omitempty"`
+
+	// Authenticates clients by JSON Web Tokens, such as OIDC ID tokens issued to
+	// CI jobs. Optional.
+	JWTAuth *JWTAuthConfig `json:"jwt_auth,omitempty"`
+
+	// Authenticates clients by a user ID header set by an authenticating reverse
+	// proxy. Optional. The header is only accepted from trusted proxies, so the
+	// server's trusted proxies must be configured.
+	HeaderAuth *HeaderAuthConfig `json:"header_auth,omitempty"`
+
+	// How far a signed request's timestamp can be from the server's clock.
+	// Defaults to 5m.
+	SignatureMaxSkew caddy.Duration `json:"signature_max_skew,omitempty"`
+
+	// Verifies signed requests. Nil if no account has a signing secret.
+	signedRequestAuth *signedRequestAuthenticator
+
+	// How far ahead to warn at startup about accounts that are about to expire.
+	// Defaults to 14d.
+	ExpiryWarning caddy.Duration `json:"expiry_warning,omitempty"`
+
 	// Specifies how clients should be authenticated. If absent, then clients must
 	// be authenticated by an `http.handlers.authentication` instance earlier in
-	// the handler chain. Derived from [AccountsRaw].
+	// the handler chain. Derived from [AccountsRaw] and the other authentication
+	// settings.
 	//
 	// XXX This should be an Optional[*caddyauth.Authentication], but Caddy's
 	// documentation generator doesn't work with generics.
@@ -53,11 +94,69 @@ type Handler struct {
 	// challenges. Derived from [AccountsRaw].
 	ClientRegistry ClientRegistry `json:"-"`
 
+	// The DNS zones in which challenges can be answered, regardless of account
+	// policies. Each zone also covers its subzones. Optional. If given, then
+	// challenges in other zones are denied, and every account's allowed domains
+	// must fall within these zones. Allowed domain patterns can't be checked
+	// against these zones when the configuration is loaded, so only the check
+	// at request time applies to them.
+	AllowedZones []string `json:"allowed_zones,omitempty"`
+
+	// The DNS zones in which challenges are never answered, regardless of
+	// account policies. Each zone also covers its subzones. Optional.
+	DeniedZones []string `json:"denied_zones,omitempty"`
+
+	zoneGuard zoneGuard
+
+	// Periods during which no new records can be presented, except by accounts
+	// that override freezes. Optional.
+	FreezeWindows []FreezeWindow `json:"freeze_windows,omitempty"`
+
+	// Limits the number of DNS provider operations in flight at once. Optional.
+	// If omitted, then there is no limit.
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+
+	concurrencyLimiter *concurrencyLimiter
+
+	// Locks out usernames and client IP addresses after repeated password
+	// failures. Failures are remembered across configuration reloads, and are
+	// shared by every handler with the same lockout configuration. Optional. If
+	// omitted, then failures are not tracked.
+	Lockout *LockoutConfig `json:"lockout,omitempty"`
+
+	lockout *lockoutTracker
+
+	// Consults an external policy service for the final authorization decision
+	// on each request to present a record. Optional.
+	AuthzWebhook *AuthzWebhookConfig `json:"authz_webhook,omitempty"`
+
+	authzWebhook *authzWebhook
+
+	// Turns away requests for sensitive domains, telling clients to retry, until
+	// an operator approves them. Optional.
+	RequireApproval *ApprovalConfig `json:"require_approval,omitempty"`
+
+	approvalGate *approvalGate
+
+	// The accounts that delegators have created. Nil if no account is a
+	// delegator.
+	delegation *delegationStore
+
+	// Whether to persist each user's usage against their limits in Caddy
+	// storage, so that usage counters survive restarts. Usage is persisted a few
+	// seconds after it changes. (Usage counters always survive configuration
+	// reloads that don't change this setting.)
+	PersistUsage bool `json:"persist_usage,omitempty"`
+
+	// Tracks each user's usage against their limits.
+	usage usageTracker
+
 	logger *zap.Logger
 }
 
 var _ caddy.Module = (*Handler)(nil)
 var _ caddy.Provisioner = (*Handler)(nil)
+var _ caddy.CleanerUpper = (*Handler)(nil)
 var _ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 var _ caddyfile.Unmarshaler = (*Handler)(nil)
 
@@ -68,6 +167,36 @@ type RawAccount struct {
 	// omitted, then clients must be authenticated by an
 	// `http.handlers.authentication` instance earlier in the handler chain.
 	Password *string `json:"password,omitempty"`
+
+	// Additional passwords for the user, each optionally limited to a validity
+	// period. Listing both the old and the new password during a rotation lets
+	// clients switch over at their own pace. Optional.
+	Credentials []RawCredential `json:"credentials,omitempty"`
+
+	// API tokens with which the user can authenticate, as an alternative to the
+	// password. Optional.
+	Tokens []RawToken `json:"tokens,omitempty"`
+
+	// A shared secret with which the user signs requests, as an alternative to
+	// the password. See the signing package for the signature scheme. Signed
+	// request bodies are limited to 64 KiB. Optional. Placeholders such as
+	// `{env.*}` and `{file.*}` are expanded.
+	SigningSecret *string `json:"signing_secret,omitempty"`
+
+	// The UIDs of local processes that authenticate as this user by connecting
+	// over a Unix socket. The kernel reports the UID of the connecting process,
+	// so no credential is needed. Optional. Linux only.
+	PeerUIDs []uint32 `json:"peer_uids,omitempty"`
+
+	// Like [PeerUIDs], but matches the connecting process's primary GID. A UID
+	// match takes precedence over a GID match. Optional. Linux only.
+	PeerGIDs []uint32 `json:"peer_gids,omitempty"`
+}
+
+// Determines whether the account has any means of authenticating.
+func (a *RawAccount) hasCredentials() bool {
+	return a.Password != nil || len(a.Credentials) > 0 || len(a.Tokens) > 0 ||
+		a.SigningSecret != nil || len(a.PeerUIDs) > 0 || len(a.PeerGIDs) > 0
 }
 
 func (Handler) CaddyModule() caddy.ModuleInfo {
@@ -88,53 +217,261 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		return err
 	}
 
+	// Provision the concurrency limiter.
+	if h.Concurrency != nil {
+		if h.Concurrency.MaxInFlight <= 0 {
+			return fmt.Errorf("concurrency limit must be positive")
+		}
+		if h.Concurrency.MaxQueued < 0 {
+			return fmt.Errorf("concurrency queue size must not be negative")
+		}
+		h.concurrencyLimiter, err = loadConcurrencyLimiter(*h.Concurrency)
+		if err != nil {
+			return fmt.Errorf("unable to load concurrency limiter: %w", err)
+		}
+	}
+
 	// Provision Authentication from AccountsRaw.
-	accountList := []caddyauth.Account{}
-	for _, rawAccount := range h.AccountsRaw {
-		if rawAccount.Password != nil {
-			accountList = append(accountList, caddyauth.Account{
-				Username: rawAccount.UserID,
-				Password: *rawAccount.Password,
-			})
-		}
-	}
-	if len(accountList) > 0 {
-		auth := &caddyauth.Authentication{
-			ProvidersRaw: caddy.ModuleMap{
-				"http_basic": caddyconfig.JSON(
-					caddyauth.HTTPBasicAuth{
-						AccountList: accountList,
-					},
-					nil,
-				),
-			},
+	auth := &caddyauth.Authentication{
+		ProvidersRaw: caddy.ModuleMap{},
+	}
+	err = auth.Provision(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to provision authenticaiton: %w", err)
+	}
+
+	// Add the authentication methods that are implemented here. They are
+	// registered as a single provider, so that they are tried in a fixed order.
+	credentialAuth := &compositeAuthenticator{}
+	passwordAuth, err := newPasswordAuthenticator(h.AccountsRaw)
+	if err != nil {
+		return fmt.Errorf("unable to provision password authentication: %w", err)
+	}
+	if passwordAuth != nil {
+		if h.Lockout != nil {
+			h.lockout, err = loadLockoutTracker(*h.Lockout, h.logger)
+			if err != nil {
+				return fmt.Errorf("unable to provision lockout: %w", err)
+			}
+			passwordAuth.lockout = h.lockout
+		}
+		credentialAuth.add(authMethodPassword, passwordAuth)
+	}
+	if h.ClientCertAuth != nil {
+		authenticator, err := h.ClientCertAuth.provision(&h.ClientRegistry)
+		if err != nil {
+			return fmt.Errorf(
+				"unable to provision client certificate authentication: %w",
+				err,
+			)
+		}
+		credentialAuth.add(authMethodClientCert, authenticator)
+	}
+	if h.JWTAuth != nil {
+		authenticator, err := h.JWTAuth.provision(h.logger)
+		if err != nil {
+			return fmt.Errorf("unable to provision JWT authentication: %w", err)
+		}
+		credentialAuth.add(authMethodJWT, authenticator)
+	}
+	if h.HeaderAuth != nil {
+		credentialAuth.add(authMethodHeader, h.HeaderAuth.provision(h.logger))
+	}
+	peerCredAuth, err := newPeerCredAuthenticator(h.AccountsRaw)
+	if err != nil {
+		return fmt.Errorf(
+			"unable to provision peer credential authentication: %w",
+			err,
+		)
+	}
+	if peerCredAuth != nil {
+		if runtime.GOOS != "linux" {
+			ctx.Logger().Warn("peer credential authentication is only supported on Linux")
 		}
-		err := auth.Provision(ctx)
+
+		// The peer credentials are read when the connection is accepted.
+		server, ok := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+		if !ok {
+			return fmt.Errorf("peer credential authentication requires an HTTP server")
+		}
+		server.RegisterConnContext(peerCredentialsConnContext)
+		credentialAuth.add(authMethodPeerCred, peerCredAuth)
+	}
+	tokenAuth, err := newTokenAuthenticator(h.AccountsRaw)
+	if err != nil {
+		return fmt.Errorf("unable to provision API token authentication: %w", err)
+	}
+	if tokenAuth != nil {
+		credentialAuth.add(authMethodToken, tokenAuth)
+	}
+	h.signedRequestAuth, err = newSignedRequestAuthenticator(
+		h.AccountsRaw,
+		time.Duration(h.SignatureMaxSkew),
+		h.logger,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to provision request signing: %w", err)
+	}
+	if h.signedRequestAuth != nil {
+		credentialAuth.add(authMethodSignedRequest, h.signedRequestAuth)
+	}
+
+	// Load the delegated accounts, if any account can create them.
+	if slices.ContainsFunc(h.AccountsRaw, func(account RawAccount) bool {
+		return account.Delegator
+	}) {
+		h.delegation, err = loadDelegationStore(ctx, h.logger)
 		if err != nil {
-			return fmt.Errorf("unable to provision authenticaiton: %w", err)
+			return fmt.Errorf("unable to provision delegated accounts: %w", err)
 		}
+		credentialAuth.add(authMethodDelegatedToken, h.delegation)
+	}
 
+	if len(credentialAuth.methods) > 0 {
+		auth.Providers["dns01proxy"] = credentialAuth
 		h.Authentication = auth
 	}
 
-	// Normally, we expect either all users or no users to have a password
-	// configured. Warn if this is not the case.
-	if len(accountList) > 0 && len(accountList) != len(h.AccountsRaw) {
+	// Normally, if passwords are the only means of authentication, we expect
+	// either all users or no users to have a password configured. Warn if this
+	// is not the case.
+	numAccounts := len(h.AccountsRaw)
+	for _, rawAccount := range h.AccountsRaw {
+		if rawAccount.UserID == defaultAccountUserID {
+			numAccounts--
+		}
+	}
+	if passwordAuth != nil && len(credentialAuth.methods) == 1 &&
+		len(passwordAuth.credentials) != numAccounts {
 		ctx.Logger().Warn("some users will always fail authentication because they do not have a password configured")
 	}
 
+	// Provision the zone guardrails, and check that the allowed domains of every
+	// account, group and JWT fall within them.
+	h.zoneGuard = newZoneGuard(h.AllowedZones, h.DeniedZones)
+	for _, rawAccount := range h.AccountsRaw {
+		err := h.zoneGuard.checkAllowDomains(
+			fmt.Sprintf("user ID %q", rawAccount.UserID),
+			rawAccount.AllowDomainsRaw,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rawGroup := range h.GroupsRaw {
+		err := h.zoneGuard.checkAllowDomains(
+			fmt.Sprintf("group %q", rawGroup.Name),
+			rawGroup.AllowDomainsRaw,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if h.JWTAuth != nil {
+		err := h.zoneGuard.checkAllowDomains(
+			"JWT authentication",
+			h.JWTAuth.AllowDomains,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Provision the approval workflow.
+	if h.RequireApproval != nil {
+		h.approvalGate, err = h.RequireApproval.provision(h.logger)
+		if err != nil {
+			return fmt.Errorf("unable to provision approval workflow: %w", err)
+		}
+	}
+
+	// Provision the freeze windows.
+	for i := range h.FreezeWindows {
+		err := h.FreezeWindows[i].provision()
+		if err != nil {
+			return fmt.Errorf("invalid freeze window %d: %w", i, err)
+		}
+	}
+
+	// Provision the authorization webhook.
+	if h.AuthzWebhook != nil {
+		h.authzWebhook, err = h.AuthzWebhook.provision(h.logger)
+		if err != nil {
+			return fmt.Errorf("unable to provision authorization webhook: %w", err)
+		}
+	}
+
+	// Warn about accounts that have expired or are about to.
+	if h.ExpiryWarning <= 0 {
+		h.ExpiryWarning = caddy.Duration(defaultExpiryWarning)
+	}
+	now := time.Now()
+	for _, rawAccount := range h.AccountsRaw {
+		notAfter := rawAccount.NotAfter
+		if notAfter == nil || rawAccount.Disabled {
+			continue
+		}
+		if !now.Before(*notAfter) {
+			h.logger.Warn(
+				"account has expired",
+				zap.String("user_id", rawAccount.UserID),
+				zap.Time("not_after", *notAfter),
+			)
+		} else if notAfter.Sub(now) < time.Duration(h.ExpiryWarning) {
+			h.logger.Warn(
+				"account expires soon",
+				zap.String("user_id", rawAccount.UserID),
+				zap.Time("not_after", *notAfter),
+			)
+		}
+	}
+
 	// Provision ClientRegistry from AccountsRaw.
-	err = h.ClientRegistry.Provision(ctx, h.AccountsRaw)
+	err = h.ClientRegistry.Provision(
+		ctx,
+		h.AccountsRaw,
+		h.GroupsRaw,
+		h.DefaultAccountFallback,
+		h.DNS.Resolvers,
+		h.delegation,
+	)
 	if err != nil {
 		return fmt.Errorf("unable to provision client registry: %w", err)
 	}
 
-	// Allow AccountsRaw to be GC'd.
+	// Provision usage tracking.
+	err = h.usage.Provision(ctx, &h.ClientRegistry, h.PersistUsage)
+	if err != nil {
+		return fmt.Errorf("unable to provision usage tracking: %w", err)
+	}
+
+	// Allow AccountsRaw and GroupsRaw to be GC'd.
 	h.AccountsRaw = nil
+	h.GroupsRaw = nil
 
 	return nil
 }
 
+func (h *Handler) Cleanup() error {
+	errs := []error{h.usage.Cleanup(), h.DNS.Cleanup()}
+	if h.concurrencyLimiter != nil {
+		errs = append(errs, h.concurrencyLimiter.release())
+	}
+	if h.authzWebhook != nil {
+		errs = append(errs, h.authzWebhook.release())
+	}
+	if h.signedRequestAuth != nil {
+		errs = append(errs, h.signedRequestAuth.Cleanup())
+	}
+	if h.lockout != nil {
+		errs = append(errs, h.lockout.release())
+	}
+	if h.delegation != nil {
+		errs = append(errs, h.delegation.release())
+	}
+	return errors.Join(errs...)
+}
+
 func (h *Handler) ServeHTTP(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -156,17 +493,112 @@ func (h *Handler) ServeHTTP(
 		}
 		mode = hmCleanup
 
+	case "/approvals", "/approvals/approve", "/approvals/reject":
+		return h.serveApprovals(w, req, nextHandler)
+
+	case "/delegation", "/delegation/create", "/delegation/rotate", "/delegation/delete":
+		return h.serveDelegation(w, req, nextHandler)
+
 	default:
 		return nextHandler.ServeHTTP(w, req)
 	}
 
-	handlerImpl := jsonutil.WrapHandler(h.handleDNSRequest(mode))
+	return h.authenticate(w, req, jsonutil.WrapHandler(h.handleDNSRequest(mode)))
+}
+
+// Turns away locked-out clients, and then authenticates the request, if
+// authentication is configured, before passing it on to the given handler.
+func (h *Handler) authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+	handlerImpl caddyhttp.Handler,
+) error {
+	// Turn away locked-out clients before spending any time on their passwords.
+	if username, _, ok := req.BasicAuth(); ok && h.lockout != nil {
+		if kind, remaining, locked := h.lockout.lockedOut(req, username); locked {
+			addLogField(req, zap.String(logLockedOut, kind))
+			setRetryAfter(w.Header(), remaining)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return nil
+		}
+	}
+
 	if h.Authentication != nil {
 		return h.Authentication.ServeHTTP(w, req, handlerImpl)
 	}
 	return handlerImpl.ServeHTTP(w, req)
 }
 
+// Serves the endpoints for listing, approving and rejecting requests that are
+// waiting for approval.
+func (h *Handler) serveApprovals(
+	w http.ResponseWriter,
+	req *http.Request,
+	nextHandler caddyhttp.Handler,
+) error {
+	if h.approvalGate == nil {
+		return nextHandler.ServeHTTP(w, req)
+	}
+
+	var handlerImpl caddyhttp.Handler
+	switch req.URL.Path {
+	case "/approvals":
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return nil
+		}
+		handlerImpl = caddyhttp.HandlerFunc(h.approvalGate.serveList)
+
+	default:
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return nil
+		}
+		approve := req.URL.Path == "/approvals/approve"
+		handlerImpl = jsonutil.WrapHandler(h.approvalGate.serveDecision(approve))
+	}
+
+	return h.authenticate(w, req, handlerImpl)
+}
+
+// Serves the endpoints with which delegators list, create, rotate and delete
+// delegated accounts.
+func (h *Handler) serveDelegation(
+	w http.ResponseWriter,
+	req *http.Request,
+	nextHandler caddyhttp.Handler,
+) error {
+	if h.delegation == nil {
+		return nextHandler.ServeHTTP(w, req)
+	}
+
+	var handlerImpl caddyhttp.Handler
+	switch req.URL.Path {
+	case "/delegation":
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return nil
+		}
+		handlerImpl = caddyhttp.HandlerFunc(h.serveDelegatedAccountList)
+
+	default:
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return nil
+		}
+		switch req.URL.Path {
+		case "/delegation/create":
+			handlerImpl = jsonutil.WrapHandler(h.serveCreateDelegatedAccount)
+		case "/delegation/rotate":
+			handlerImpl = jsonutil.WrapHandler(h.serveRotateDelegatedAccount)
+		default:
+			handlerImpl = jsonutil.WrapHandler(h.serveDeleteDelegatedAccount)
+		}
+	}
+
+	return h.authenticate(w, req, handlerImpl)
+}
+
 type handlerMode string
 
 const (
@@ -176,10 +608,11 @@ const (
 
 func (h *Handler) handleDNSRequest(
 	mode handlerMode,
-) func(*http.Request, RequestBody) (int, optionals.Optional[ResponseBody], error) {
+) func(*http.Request, RequestBody, http.Header) (int, optionals.Optional[ResponseBody], error) {
 	return func(
 		req *http.Request,
 		reqBody RequestBody,
+		respHeader http.Header,
 	) (httpStatus int, respBody optionals.Optional[ResponseBody], err error) {
 		// Check that the user gave a valid request body.
 		if !reqBody.IsValid() {
@@ -189,10 +622,20 @@ func (h *Handler) handleDNSRequest(
 		// Log the challenge domain that appears in the request.
 		addLogField(req, zap.String("domain", reqBody.ChallengeFQDN))
 
+		// Log which password the user authenticated with, so that unused
+		// passwords can be identified and removed.
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if credential, ok := repl.GetString(
+			"http.auth.user." + credentialMetadataKey,
+		); ok {
+			addLogField(req, zap.String(logCredential, credential))
+		}
+
 		// Check that the user is authorized for the challenge domain in the
 		// request.
 		denyReasonOpt, err := h.ClientRegistry.AuthorizeUserChallengeDomain(
 			req,
+			mode,
 			reqBody.ChallengeFQDN,
 		)
 		if err != nil {
@@ -204,6 +647,49 @@ func (h *Handler) handleDNSRequest(
 			return http.StatusForbidden, optionals.None[ResponseBody](), nil
 		}
 
+		userID, err := authenticatedUserID(req)
+		if err != nil {
+			return 0, optionals.None[ResponseBody](), err
+		}
+		policy, exists := h.ClientRegistry.Policy(userID)
+		if !exists {
+			// The user was authorized by their JWT claims alone.
+			policy = &ClientPolicy{UserID: userID}
+		}
+		if policy.delegatedBy != "" && policy.limitsUserID == "" {
+			// The delegation was revoked after the request was authorized.
+			addLogField(req, zap.String(logAuthorizationFailure, string(DenyDelegationRevoked)))
+			return http.StatusForbidden, optionals.None[ResponseBody](), nil
+		}
+
+		// Deny new records during freeze windows.
+		if mode == hmPresent && !policy.FreezeOverride {
+			if window, frozen := activeFreezeWindow(h.FreezeWindows, time.Now()); frozen {
+				addLogField(req, zap.String(logAuthorizationFailure, string(DenyFreezeWindow)))
+				addLogField(req, zap.String(logFreezeWindow, window.Name))
+				return http.StatusForbidden, optionals.None[ResponseBody](), nil
+			}
+		}
+
+		// Check the user's rate limits and quotas. Users that fall back to the
+		// default account share its limits, and delegated accounts share the
+		// limits of the configured account that they descend from, so usage is
+		// tracked against that account rather than the user.
+		denyReasonOpt, commitUsage := h.usage.Reserve(
+			policy.usageUserID(),
+			policy.Limits,
+			mode,
+			reqBody,
+		)
+		if denyReason, denied := denyReasonOpt.Get(); denied {
+			addLogField(req, zap.String(logAuthorizationFailure, string(denyReason)))
+			return http.StatusTooManyRequests, optionals.None[ResponseBody](), nil
+		}
+
+		// Give back the reserved usage unless the DNS provider call succeeds.
+		providerSucceeded := false
+		defer func() { commitUsage(providerSucceeded) }()
+
 		// Figure out the challenge domain's DNS zone.
 		zone, err := certmagic.FindZoneByFQDN(
 			req.Context(),
@@ -220,10 +706,129 @@ func (h *Handler) handleDNSRequest(
 				)
 		}
 
+		// Check the zone against the guardrails.
+		if !h.zoneGuard.allowsZone(zone) {
+			addLogField(req, zap.String(logAuthorizationFailure, string(DenyZoneNotAllowed)))
+			return http.StatusForbidden, optionals.None[ResponseBody](), nil
+		}
+
+		// Check the requested domain's depth below the zone.
+		if policy.MaxSubdomainDepth > 0 {
+			domain, _ := requestedDomain(reqBody.ChallengeFQDN)
+			if subdomainDepth(domain, zone) > policy.MaxSubdomainDepth {
+				addLogField(req, zap.String(logAuthorizationFailure, string(DenySubdomainTooDeep)))
+				return http.StatusForbidden, optionals.None[ResponseBody](), nil
+			}
+		}
+
+		// Check the user's CEL policy, and their shadow CEL policy, now that the
+		// zone is known.
+		if policy.celPolicy != nil || policy.shadow.hasCEL() {
+			domain, _ := requestedDomain(reqBody.ChallengeFQDN)
+			clientIP, _ := caddyhttp.GetVar(
+				req.Context(),
+				caddyhttp.ClientIPVarKey,
+			).(string)
+			celInput := celPolicyInput{
+				userID:   userID,
+				domain:   domain,
+				zone:     normalizeZone(zone),
+				clientIP: clientIP,
+				time:     time.Now(),
+				headers:  req.Header,
+			}
+			denyReasonOpt := optionals.None[DenyReason]()
+			if policy.celPolicy != nil {
+				allowed, err := policy.celPolicy.allows(req.Context(), celInput)
+				if err != nil {
+					// For example, the expression used a header that wasn't sent.
+					h.logger.Warn(
+						"CEL policy failed; denying request",
+						zap.String("user_id", userID),
+						zap.Error(err),
+					)
+				}
+				if !allowed {
+					denyReasonOpt = optionals.Some(DenyCELPolicy)
+				}
+			}
+			h.checkShadowCELPolicy(req, policy, celInput, denyReasonOpt)
+			if denyReason, denied := denyReasonOpt.Get(); denied {
+				addLogField(req, zap.String(logAuthorizationFailure, string(denyReason)))
+				return http.StatusForbidden, optionals.None[ResponseBody](), nil
+			}
+		}
+
+		// Consult the external policy service.
+		if h.authzWebhook != nil {
+			domain, _ := requestedDomain(reqBody.ChallengeFQDN)
+			clientIP, _ := caddyhttp.GetVar(
+				req.Context(),
+				caddyhttp.ClientIPVarKey,
+			).(string)
+			denyReasonOpt, webhookReason := h.authzWebhook.authorize(
+				req.Context(),
+				authzWebhookRequest{
+					User:     userID,
+					FQDN:     reqBody.ChallengeFQDN,
+					Domain:   domain,
+					Zone:     normalizeZone(zone),
+					ClientIP: clientIP,
+					Mode:     mode,
+				},
+			)
+			denyReason, denied := denyReasonOpt.Get()
+			if denied && webhookReason != "" {
+				addLogField(req, zap.String(logWebhookReason, webhookReason))
+			}
+			if denied && !h.authzWebhook.enforces(mode) {
+				// Let the cleanup go ahead, so that the record isn't stranded.
+				addLogField(req, zap.String(logWebhookDenialIgnored, string(denyReason)))
+			} else if denied {
+				addLogField(req, zap.String(logAuthorizationFailure, string(denyReason)))
+				if denyReason == DenyWebhookUnavailable {
+					return http.StatusServiceUnavailable, optionals.None[ResponseBody](), nil
+				}
+				return http.StatusForbidden, optionals.None[ResponseBody](), nil
+			}
+		}
+
+		// Turn away requests for sensitive domains until they are approved. The
+		// client retries, and each retry goes through the checks above again, so
+		// freeze windows and limits still apply once a request is approved.
+		if mode == hmPresent && h.approvalGate != nil {
+			domain, _ := requestedDomain(reqBody.ChallengeFQDN)
+			if h.approvalGate.required(domain, zone) {
+				clientIP, _ := caddyhttp.GetVar(
+					req.Context(),
+					caddyhttp.ClientIPVarKey,
+				).(string)
+				denyReasonOpt, approvalID, err := h.approvalGate.check(req, PendingApproval{
+					User:     userID,
+					FQDN:     reqBody.ChallengeFQDN,
+					Zone:     normalizeZone(zone),
+					ClientIP: clientIP,
+				})
+				if err != nil {
+					return 0, optionals.None[ResponseBody](), err
+				}
+				if denyReason, denied := denyReasonOpt.Get(); denied {
+					addLogField(req, zap.String(logAuthorizationFailure, string(denyReason)))
+					if denyReason == DenyApprovalPending {
+						respHeader.Set(approvalIDHeader, approvalID)
+						setRetryAfter(respHeader, approvalRetryAfter)
+						return http.StatusServiceUnavailable, optionals.None[ResponseBody](), nil
+					}
+					return http.StatusForbidden, optionals.None[ResponseBody](), nil
+				}
+			}
+		}
+
 		// Build the DNS record to create/delete.
 		ttl := time.Duration(0)
-		if mode != hmCleanup && h.DNS.TTL != nil {
-			ttl = time.Duration(*h.DNS.TTL)
+		if mode != hmCleanup {
+			ttl = h.DNS.recordTTL(policy, zone, reqBody.TTL)
+			addLogField(req, zap.Duration(logTTL, ttl))
 		}
 		records := []libdns.Record{
 			libdns.TXT{
@@ -233,24 +838,59 @@ func (h *Handler) handleDNSRequest(
 			},
 		}
 
+		// Wait for our turn to call the DNS provider.
+		if h.concurrencyLimiter != nil {
+			release, queueDepth, waited, err := h.concurrencyLimiter.acquire(
+				req.Context(),
+			)
+			addLogField(req, zap.Int(logQueueDepth, queueDepth))
+			addLogField(req, zap.Duration(logQueueWait, waited))
+			if errors.Is(err, errOverloaded) {
+				addLogField(req, zap.Bool(logOverloaded, true))
+				setRetryAfter(
+					respHeader,
+					time.Duration(h.concurrencyLimiter.config.RetryAfter),
+				)
+				return http.StatusTooManyRequests, optionals.None[ResponseBody](), nil
+			}
+			if err != nil {
+				return 0, optionals.None[ResponseBody](),
+					fmt.Errorf("unable to start DNS provider operation: %w", err)
+			}
+			defer release()
+		}
+
+		// Report the TTL that the record actually gets, rather than the one that
+		// was requested.
+		result := reqBody
+		result.TTL = ttlSeconds(ttl)
+
 		switch mode {
 		case hmPresent:
 			// Create the DNS record.
 			_, err = h.DNS.Provider.AppendRecords(req.Context(), zone, records)
+			providerSucceeded = err == nil
 			if err != nil {
-				return 0, optionals.None[ResponseBody](),
-					fmt.Errorf("error creating DNS record: %w", err)
+				return providerErrorResponse(
+					req,
+					respHeader,
+					fmt.Errorf("error creating DNS record: %w", err),
+				)
 			}
-			return http.StatusOK, optionals.Some(reqBody), nil
+			return http.StatusOK, optionals.Some(result), nil
 
 		case hmCleanup:
 			// Delete the DNS record.
 			_, err = h.DNS.Provider.DeleteRecords(req.Context(), zone, records)
+			providerSucceeded = err == nil
 			if err != nil {
-				return 0, optionals.None[ResponseBody](),
-					fmt.Errorf("error deleting DNS record: %w", err)
+				return providerErrorResponse(
+					req,
+					respHeader,
+					fmt.Errorf("error deleting DNS record: %w", err),
+				)
 			}
-			return http.StatusOK, optionals.Some(reqBody), nil
+			return http.StatusOK, optionals.Some(result), nil
 		}
 
 		return 0, optionals.None[ResponseBody](),
@@ -258,6 +898,30 @@ func (h *Handler) handleDNSRequest(
 	}
 }
 
+// Produces the response for a failed DNS provider call. If the call was
+// rejected by the circuit breaker, then the client is told to come back later.
+// Otherwise, the error is passed on.
+func providerErrorResponse(
+	req *http.Request,
+	respHeader http.Header,
+	err error,
+) (int, optionals.Optional[ResponseBody], error) {
+	var circuitOpenErr *circuitOpenError
+	if errors.As(err, &circuitOpenErr) {
+		addLogField(req, zap.Bool(logCircuitOpen, true))
+		setRetryAfter(respHeader, circuitOpenErr.retryAfter)
+		return http.StatusServiceUnavailable, optionals.None[ResponseBody](), nil
+	}
+	return 0, optionals.None[ResponseBody](), err
+}
+
+// Sets the Retry-After header to the given duration, rounded up to the nearest
+// second.
+func setRetryAfter(header http.Header, d time.Duration) {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	header.Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+}
+
 // Parses a dns01proxy directive into a Handler instance.
 //
 // Syntax:
@@ -265,11 +929,108 @@ func (h *Handler) handleDNSRequest(
 //	dns01proxy {
 //		dns <provider_name> [<params...>]
 //		dns_ttl <ttl>
+//		zone <zone> {
+//			ttl <ttl>
+//			min_ttl <ttl>
+//			max_ttl <ttl>
+//		}
 //		resolvers <resolvers...>
+//		dns_retries <max_attempts> [<initial_backoff> [<max_backoff>]]
+//		dns_circuit_breaker <failure_threshold> [<cooldown>]
+//		concurrency_limit <max_in_flight> {
+//			max_queued <max_queued>
+//			max_wait <max_wait>
+//			retry_after <retry_after>
+//		}
+//		lockout {
+//			max_failures <failures>
+//			duration <duration>
+//			max_duration <duration>
+//			reset_after <duration>
+//		}
+//		persist_usage
+//		default_account_fallback
+//		signature_max_skew <duration>
+//		expiry_warning <duration>
+//		header_auth [<header>]
+//		client_cert_auth {
+//			trusted_ca_cert_file <files...>
+//			identity cn|dns_san|spiffe
+//		}
+//		jwt_auth {
+//			jwks_file <file>
+//			jwks_url <url>
+//			jwks_refresh <duration>
+//			issuer <issuer>
+//			audience <audiences...>
+//			user_id_claim <claim>
+//			allow_domains <domains...>
+//		}
+//		authz_webhook <url> {
+//			header <name> <value>
+//			timeout <duration>
+//			cache_ttl <duration>
+//			fail_open
+//			enforce_on_cleanup
+//		}
+//		require_approval {
+//			domains <domains...>
+//			patterns <regexps...>
+//			zone_apex
+//			approvers <user_ids...>
+//			timeout <duration>
+//		}
+//		allowed_zones <zones...>
+//		denied_zones <zones...>
+//		freeze_window <name> {
+//			start <time>
+//			end <time>
+//			cron <minute> <hour> <day_of_month> <month> <day_of_week>
+//			duration <duration>
+//			timezone <timezone>
+//		}
+//		group <name> {
+//			allow_domains <domains...>
+//			deny_domains <domains...>
+//			freeze_override
+//		}
 //		user <userID> {
 //			password <hashed_password>
+//			credential <name> <hashed_password> {
+//				not_before <time>
+//				not_after <time>
+//			}
+//			token <name> <sha256> {
+//				expires <time>
+//				scope <domains...>
+//			}
+//			signing_secret <secret>
+//			peer_uid <uids...>
+//			peer_gid <gids...>
+//			disabled
+//			not_before <time>
+//			not_after <time>
+//			active_hours <days> <start> <end> [<timezone>]
+//			freeze_override
+//			delegator
+//			groups <names...>
 //			allow_domains <domains...>
 //			deny_domains <domains...>
+//			allow_patterns <regexps...>
+//			deny_patterns <regexps...>
+//			max_subdomain_depth <depth>
+//			allowed_networks <cidrs...>
+//			bind_to_client_ip [check_ptr]
+//			cel <expression>
+//			shadow_allow_domains <domains...>
+//			shadow_deny_domains <domains...>
+//			shadow_cel <expression>
+//			requests_per_minute <requests> [<burst>]
+//			presents_per_day <presents>
+//			max_outstanding_records <records>
+//			ttl <ttl>
+//			min_ttl <ttl>
+//			max_ttl <ttl>
 //		}
 //	}
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -312,12 +1073,526 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			caddyTTL := caddy.Duration(parsedTTL)
 			h.DNS.TTL = &caddyTTL
 
-		case "resolvers":
-			h.DNS.Resolvers = d.RemainingArgs()
-			if len(h.DNS.Resolvers) == 0 {
-				return d.Errf("must specify at least one resolver address")
+		case "zone":
+			var zone string
+			if !d.AllArgs(&zone) {
+				return d.ArgErr()
 			}
-
+			if h.DNS.Zones == nil {
+				h.DNS.Zones = map[string]*ZoneConfig{}
+			}
+			if _, exists := h.DNS.Zones[zone]; exists {
+				return d.Errf("cannot configure zone %q more than once", zone)
+			}
+
+			zoneConfig := &ZoneConfig{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				fieldName := d.Val()
+				var dest **caddy.Duration
+				switch fieldName {
+				case "ttl":
+					dest = &zoneConfig.TTL
+				case "min_ttl":
+					dest = &zoneConfig.MinTTL
+				case "max_ttl":
+					dest = &zoneConfig.MaxTTL
+				default:
+					return d.Errf("unrecognized zone directive: %q", fieldName)
+				}
+
+				err := parseDurationArg(d, dest)
+				if err != nil {
+					return err
+				}
+			}
+			h.DNS.Zones[zone] = zoneConfig
+
+		case "resolvers":
+			h.DNS.Resolvers = d.RemainingArgs()
+			if len(h.DNS.Resolvers) == 0 {
+				return d.Errf("must specify at least one resolver address")
+			}
+
+		case "dns_retries":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			maxAttempts, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid number of attempts %q: %v", args[0], err)
+			}
+			retries := &RetryConfig{
+				MaxAttempts: maxAttempts,
+			}
+			backoffs := []*caddy.Duration{
+				&retries.InitialBackoff,
+				&retries.MaxBackoff,
+			}
+			for i, arg := range args[1:] {
+				backoff, err := caddy.ParseDuration(arg)
+				if err != nil {
+					return err
+				}
+				*backoffs[i] = caddy.Duration(backoff)
+			}
+			h.DNS.Retries = retries
+
+		case "dns_circuit_breaker":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid failure threshold %q: %v", args[0], err)
+			}
+			breaker := &CircuitBreakerConfig{
+				FailureThreshold: threshold,
+			}
+			if len(args) > 1 {
+				cooldown, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return err
+				}
+				breaker.Cooldown = caddy.Duration(cooldown)
+			}
+			h.DNS.CircuitBreaker = breaker
+
+		case "concurrency_limit":
+			var maxInFlightRaw string
+			if !d.AllArgs(&maxInFlightRaw) {
+				return d.ArgErr()
+			}
+			maxInFlight, err := strconv.Atoi(maxInFlightRaw)
+			if err != nil {
+				return d.Errf("invalid concurrency limit %q: %v", maxInFlightRaw, err)
+			}
+			concurrency := &ConcurrencyConfig{
+				MaxInFlight: maxInFlight,
+			}
+
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				fieldName := d.Val()
+				var arg string
+				if !d.AllArgs(&arg) {
+					return d.ArgErr()
+				}
+
+				switch fieldName {
+				case "max_queued":
+					concurrency.MaxQueued, err = strconv.Atoi(arg)
+					if err != nil {
+						return d.Errf("invalid queue size %q: %v", arg, err)
+					}
+
+				case "max_wait", "retry_after":
+					duration, err := caddy.ParseDuration(arg)
+					if err != nil {
+						return err
+					}
+					if fieldName == "max_wait" {
+						concurrency.MaxWait = caddy.Duration(duration)
+					} else {
+						concurrency.RetryAfter = caddy.Duration(duration)
+					}
+
+				default:
+					return d.Errf("unrecognized concurrency_limit directive: %q", fieldName)
+				}
+			}
+			h.Concurrency = concurrency
+
+		case "lockout":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if h.Lockout != nil {
+				return d.Errf("cannot specify more than one lockout block")
+			}
+			lockout := &LockoutConfig{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				fieldName := d.Val()
+				var arg string
+				if !d.AllArgs(&arg) {
+					return d.ArgErr()
+				}
+
+				switch fieldName {
+				case "max_failures":
+					maxFailures, err := strconv.Atoi(arg)
+					if err != nil {
+						return d.Errf("invalid failure count %q: %v", arg, err)
+					}
+					lockout.MaxFailures = maxFailures
+
+				case "duration", "max_duration", "reset_after":
+					duration, err := caddy.ParseDuration(arg)
+					if err != nil {
+						return err
+					}
+					dest := map[string]*caddy.Duration{
+						"duration":     &lockout.Duration,
+						"max_duration": &lockout.MaxDuration,
+						"reset_after":  &lockout.ResetAfter,
+					}[fieldName]
+					*dest = caddy.Duration(duration)
+
+				default:
+					return d.Errf("unrecognized lockout directive: %q", fieldName)
+				}
+			}
+			h.Lockout = lockout
+
+		case "allowed_zones", "denied_zones":
+			fieldName := d.Val()
+			zones := d.RemainingArgs()
+			if len(zones) == 0 {
+				return d.Errf("must specify at least one zone")
+			}
+			if fieldName == "allowed_zones" {
+				h.AllowedZones = append(h.AllowedZones, zones...)
+			} else {
+				h.DeniedZones = append(h.DeniedZones, zones...)
+			}
+
+		case "client_cert_auth":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if h.ClientCertAuth != nil {
+				return d.Errf("cannot specify more than one client_cert_auth block")
+			}
+			config := &ClientCertAuthConfig{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				fieldName := d.Val()
+				switch fieldName {
+				case "trusted_ca_cert_file":
+					files := d.RemainingArgs()
+					if len(files) == 0 {
+						return d.ArgErr()
+					}
+					config.TrustedCACertPEMFiles = append(
+						config.TrustedCACertPEMFiles,
+						files...,
+					)
+
+				case "identity":
+					if !d.AllArgs(&config.Identity) {
+						return d.ArgErr()
+					}
+
+				default:
+					return d.Errf("unrecognized client_cert_auth directive: %q", fieldName)
+				}
+			}
+			h.ClientCertAuth = config
+
+		case "jwt_auth":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if h.JWTAuth != nil {
+				return d.Errf("cannot specify more than one jwt_auth block")
+			}
+			config := &JWTAuthConfig{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				fieldName := d.Val()
+				switch fieldName {
+				case "jwks_file":
+					if !d.AllArgs(&config.JWKSFile) {
+						return d.ArgErr()
+					}
+
+				case "jwks_url":
+					if !d.AllArgs(&config.JWKSURL) {
+						return d.ArgErr()
+					}
+
+				case "jwks_refresh":
+					var refreshRaw string
+					if !d.AllArgs(&refreshRaw) {
+						return d.ArgErr()
+					}
+					refresh, err := caddy.ParseDuration(refreshRaw)
+					if err != nil {
+						return err
+					}
+					config.JWKSRefresh = caddy.Duration(refresh)
+
+				case "issuer":
+					if !d.AllArgs(&config.Issuer) {
+						return d.ArgErr()
+					}
+
+				case "audience":
+					audiences := d.RemainingArgs()
+					if len(audiences) == 0 {
+						return d.ArgErr()
+					}
+					config.Audience = append(config.Audience, audiences...)
+
+				case "user_id_claim":
+					if !d.AllArgs(&config.UserIDClaim) {
+						return d.ArgErr()
+					}
+
+				case "allow_domains":
+					domains := d.RemainingArgs()
+					if len(domains) == 0 {
+						return d.ArgErr()
+					}
+					config.AllowDomains = append(config.AllowDomains, domains...)
+
+				default:
+					return d.Errf("unrecognized jwt_auth directive: %q", fieldName)
+				}
+			}
+			h.JWTAuth = config
+
+		case "header_auth":
+			if h.HeaderAuth != nil {
+				return d.Errf("cannot specify more than one header_auth directive")
+			}
+			config := &HeaderAuthConfig{}
+			if d.NextArg() {
+				config.Header = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			h.HeaderAuth = config
+
+		case "authz_webhook":
+			if h.AuthzWebhook != nil {
+				return d.Errf("cannot specify more than one authz_webhook block")
+			}
+			config := &AuthzWebhookConfig{}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.URL = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				fieldName := d.Val()
+				switch fieldName {
+				case "header":
+					var name, value string
+					if !d.AllArgs(&name, &value) {
+						return d.ArgErr()
+					}
+					if config.Headers == nil {
+						config.Headers = map[string]string{}
+					}
+					config.Headers[name] = value
+
+				case "timeout", "cache_ttl":
+					var durationRaw string
+					if !d.AllArgs(&durationRaw) {
+						return d.ArgErr()
+					}
+					duration, err := caddy.ParseDuration(durationRaw)
+					if err != nil {
+						return err
+					}
+					if fieldName == "timeout" {
+						config.Timeout = caddy.Duration(duration)
+					} else {
+						config.CacheTTL = caddy.Duration(duration)
+					}
+
+				case "fail_open":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					config.FailOpen = true
+
+				case "enforce_on_cleanup":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					config.EnforceOnCleanup = true
+
+				default:
+					return d.Errf("unrecognized authz_webhook directive: %q", fieldName)
+				}
+			}
+			h.AuthzWebhook = config
+
+		case "require_approval":
+			if h.RequireApproval != nil {
+				return d.Errf("cannot specify more than one require_approval block")
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config := &ApprovalConfig{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				fieldName := d.Val()
+				switch fieldName {
+				case "domains", "patterns", "approvers":
+					values := d.RemainingArgs()
+					if len(values) == 0 {
+						return d.ArgErr()
+					}
+					switch fieldName {
+					case "domains":
+						config.Domains = append(config.Domains, values...)
+					case "patterns":
+						config.Patterns = append(config.Patterns, values...)
+					case "approvers":
+						config.Approvers = append(config.Approvers, values...)
+					}
+
+				case "zone_apex":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					config.ZoneApex = true
+
+				case "timeout":
+					var timeoutRaw string
+					if !d.AllArgs(&timeoutRaw) {
+						return d.ArgErr()
+					}
+					timeout, err := caddy.ParseDuration(timeoutRaw)
+					if err != nil {
+						return err
+					}
+					config.Timeout = caddy.Duration(timeout)
+
+				default:
+					return d.Errf("unrecognized require_approval directive: %q", fieldName)
+				}
+			}
+			h.RequireApproval = config
+
+		case "signature_max_skew":
+			var skewRaw string
+			if !d.AllArgs(&skewRaw) {
+				return d.ArgErr()
+			}
+			skew, err := caddy.ParseDuration(skewRaw)
+			if err != nil {
+				return err
+			}
+			h.SignatureMaxSkew = caddy.Duration(skew)
+
+		case "expiry_warning":
+			var warningRaw string
+			if !d.AllArgs(&warningRaw) {
+				return d.ArgErr()
+			}
+			warning, err := caddy.ParseDuration(warningRaw)
+			if err != nil {
+				return err
+			}
+			h.ExpiryWarning = caddy.Duration(warning)
+
+		case "persist_usage":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			h.PersistUsage = true
+
+		case "default_account_fallback":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			h.DefaultAccountFallback = true
+
+		case "freeze_window":
+			var window FreezeWindow
+			if !d.AllArgs(&window.Name) {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				windowFieldName := d.Val()
+				switch windowFieldName {
+				case "start", "end":
+					var timeRaw string
+					if !d.AllArgs(&timeRaw) {
+						return d.ArgErr()
+					}
+					t, err := time.Parse(time.RFC3339, timeRaw)
+					if err != nil {
+						return d.Errf("invalid time %q: %v", timeRaw, err)
+					}
+					if windowFieldName == "start" {
+						window.Start = &t
+					} else {
+						window.End = &t
+					}
+
+				case "cron":
+					fields := d.RemainingArgs()
+					if len(fields) == 0 {
+						return d.ArgErr()
+					}
+					window.Cron = strings.Join(fields, " ")
+
+				case "duration":
+					var durationRaw string
+					if !d.AllArgs(&durationRaw) {
+						return d.ArgErr()
+					}
+					duration, err := caddy.ParseDuration(durationRaw)
+					if err != nil {
+						return err
+					}
+					window.Duration = caddy.Duration(duration)
+
+				case "timezone":
+					if !d.AllArgs(&window.Timezone) {
+						return d.ArgErr()
+					}
+
+				default:
+					return d.Errf("unrecognized freeze_window directive: %q", windowFieldName)
+				}
+			}
+			h.FreezeWindows = append(h.FreezeWindows, window)
+
+		case "group":
+			var group RawGroup
+			if !d.AllArgs(&group.Name) {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				var curDomainsRaw *[]string
+				fieldName := d.Val()
+				switch fieldName {
+				case "freeze_override":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					group.FreezeOverride = true
+					continue
+
+				case "allow_domains":
+					curDomainsRaw = &group.AllowDomainsRaw
+				case "deny_domains":
+					curDomainsRaw = &group.DenyDomainsRaw
+				default:
+					return d.Errf("unrecognized group directive: %q", fieldName)
+				}
+
+				if *curDomainsRaw != nil {
+					return d.Errf(
+						"cannot specify more than one %q policy per group",
+						fieldName,
+					)
+				}
+				domainList := d.RemainingArgs()
+				if len(domainList) == 0 {
+					return d.Errf("must specify at least one domain")
+				}
+				*curDomainsRaw = domainList
+			}
+			h.GroupsRaw = append(h.GroupsRaw, group)
+
 		case "user":
 			var userID string
 			if !d.AllArgs(&userID) {
@@ -347,12 +1622,293 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					account.Password = &password
 					continue
 
+				case "requests_per_minute", "presents_per_day", "max_outstanding_records":
+					args := d.RemainingArgs()
+					maxArgs := 1
+					if fieldName == "requests_per_minute" {
+						maxArgs = 2
+					}
+					if len(args) < 1 || len(args) > maxArgs {
+						return d.ArgErr()
+					}
+					values := make([]int, len(args))
+					for i, arg := range args {
+						var err error
+						values[i], err = strconv.Atoi(arg)
+						if err != nil {
+							return d.Errf("invalid %s %q: %v", fieldName, arg, err)
+						}
+					}
+
+					if account.Limits == nil {
+						account.Limits = &AccountLimits{}
+					}
+					switch fieldName {
+					case "requests_per_minute":
+						account.Limits.RequestsPerMinute = values[0]
+						if len(values) > 1 {
+							account.Limits.Burst = values[1]
+						}
+					case "presents_per_day":
+						account.Limits.PresentsPerDay = values[0]
+					case "max_outstanding_records":
+						account.Limits.MaxOutstandingRecords = values[0]
+					}
+					continue
+
+				case "credential":
+					var name, password string
+					if !d.Args(&name, &password) || d.NextArg() {
+						return d.ArgErr()
+					}
+					credential := RawCredential{
+						Name:     name,
+						Password: password,
+					}
+
+					for nesting := d.Nesting(); d.NextBlock(nesting); {
+						credentialFieldName := d.Val()
+						switch credentialFieldName {
+						case "not_before", "not_after":
+							var timeRaw string
+							if !d.AllArgs(&timeRaw) {
+								return d.ArgErr()
+							}
+							t, err := time.Parse(time.RFC3339, timeRaw)
+							if err != nil {
+								return d.Errf("invalid time %q: %v", timeRaw, err)
+							}
+							if credentialFieldName == "not_before" {
+								credential.NotBefore = &t
+							} else {
+								credential.NotAfter = &t
+							}
+
+						default:
+							return d.Errf(
+								"unrecognized credential directive: %q",
+								credentialFieldName,
+							)
+						}
+					}
+
+					account.Credentials = append(account.Credentials, credential)
+					continue
+
+				case "token":
+					var name, hash string
+					if !d.Args(&name, &hash) || d.NextArg() {
+						return d.ArgErr()
+					}
+					token := RawToken{
+						Name:   name,
+						SHA256: hash,
+					}
+
+					for nesting := d.Nesting(); d.NextBlock(nesting); {
+						tokenFieldName := d.Val()
+						switch tokenFieldName {
+						case "expires":
+							var expiresRaw string
+							if !d.AllArgs(&expiresRaw) {
+								return d.ArgErr()
+							}
+							expires, err := time.Parse(time.RFC3339, expiresRaw)
+							if err != nil {
+								return d.Errf("invalid expiry time %q: %v", expiresRaw, err)
+							}
+							token.Expires = &expires
+
+						case "scope":
+							token.Scope = d.RemainingArgs()
+							if len(token.Scope) == 0 {
+								return d.Errf("must specify at least one domain")
+							}
+
+						default:
+							return d.Errf("unrecognized token directive: %q", tokenFieldName)
+						}
+					}
+
+					account.Tokens = append(account.Tokens, token)
+					continue
+
+				case "signing_secret":
+					var secret string
+					if !d.AllArgs(&secret) {
+						return d.ArgErr()
+					}
+					if account.SigningSecret != nil {
+						return d.Errf("cannot specify more than one signing secret per user")
+					}
+					account.SigningSecret = &secret
+					continue
+
+				case "peer_uid", "peer_gid":
+					idsRaw := d.RemainingArgs()
+					if len(idsRaw) == 0 {
+						return d.ArgErr()
+					}
+					for _, idRaw := range idsRaw {
+						id, err := strconv.ParseUint(idRaw, 10, 32)
+						if err != nil {
+							return d.Errf("invalid %s: %q", fieldName, idRaw)
+						}
+						if fieldName == "peer_uid" {
+							account.PeerUIDs = append(account.PeerUIDs, uint32(id))
+						} else {
+							account.PeerGIDs = append(account.PeerGIDs, uint32(id))
+						}
+					}
+					continue
+
+				case "ttl", "min_ttl", "max_ttl":
+					dest := map[string]**caddy.Duration{
+						"ttl":     &account.TTL,
+						"min_ttl": &account.MinTTL,
+						"max_ttl": &account.MaxTTL,
+					}[fieldName]
+					err := parseDurationArg(d, dest)
+					if err != nil {
+						return err
+					}
+					continue
+
+				case "bind_to_client_ip":
+					if account.BindToClientIP != nil {
+						return d.Errf("cannot specify more than one bind_to_client_ip per user")
+					}
+					account.BindToClientIP = &ClientIPBinding{}
+					for d.NextArg() {
+						switch d.Val() {
+						case "check_ptr":
+							account.BindToClientIP.CheckPTR = true
+						default:
+							return d.Errf("unrecognized bind_to_client_ip option: %q", d.Val())
+						}
+					}
+					continue
+
+				case "cel":
+					if account.CEL != "" {
+						return d.Errf("cannot specify more than one CEL policy per user")
+					}
+					if !d.AllArgs(&account.CEL) {
+						return d.ArgErr()
+					}
+					continue
+
+				case "shadow_cel":
+					if account.ShadowCEL != "" {
+						return d.Errf("cannot specify more than one shadow CEL policy per user")
+					}
+					if !d.AllArgs(&account.ShadowCEL) {
+						return d.ArgErr()
+					}
+					continue
+
+				case "disabled":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					account.Disabled = true
+					continue
+
+				case "delegator":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					account.Delegator = true
+					continue
+
+				case "not_before", "not_after":
+					var timeRaw string
+					if !d.AllArgs(&timeRaw) {
+						return d.ArgErr()
+					}
+					t, err := time.Parse(time.RFC3339, timeRaw)
+					if err != nil {
+						return d.Errf("invalid time %q: %v", timeRaw, err)
+					}
+					if fieldName == "not_before" {
+						account.NotBefore = &t
+					} else {
+						account.NotAfter = &t
+					}
+					continue
+
+				case "active_hours":
+					args := d.RemainingArgs()
+					if len(args) < 3 || len(args) > 4 {
+						return d.ArgErr()
+					}
+					window := ActiveHoursWindow{
+						Days:  strings.Split(args[0], ","),
+						Start: args[1],
+						End:   args[2],
+					}
+					if len(args) == 4 {
+						window.Timezone = args[3]
+					}
+					account.ActiveHours = append(account.ActiveHours, window)
+					continue
+
+				case "freeze_override":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					account.FreezeOverride = true
+					continue
+
+				case "groups":
+					groups := d.RemainingArgs()
+					if len(groups) == 0 {
+						return d.Errf("must specify at least one group")
+					}
+					account.Groups = append(account.Groups, groups...)
+					continue
+
+				case "allowed_networks":
+					networks := d.RemainingArgs()
+					if len(networks) == 0 {
+						return d.Errf("must specify at least one network")
+					}
+					account.AllowedNetworksRaw = append(
+						account.AllowedNetworksRaw,
+						networks...,
+					)
+					continue
+
 				case "allow_domains":
 					curDomainsRaw = &account.AllowDomainsRaw
 
 				case "deny_domains":
 					curDomainsRaw = &account.DenyDomainsRaw
 
+				case "allow_patterns":
+					curDomainsRaw = &account.AllowPatternsRaw
+
+				case "deny_patterns":
+					curDomainsRaw = &account.DenyPatternsRaw
+
+				case "shadow_allow_domains":
+					curDomainsRaw = &account.ShadowAllowDomainsRaw
+
+				case "shadow_deny_domains":
+					curDomainsRaw = &account.ShadowDenyDomainsRaw
+
+				case "max_subdomain_depth":
+					var depthRaw string
+					if !d.AllArgs(&depthRaw) {
+						return d.ArgErr()
+					}
+					depth, err := strconv.Atoi(depthRaw)
+					if err != nil {
+						return d.Errf("invalid subdomain depth %q: %v", depthRaw, err)
+					}
+					account.MaxSubdomainDepth = depth
+					continue
+
 				default:
 					return d.Errf("unrecognized user directive: %q", fieldName)
 				}
@@ -383,6 +1939,26 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// Parses a single duration argument from the current Caddyfile line into dest,
+// which must not already be set.
+func parseDurationArg(d *caddyfile.Dispenser, dest **caddy.Duration) error {
+	fieldName := d.Val()
+	var arg string
+	if !d.AllArgs(&arg) {
+		return d.ArgErr()
+	}
+	if *dest != nil {
+		return d.Errf("cannot specify %q more than once", fieldName)
+	}
+	duration, err := caddy.ParseDuration(arg)
+	if err != nil {
+		return err
+	}
+	caddyDuration := caddy.Duration(duration)
+	*dest = &caddyDuration
+	return nil
+}
+
 // Unmarshals tokens from h into a new Handler instance that is ready for
 // provisioning.
 func parseHandler(
@@ -0,0 +1,64 @@
+package caddydns01proxy
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+)
+
+// Configures authentication by a request header that an authenticating reverse
+// proxy (e.g., oauth2-proxy or Authelia) sets to the user ID. The header is
+// only accepted from proxies that are configured as trusted.
+type HeaderAuthConfig struct {
+	// The header that carries the user ID. Defaults to `X-Forwarded-User`.
+	Header string `json:"header,omitempty"`
+}
+
+const defaultIdentityHeader = "X-Forwarded-User"
+
+// Authenticates clients by a header set by a trusted proxy.
+type headerAuthenticator struct {
+	header string
+	logger *zap.Logger
+}
+
+var _ caddyauth.Authenticator = (*headerAuthenticator)(nil)
+
+func (c *HeaderAuthConfig) provision(logger *zap.Logger) *headerAuthenticator {
+	if c.Header == "" {
+		c.Header = defaultIdentityHeader
+	}
+	return &headerAuthenticator{
+		header: http.CanonicalHeaderKey(c.Header),
+		logger: logger,
+	}
+}
+
+func (a *headerAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	userID := req.Header.Get(a.header)
+	if userID == "" {
+		return caddyauth.User{}, false, nil
+	}
+
+	// Anyone can send the header, so only believe it if the connection comes
+	// from a trusted proxy.
+	trusted, _ := caddyhttp.GetVar(
+		req.Context(),
+		caddyhttp.TrustedProxyVarKey,
+	).(bool)
+	if !trusted {
+		a.logger.Warn(
+			"rejected identity header from untrusted connection",
+			zap.String("header", a.header),
+			zap.String("remote_addr", req.RemoteAddr),
+		)
+		return caddyauth.User{}, false, nil
+	}
+
+	return caddyauth.User{ID: userID}, true, nil
+}
@@ -0,0 +1,64 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Sets the given Caddy HTTP variables on the request, as the server would.
+func withVars(req *http.Request, vars map[string]any) *http.Request {
+	ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, vars)
+	return req.WithContext(ctx)
+}
+
+func TestHeaderAuth(t *testing.T) {
+	a := (&HeaderAuthConfig{Header: "x-remote-user"}).provision(zap.NewNop())
+
+	for _, test := range []struct {
+		name       string
+		trusted    bool
+		userID     string
+		wantAuthed bool
+	}{
+		{"trusted proxy", true, "alice", true},
+		{"untrusted connection", false, "alice", false},
+		{"no header", true, "", false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/present", nil)
+		if test.userID != "" {
+			req.Header.Set("X-Remote-User", test.userID)
+		}
+		req = withVars(req, map[string]any{
+			caddyhttp.TrustedProxyVarKey: test.trusted,
+		})
+
+		user, authed, err := a.Authenticate(httptest.NewRecorder(), req)
+		if err != nil || authed != test.wantAuthed {
+			t.Errorf("%s: got authed %v, error %v", test.name, authed, err)
+		}
+		if authed && user.ID != test.userID {
+			t.Errorf("%s: got user %q, want %q", test.name, user.ID, test.userID)
+		}
+	}
+}
+
+func TestHeaderAuthDefaultHeader(t *testing.T) {
+	config := &HeaderAuthConfig{}
+	a := config.provision(zap.NewNop())
+	if config.Header != defaultIdentityHeader {
+		t.Errorf("got header %q, want %q", config.Header, defaultIdentityHeader)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/present", nil)
+	req.Header.Set(defaultIdentityHeader, "alice")
+	req = withVars(req, map[string]any{caddyhttp.TrustedProxyVarKey: true})
+	user, authed, err := a.Authenticate(httptest.NewRecorder(), req)
+	if err != nil || !authed || user.ID != "alice" {
+		t.Errorf("got authed %v as %q, error %v", authed, user.ID, err)
+	}
+}
@@ -0,0 +1,111 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/liujed/goutil/optionals"
+)
+
+// Requires that a requested domain currently resolves to the client's IP
+// address. This lets a fleet of hosts share one account, with each host only
+// able to answer challenges for its own hostname.
+type ClientIPBinding struct {
+	// Whether the reverse DNS (PTR) records of the client's IP address must also
+	// include the requested domain.
+	CheckPTR bool `json:"check_ptr,omitempty"`
+}
+
+// How long the DNS lookups for a ClientIPBinding can take.
+const clientIPBindingTimeout = 5 * time.Second
+
+// Returns a resolver that uses the given DNS resolvers, or the system's
+// resolvers if none are given.
+func newResolver(resolvers []string) *net.Resolver {
+	if len(resolvers) == 0 {
+		return net.DefaultResolver
+	}
+
+	nameservers := certmagic.RecursiveNameservers(resolvers)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			var err error
+			for _, nameserver := range nameservers {
+				var conn net.Conn
+				conn, err = dialer.DialContext(ctx, network, nameserver)
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
+
+// Checks that the given domain resolves to the given client IP address, and, if
+// configured, that the client IP address's PTR records include the domain.
+// Returns None if so. Otherwise, returns the reason for denial.
+func (b *ClientIPBinding) check(
+	ctx context.Context,
+	resolver *net.Resolver,
+	domain string,
+	clientIP netip.Addr,
+) (optionals.Optional[DenyReason], error) {
+	ctx, cancel := context.WithTimeout(ctx, clientIPBindingTimeout)
+	defer cancel()
+
+	clientIP = clientIP.Unmap().WithZone("")
+
+	addrs, err := resolver.LookupNetIP(ctx, "ip", domain)
+	if isDNSNotFound(err) {
+		return optionals.Some(DenyDomainNotBound), nil
+	}
+	if err != nil {
+		return optionals.Some(DenyError),
+			fmt.Errorf("unable to resolve requested domain: %w", err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.Unmap() == clientIP {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return optionals.Some(DenyDomainNotBound), nil
+	}
+
+	if !b.CheckPTR {
+		return optionals.None[DenyReason](), nil
+	}
+
+	names, err := resolver.LookupAddr(ctx, clientIP.String())
+	if isDNSNotFound(err) {
+		return optionals.Some(DenyDomainNotBound), nil
+	}
+	if err != nil {
+		return optionals.Some(DenyError),
+			fmt.Errorf("unable to look up PTR records for client IP: %w", err)
+	}
+	for _, name := range names {
+		if strings.EqualFold(strings.TrimSuffix(name, "."), domain) {
+			return optionals.None[DenyReason](), nil
+		}
+	}
+	return optionals.Some(DenyDomainNotBound), nil
+}
+
+// Determines whether the given error from a lookup means that there are no
+// records.
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
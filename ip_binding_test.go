@@ -0,0 +1,99 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/liujed/goutil/optionals"
+)
+
+// These tests rely on the hosts file mapping localhost to 127.0.0.1, which the
+// system resolver consults before DNS.
+func TestClientIPBinding(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		binding  ClientIPBinding
+		clientIP string
+		want     optionals.Optional[DenyReason]
+	}{
+		{"bound", ClientIPBinding{}, "127.0.0.1", optionals.None[DenyReason]()},
+		{"bound, mapped", ClientIPBinding{}, "::ffff:127.0.0.1", optionals.None[DenyReason]()},
+		{"bound, PTR", ClientIPBinding{CheckPTR: true}, "127.0.0.1", optionals.None[DenyReason]()},
+		{"not bound", ClientIPBinding{}, "192.0.2.1", optionals.Some(DenyDomainNotBound)},
+	} {
+		got, err := test.binding.check(
+			context.Background(),
+			net.DefaultResolver,
+			"localhost",
+			netip.MustParseAddr(test.clientIP),
+		)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		gotReason, gotDenied := got.Get()
+		wantReason, wantDenied := test.want.Get()
+		if gotDenied != wantDenied || gotReason != wantReason {
+			t.Errorf("%s: got deny reason %q (%v), want %q (%v)",
+				test.name, gotReason, gotDenied, wantReason, wantDenied)
+		}
+	}
+}
+
+func TestAuthorizeClientIPBinding(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID:          "alice",
+			AllowDomainsRaw: []string{"localhost"},
+			BindToClientIP:  &ClientIPBinding{},
+		},
+	}}, nil)
+
+	req := authedRequest("alice", "192.0.2.1", nil)
+	expectAuthorization(t, registry, req, "localhost", optionals.Some(DenyDomainNotBound))
+
+	// Cleanups aren't bound, so that records can be removed after the domain
+	// moves.
+	req.URL.Path = "/cleanup"
+	expectAuthorization(t, registry, req, "localhost", optionals.None[DenyReason]())
+}
+
+func TestClientIPBindingResolverError(t *testing.T) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("no nameservers reachable")
+		},
+	}
+	got, err := (&ClientIPBinding{}).check(
+		context.Background(),
+		resolver,
+		"www.example.com",
+		netip.MustParseAddr("192.0.2.1"),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expectDenyReason(t, got, optionals.Some(DenyError))
+}
+
+func TestIsDNSNotFound(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("boom"), false},
+		{&net.DNSError{IsNotFound: true}, true},
+		{&net.DNSError{IsTimeout: true}, false},
+		{fmt.Errorf("wrapped: %w", &net.DNSError{IsNotFound: true}), true},
+	} {
+		if got := isDNSNotFound(test.err); got != test.want {
+			t.Errorf("isDNSNotFound(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -10,11 +10,13 @@ import (
 )
 
 // Wraps the given handler function with a layer that handles the marshalling
-// and unmarshalling of request/response modies.
+// and unmarshalling of request/response modies. The handler function can set
+// response headers through respHeader.
 func WrapHandler[RequestT any, ResponseT any](
 	handler func(
 		req *http.Request,
 		requestBody RequestT,
+		respHeader http.Header,
 	) (
 		httpStatus int,
 		responseBody optionals.Optional[ResponseT],
@@ -28,6 +30,7 @@ type wrappedHandler[RequestT any, ResponseT any] struct {
 	handler func(
 		req *http.Request,
 		requestBody RequestT,
+		respHeader http.Header,
 	) (
 		httpStatus int,
 		responseBody optionals.Optional[ResponseT],
@@ -54,7 +57,7 @@ func (h wrappedHandler[RequestT, ResponseT]) ServeHTTP(
 	}
 
 	// Call the wrapped handler.
-	httpStatus, responseBodyOpt, err := h.handler(req, reqBody)
+	httpStatus, responseBodyOpt, err := h.handler(req, reqBody, w.Header())
 	if err != nil {
 		return err
 	}
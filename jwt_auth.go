@@ -0,0 +1,336 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// Configures authentication by JSON Web Tokens, such as the OIDC ID tokens that
+// CI systems issue to their jobs. Tokens are sent in an `Authorization: Bearer`
+// header.
+type JWTAuthConfig struct {
+	// A file containing the JSON Web Key Set with which tokens are verified.
+	// Exactly one of this and [JWKSURL] must be given.
+	JWKSFile string `json:"jwks_file,omitempty"`
+
+	// A URL from which to fetch the JSON Web Key Set with which tokens are
+	// verified. Exactly one of this and [JWKSFile] must be given.
+	JWKSURL string `json:"jwks_url,omitempty"`
+
+	// How often to re-fetch the key set from [JWKSURL]. The key set is also
+	// re-fetched when a token is signed by an unknown key, at most once a
+	// minute. Defaults to 1h.
+	JWKSRefresh caddy.Duration `json:"jwks_refresh,omitempty"`
+
+	// The required value of the token's `iss` claim.
+	Issuer string `json:"issuer"`
+
+	// The token's `aud` claim must contain at least one of these values.
+	Audience []string `json:"audience"`
+
+	// The claim whose value is the user ID. Defaults to `sub`.
+	UserIDClaim string `json:"user_id_claim,omitempty"`
+
+	// Templates for the domains at which the token's bearer can answer
+	// challenges, as an alternative to looking up the user's account. Optional.
+	// If given, then these domains replace the account's domain policy, and no
+	// account is needed. Placeholders of the form `{claims.<name>}` are replaced
+	// with the values of the token's claims, which must be DNS names. Otherwise,
+	// follows the same rules as [ClientPolicy.AllowDomainsRaw].
+	AllowDomains []string `json:"allow_domains,omitempty"`
+}
+
+const (
+	defaultJWKSRefresh   = time.Hour
+	minJWKSRefetchPeriod = time.Minute
+	jwksFetchTimeout     = 10 * time.Second
+
+	// The user metadata key under which the domains derived from a token's
+	// claims are recorded, separated by spaces.
+	jwtAllowDomainsMetadataKey = "jwt_allow_domains"
+)
+
+// The signature algorithms that are accepted in tokens.
+var jwtSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// Claim values that are substituted into domain templates must match this.
+var claimDomainRegexp = regexp.MustCompile(
+	`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`,
+)
+
+// Authenticates clients by JSON Web Tokens.
+type jwtAuthenticator struct {
+	config JWTAuthConfig
+
+	mu   sync.Mutex
+	keys jose.JSONWebKeySet
+
+	// When the key set was last fetched successfully.
+	fetchedAt time.Time
+
+	// When the key set was last fetched, successfully or not.
+	attemptedAt time.Time
+
+	// Ensures that concurrent requests share a single fetch.
+	fetches singleflight.Group
+
+	logger *zap.Logger
+}
+
+var _ caddyauth.Authenticator = (*jwtAuthenticator)(nil)
+
+func (c *JWTAuthConfig) provision(logger *zap.Logger) (*jwtAuthenticator, error) {
+	if (c.JWKSFile == "") == (c.JWKSURL == "") {
+		return nil, fmt.Errorf("must configure exactly one of a JWKS file or URL")
+	}
+	if c.Issuer == "" {
+		return nil, fmt.Errorf("must configure an issuer")
+	}
+	if len(c.Audience) == 0 {
+		return nil, fmt.Errorf("must configure at least one audience")
+	}
+	if c.UserIDClaim == "" {
+		c.UserIDClaim = "sub"
+	}
+	if c.JWKSRefresh <= 0 {
+		c.JWKSRefresh = caddy.Duration(defaultJWKSRefresh)
+	}
+
+	result := &jwtAuthenticator{
+		config: *c,
+		logger: logger,
+	}
+	keys, err := result.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	result.keys = keys
+	result.fetchedAt = time.Now()
+	result.attemptedAt = result.fetchedAt
+	return result, nil
+}
+
+// Loads the key set from the configured file or URL.
+func (a *jwtAuthenticator) loadKeys() (jose.JSONWebKeySet, error) {
+	var keySetJSON []byte
+	if a.config.JWKSFile != "" {
+		var err error
+		keySetJSON, err = os.ReadFile(a.config.JWKSFile)
+		if err != nil {
+			return jose.JSONWebKeySet{}, fmt.Errorf("unable to read JWKS: %w", err)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			a.config.JWKSURL,
+			nil,
+		)
+		if err != nil {
+			return jose.JSONWebKeySet{}, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return jose.JSONWebKeySet{}, fmt.Errorf("unable to fetch JWKS: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return jose.JSONWebKeySet{}, fmt.Errorf(
+				"unable to fetch JWKS: got HTTP status %d",
+				resp.StatusCode,
+			)
+		}
+		keySetJSON, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return jose.JSONWebKeySet{}, fmt.Errorf("unable to fetch JWKS: %w", err)
+		}
+	}
+
+	var keys jose.JSONWebKeySet
+	err := json.Unmarshal(keySetJSON, &keys)
+	if err != nil {
+		return jose.JSONWebKeySet{}, fmt.Errorf("unable to parse JWKS: %w", err)
+	}
+	if len(keys.Keys) == 0 {
+		return jose.JSONWebKeySet{}, fmt.Errorf("JWKS contains no keys")
+	}
+	return keys, nil
+}
+
+// Returns the current key set. If the keys come from a URL, then they are
+// re-fetched if they are stale or if forceRefresh is true, subject to a minimum
+// period between fetches. The fetch is done without holding the lock, so that
+// other requests can use the current keys in the meantime.
+func (a *jwtAuthenticator) currentKeys(forceRefresh bool) jose.JSONWebKeySet {
+	a.mu.Lock()
+	keys := a.keys
+	shouldFetch := a.shouldFetchLocked(forceRefresh, time.Now())
+	a.mu.Unlock()
+	if !shouldFetch {
+		return keys
+	}
+
+	result, _, _ := a.fetches.Do("", func() (any, error) {
+		// Check again, in case another fetch finished in the meantime.
+		a.mu.Lock()
+		if !a.shouldFetchLocked(forceRefresh, time.Now()) {
+			defer a.mu.Unlock()
+			return a.keys, nil
+		}
+		a.attemptedAt = time.Now()
+		a.mu.Unlock()
+
+		keys, err := a.loadKeys()
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err != nil {
+			a.logger.Error("unable to refresh JWKS", zap.Error(err))
+			return a.keys, nil
+		}
+		a.keys = keys
+		a.fetchedAt = time.Now()
+		return a.keys, nil
+	})
+	return result.(jose.JSONWebKeySet)
+}
+
+// Determines whether the key set should be fetched. Fetches are limited to one
+// per minJWKSRefetchPeriod, however often tokens with unknown keys arrive.
+func (a *jwtAuthenticator) shouldFetchLocked(forceRefresh bool, now time.Time) bool {
+	if a.config.JWKSURL == "" {
+		return false
+	}
+	stale := now.Sub(a.fetchedAt) > time.Duration(a.config.JWKSRefresh)
+	return (stale || forceRefresh) && now.Sub(a.attemptedAt) > minJWKSRefetchPeriod
+}
+
+func (a *jwtAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	const bearerPrefix = "Bearer "
+	authz := req.Header.Get("Authorization")
+	if len(authz) <= len(bearerPrefix) ||
+		!strings.EqualFold(authz[:len(bearerPrefix)], bearerPrefix) {
+		return caddyauth.User{}, false, nil
+	}
+
+	// Anything that doesn't parse as a JWT might be meant for another
+	// authentication provider.
+	token, err := jwt.ParseSigned(
+		strings.TrimSpace(authz[len(bearerPrefix):]),
+		jwtSignatureAlgorithms,
+	)
+	if err != nil {
+		return caddyauth.User{}, false, nil
+	}
+
+	var registeredClaims jwt.Claims
+	var allClaims map[string]any
+	err = token.Claims(a.currentKeys(false), &registeredClaims, &allClaims)
+	if errors.Is(err, jose.ErrJWKSKidNotFound) {
+		// The issuer may have rotated its keys.
+		err = token.Claims(a.currentKeys(true), &registeredClaims, &allClaims)
+	}
+	if err != nil {
+		a.logger.Debug("rejected JWT", zap.Error(err))
+		return caddyauth.User{}, false, nil
+	}
+
+	if registeredClaims.Expiry == nil {
+		a.logger.Debug("rejected JWT without expiry")
+		return caddyauth.User{}, false, nil
+	}
+	err = registeredClaims.Validate(jwt.Expected{
+		Issuer:      a.config.Issuer,
+		AnyAudience: a.config.Audience,
+		Time:        time.Now(),
+	})
+	if err != nil {
+		a.logger.Debug("rejected JWT", zap.Error(err))
+		return caddyauth.User{}, false, nil
+	}
+
+	userID, ok := allClaims[a.config.UserIDClaim].(string)
+	if !ok || userID == "" {
+		a.logger.Debug(
+			"rejected JWT without user ID claim",
+			zap.String("claim", a.config.UserIDClaim),
+		)
+		return caddyauth.User{}, false, nil
+	}
+	user := caddyauth.User{ID: userID}
+
+	// Derive the allowed domains from the claims, if configured.
+	if len(a.config.AllowDomains) > 0 {
+		domains, err := expandClaimTemplates(a.config.AllowDomains, allClaims)
+		if err != nil {
+			a.logger.Debug("rejected JWT", zap.Error(err))
+			return caddyauth.User{}, false, nil
+		}
+		user.Metadata = map[string]string{
+			jwtAllowDomainsMetadataKey: strings.Join(domains, " "),
+		}
+	}
+
+	return user, true, nil
+}
+
+// Expands `{claims.<name>}` placeholders in the given templates.
+func expandClaimTemplates(
+	templates []string,
+	claims map[string]any,
+) ([]string, error) {
+	// Check each claim value as it gets substituted, so that claims can't inject
+	// wildcards or other syntax.
+	var badValueErr error
+	repl := caddy.NewEmptyReplacer()
+	repl.Map(func(key string) (any, bool) {
+		name, isClaim := strings.CutPrefix(key, "claims.")
+		if !isClaim {
+			return nil, false
+		}
+		value, exists := claims[name].(string)
+		if exists && !claimDomainRegexp.MatchString(value) {
+			badValueErr = fmt.Errorf("value of claim %q is not a DNS name", name)
+		}
+		return value, exists
+	})
+
+	result := make([]string, 0, len(templates))
+	for _, template := range templates {
+		domain, err := repl.ReplaceOrErr(template, true, true)
+		if err != nil {
+			return nil, err
+		}
+		if badValueErr != nil {
+			return nil, badValueErr
+		}
+		result = append(result, strings.ToLower(domain))
+	}
+	return result, nil
+}
@@ -0,0 +1,279 @@
+package caddydns01proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"go.uber.org/zap"
+)
+
+const (
+	testJWTIssuer   = "https://issuer.example.com"
+	testJWTAudience = "dns01proxy"
+)
+
+// A signing key with its JWKS entry.
+type testJWK struct {
+	private *ecdsa.PrivateKey
+	public  jose.JSONWebKey
+}
+
+func newTestJWK(t *testing.T, keyID string) testJWK {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testJWK{
+		private: private,
+		public: jose.JSONWebKey{
+			Key:       &private.PublicKey,
+			KeyID:     keyID,
+			Algorithm: string(jose.ES256),
+			Use:       "sig",
+		},
+	}
+}
+
+// Issues a token with the given claims, on top of valid registered claims.
+func (k testJWK) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{
+			Algorithm: jose.ES256,
+			Key:       jose.JSONWebKey{Key: k.private, KeyID: k.public.KeyID},
+		},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := jwt.Claims{
+		Issuer:   testJWTIssuer,
+		Subject:  "alice",
+		Audience: jwt.Audience{testJWTAudience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}
+	token, err := jwt.Signed(signer).Claims(registered).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Serves a JWKS, counting the fetches.
+type testJWKSServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	keys  []jose.JSONWebKey
+	hits  atomic.Int32
+	delay time.Duration
+}
+
+func newTestJWKSServer(t *testing.T, keys ...testJWK) *testJWKSServer {
+	t.Helper()
+	result := &testJWKSServer{}
+	result.setKeys(keys...)
+	result.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			result.hits.Add(1)
+			time.Sleep(result.delay)
+			result.mu.Lock()
+			defer result.mu.Unlock()
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: result.keys})
+		},
+	))
+	t.Cleanup(result.Close)
+	return result
+}
+
+func (s *testJWKSServer) setKeys(keys ...testJWK) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = nil
+	for _, key := range keys {
+		s.keys = append(s.keys, key.public)
+	}
+}
+
+func newTestJWTAuthenticator(t *testing.T, config JWTAuthConfig) *jwtAuthenticator {
+	t.Helper()
+	config.Issuer = testJWTIssuer
+	config.Audience = []string{testJWTAudience}
+	a, err := config.provision(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestJWTAuth(t *testing.T) {
+	key := newTestJWK(t, "k1")
+	server := newTestJWKSServer(t, key)
+	a := newTestJWTAuthenticator(t, JWTAuthConfig{JWKSURL: server.URL})
+
+	user, authed, err := a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBearer(key.sign(t, nil)),
+	)
+	if err != nil || !authed || user.ID != "alice" {
+		t.Fatalf("got authed %v as %q, error %v", authed, user.ID, err)
+	}
+}
+
+func TestJWTAuthRejects(t *testing.T) {
+	key := newTestJWK(t, "k1")
+	otherKey := newTestJWK(t, "k1")
+	server := newTestJWKSServer(t, key)
+	a := newTestJWTAuthenticator(t, JWTAuthConfig{JWKSURL: server.URL})
+
+	for name, token := range map[string]string{
+		"wrong key":       otherKey.sign(t, nil),
+		"wrong issuer":    key.sign(t, map[string]any{"iss": "https://evil.example.com"}),
+		"wrong audience":  key.sign(t, map[string]any{"aud": "other"}),
+		"expired":         key.sign(t, map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"no user ID":      key.sign(t, map[string]any{"sub": ""}),
+		"not a JWT":       "opaque-token",
+		"no bearer token": "",
+	} {
+		_, authed, err := a.Authenticate(httptest.NewRecorder(), requestWithBearer(token))
+		if err != nil || authed {
+			t.Errorf("%s: got authed %v, error %v", name, authed, err)
+		}
+	}
+}
+
+func TestJWTAuthKeyRotation(t *testing.T) {
+	oldKey := newTestJWK(t, "old")
+	newKey := newTestJWK(t, "new")
+	server := newTestJWKSServer(t, oldKey)
+	a := newTestJWTAuthenticator(t, JWTAuthConfig{JWKSURL: server.URL})
+	if hits := server.hits.Load(); hits != 1 {
+		t.Fatalf("got %d fetches at provisioning, want 1", hits)
+	}
+
+	// A token signed by an unknown key causes a re-fetch, but only once the
+	// minimum period since the last fetch has passed.
+	server.setKeys(oldKey, newKey)
+	_, authed, _ := a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBearer(newKey.sign(t, nil)),
+	)
+	if authed || server.hits.Load() != 1 {
+		t.Fatalf("got authed %v after %d fetches; want a rate-limited refresh", authed, server.hits.Load())
+	}
+
+	a.mu.Lock()
+	a.attemptedAt = time.Now().Add(-2 * minJWKSRefetchPeriod)
+	a.mu.Unlock()
+	_, authed, _ = a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBearer(newKey.sign(t, nil)),
+	)
+	if !authed || server.hits.Load() != 2 {
+		t.Fatalf("got authed %v after %d fetches; want one refresh", authed, server.hits.Load())
+	}
+
+	// Tokens with unknown keys don't cause further fetches.
+	for range 5 {
+		_, _, _ = a.Authenticate(
+			httptest.NewRecorder(),
+			requestWithBearer(newTestJWK(t, "unknown").sign(t, nil)),
+		)
+	}
+	if hits := server.hits.Load(); hits != 2 {
+		t.Errorf("got %d fetches, want 2", hits)
+	}
+}
+
+func TestJWTAuthConcurrentRefresh(t *testing.T) {
+	key := newTestJWK(t, "k1")
+	server := newTestJWKSServer(t, key)
+	a := newTestJWTAuthenticator(t, JWTAuthConfig{JWKSURL: server.URL})
+	server.delay = 50 * time.Millisecond
+
+	a.mu.Lock()
+	a.attemptedAt = time.Now().Add(-2 * minJWKSRefetchPeriod)
+	a.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.currentKeys(true)
+		}()
+	}
+
+	// While the fetch is in progress, the current keys are still available.
+	done := make(chan struct{})
+	go func() {
+		a.mu.Lock()
+		_ = a.keys
+		a.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(25 * time.Millisecond):
+		t.Error("lock held during fetch")
+	}
+
+	wg.Wait()
+	if hits := server.hits.Load(); hits != 2 {
+		t.Errorf("got %d fetches, want 2", hits)
+	}
+}
+
+func TestJWTAuthFileAndAllowDomains(t *testing.T) {
+	key := newTestJWK(t, "k1")
+	keySetJSON, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(jwksFile, keySetJSON, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestJWTAuthenticator(t, JWTAuthConfig{
+		JWKSFile:     jwksFile,
+		UserIDClaim:  "repo",
+		AllowDomains: []string{"{claims.repo}.ci.example.com"},
+	})
+
+	user, authed, err := a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBearer(key.sign(t, map[string]any{"repo": "Web"})),
+	)
+	if err != nil || !authed || user.ID != "Web" {
+		t.Fatalf("got authed %v as %q, error %v", authed, user.ID, err)
+	}
+	if got := user.Metadata[jwtAllowDomainsMetadataKey]; got != "web.ci.example.com" {
+		t.Errorf("got allowed domains %q", got)
+	}
+
+	// Claim values can't inject wildcards.
+	_, authed, _ = a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBearer(key.sign(t, map[string]any{"repo": "*"})),
+	)
+	if authed {
+		t.Error("token with a wildcard claim was authenticated")
+	}
+}
@@ -0,0 +1,254 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Locks out usernames and client IP addresses after repeated password
+// authentication failures. Locked-out requests are rejected with HTTP 429
+// before any password is checked.
+type LockoutConfig struct {
+	// The number of consecutive failures after which a username or client IP
+	// address is locked out. Defaults to 5.
+	MaxFailures int `json:"max_failures,omitempty"`
+
+	// How long the first lockout lasts. Each further failure doubles the
+	// lockout, up to [MaxDuration]. Defaults to 1m.
+	Duration caddy.Duration `json:"duration,omitempty"`
+
+	// The longest that a lockout can last. Defaults to 1h.
+	MaxDuration caddy.Duration `json:"max_duration,omitempty"`
+
+	// How long after the last failure the failures are forgotten. Defaults to
+	// 24h.
+	ResetAfter caddy.Duration `json:"reset_after,omitempty"`
+}
+
+const (
+	defaultLockoutMaxFailures = 5
+	defaultLockoutDuration    = time.Minute
+	defaultLockoutMaxDuration = time.Hour
+	defaultLockoutResetAfter  = 24 * time.Hour
+
+	// When a lockoutTracker tracks more than this many keys, the keys whose
+	// failures have been forgotten are removed.
+	lockoutSweepThreshold = 10000
+)
+
+// The kinds of key that are tracked by a lockoutTracker. Used in logs.
+const (
+	lockoutKeyUsername = "username"
+	lockoutKeyClientIP = "client_ip"
+)
+
+// Holds the lockout trackers, keyed by their configuration, so that failures
+// are remembered across configuration reloads and by every listener in the
+// process.
+var lockoutPool = caddy.NewUsagePool()
+
+// Tracks password authentication failures according to a LockoutConfig. Safe
+// for concurrent use.
+type lockoutTracker struct {
+	config LockoutConfig
+
+	// The key under which this is held in lockoutPool.
+	poolKey string
+
+	mu sync.Mutex
+
+	// Keyed on the kind of key, then the key.
+	entries map[string]map[string]*lockoutEntry
+
+	logger *zap.Logger
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+var _ caddy.Destructor = (*lockoutTracker)(nil)
+
+// Returns the shared lockoutTracker for the given configuration. It must be
+// released with [lockoutTracker.release] when no longer needed.
+func loadLockoutTracker(
+	config LockoutConfig,
+	logger *zap.Logger,
+) (*lockoutTracker, error) {
+	tracker := newLockoutTracker(config, logger)
+	shared, _, err := lockoutPool.LoadOrNew(
+		tracker.poolKey,
+		func() (caddy.Destructor, error) {
+			return tracker, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return shared.(*lockoutTracker), nil
+}
+
+// Releases a reference to a tracker that was obtained from loadLockoutTracker.
+func (t *lockoutTracker) release() error {
+	_, err := lockoutPool.Delete(t.poolKey)
+	return err
+}
+
+func (t *lockoutTracker) Destruct() error {
+	return nil
+}
+
+func newLockoutTracker(
+	config LockoutConfig,
+	logger *zap.Logger,
+) *lockoutTracker {
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = defaultLockoutMaxFailures
+	}
+	if config.Duration <= 0 {
+		config.Duration = caddy.Duration(defaultLockoutDuration)
+	}
+	if config.MaxDuration <= 0 {
+		config.MaxDuration = caddy.Duration(defaultLockoutMaxDuration)
+	}
+	if config.ResetAfter <= 0 {
+		config.ResetAfter = caddy.Duration(defaultLockoutResetAfter)
+	}
+	return &lockoutTracker{
+		config: config,
+		poolKey: fmt.Sprintf(
+			"%d/%s/%s/%s",
+			config.MaxFailures,
+			time.Duration(config.Duration),
+			time.Duration(config.MaxDuration),
+			time.Duration(config.ResetAfter),
+		),
+		entries: map[string]map[string]*lockoutEntry{
+			lockoutKeyUsername: {},
+			lockoutKeyClientIP: {},
+		},
+		logger: logger,
+	}
+}
+
+// Returns the client IP address of the given request, as determined by the
+// server's trusted proxies configuration.
+func lockoutClientIP(req *http.Request) string {
+	clientIP, _ := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string)
+	return clientIP
+}
+
+// Determines whether the given username or the request's client IP address is
+// locked out. If so, returns the kind of key that is locked out and how long
+// the lockout will last.
+func (t *lockoutTracker) lockedOut(
+	req *http.Request,
+	username string,
+) (string, time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	keys := map[string]string{
+		lockoutKeyUsername: username,
+		lockoutKeyClientIP: lockoutClientIP(req),
+	}
+	for _, kind := range []string{lockoutKeyUsername, lockoutKeyClientIP} {
+		if keys[kind] == "" {
+			continue
+		}
+		entry, exists := t.entries[kind][keys[kind]]
+		if exists && now.Before(entry.lockedUntil) {
+			return kind, entry.lockedUntil.Sub(now), true
+		}
+	}
+	return "", 0, false
+}
+
+// Records a failed authentication attempt for the given username from the
+// request's client IP address.
+func (t *lockoutTracker) recordFailure(req *http.Request, username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.recordFailureLocked(lockoutKeyUsername, username, now)
+
+	// Requests over Unix sockets have no client IP address.
+	if clientIP := lockoutClientIP(req); clientIP != "" {
+		t.recordFailureLocked(lockoutKeyClientIP, clientIP, now)
+	}
+}
+
+func (t *lockoutTracker) recordFailureLocked(
+	kind string,
+	key string,
+	now time.Time,
+) {
+	entries := t.entries[kind]
+	if len(entries) > lockoutSweepThreshold {
+		t.sweepLocked(entries, now)
+	}
+
+	entry, exists := entries[key]
+	if !exists || now.Sub(entry.lastFailure) > time.Duration(t.config.ResetAfter) {
+		entry = &lockoutEntry{}
+		entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+
+	excess := entry.failures - t.config.MaxFailures
+	if excess < 0 {
+		return
+	}
+
+	// Double the lockout for each failure beyond the threshold.
+	duration := time.Duration(t.config.Duration)
+	for range excess {
+		duration *= 2
+		if duration >= time.Duration(t.config.MaxDuration) {
+			break
+		}
+	}
+	duration = min(duration, time.Duration(t.config.MaxDuration))
+	entry.lockedUntil = now.Add(duration)
+
+	t.logger.Warn(
+		"locked out after repeated authentication failures",
+		zap.String("key_type", kind),
+		zap.String(kind, key),
+		zap.Int("failures", entry.failures),
+		zap.Duration("duration", duration),
+	)
+}
+
+// Records a successful authentication for the given username. The client IP
+// address's failures are kept, so that succeeding as one user doesn't excuse
+// guessing the passwords of others.
+func (t *lockoutTracker) recordSuccess(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries[lockoutKeyUsername], username)
+}
+
+// Removes entries whose failures have been forgotten.
+func (t *lockoutTracker) sweepLocked(
+	entries map[string]*lockoutEntry,
+	now time.Time,
+) {
+	for key, entry := range entries {
+		if now.Sub(entry.lastFailure) > time.Duration(t.config.ResetAfter) &&
+			!now.Before(entry.lockedUntil) {
+			delete(entries, key)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package caddydns01proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func requestFromIP(clientIP string) *http.Request {
+	return withVars(
+		httptest.NewRequest(http.MethodPost, "/present", nil),
+		map[string]any{caddyhttp.ClientIPVarKey: clientIP},
+	)
+}
+
+func TestLockout(t *testing.T) {
+	tracker := newLockoutTracker(
+		LockoutConfig{
+			MaxFailures: 2,
+			Duration:    caddy.Duration(time.Minute),
+			MaxDuration: caddy.Duration(3 * time.Minute),
+		},
+		zap.NewNop(),
+	)
+	req := requestFromIP("192.0.2.1")
+
+	tracker.recordFailure(req, "alice")
+	if _, _, locked := tracker.lockedOut(req, "alice"); locked {
+		t.Fatal("locked out after one failure")
+	}
+
+	tracker.recordFailure(req, "alice")
+	kind, remaining, locked := tracker.lockedOut(req, "alice")
+	if !locked || kind != lockoutKeyUsername {
+		t.Fatalf("got locked %v by %q, want locked by username", locked, kind)
+	}
+	if remaining <= 0 || remaining > time.Minute {
+		t.Errorf("got remaining lockout %s, want up to 1m", remaining)
+	}
+
+	// The client IP address is locked out for other usernames too.
+	kind, _, locked = tracker.lockedOut(req, "bob")
+	if !locked || kind != lockoutKeyClientIP {
+		t.Errorf("got locked %v by %q, want locked by client IP", locked, kind)
+	}
+
+	// The username is locked out from other client IP addresses too.
+	if _, _, locked := tracker.lockedOut(requestFromIP("192.0.2.2"), "alice"); !locked {
+		t.Error("username not locked out from another client IP")
+	}
+
+	// Further failures double the lockout, up to the maximum.
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		tracker.recordFailure(req, "alice")
+		_, remaining, _ := tracker.lockedOut(requestFromIP(""), "alice")
+		if remaining <= want-time.Second || remaining > want {
+			t.Errorf("got remaining lockout %s, want %s", remaining, want)
+		}
+	}
+}
+
+func TestLockoutSuccessResetsUsername(t *testing.T) {
+	tracker := newLockoutTracker(LockoutConfig{MaxFailures: 2}, zap.NewNop())
+	req := requestFromIP("192.0.2.1")
+
+	tracker.recordFailure(req, "alice")
+	tracker.recordSuccess("alice")
+	tracker.recordFailure(req, "alice")
+	if _, _, locked := tracker.lockedOut(requestFromIP(""), "alice"); locked {
+		t.Error("username locked out despite an intervening success")
+	}
+
+	// The client IP address's failures are kept.
+	if kind, _, locked := tracker.lockedOut(req, "bob"); !locked || kind != lockoutKeyClientIP {
+		t.Errorf("got locked %v by %q, want locked by client IP", locked, kind)
+	}
+}
+
+func TestLockoutResetAfter(t *testing.T) {
+	tracker := newLockoutTracker(
+		LockoutConfig{MaxFailures: 2, ResetAfter: caddy.Duration(time.Hour)},
+		zap.NewNop(),
+	)
+	now := time.Now()
+	tracker.recordFailureLocked(lockoutKeyUsername, "alice", now.Add(-2*time.Hour))
+	tracker.recordFailureLocked(lockoutKeyUsername, "alice", now)
+	if _, _, locked := tracker.lockedOut(requestFromIP(""), "alice"); locked {
+		t.Error("old failure counted towards lockout")
+	}
+}
+
+func TestLockoutSharedAcrossReloads(t *testing.T) {
+	config := LockoutConfig{MaxFailures: 1}
+	first, err := loadLockoutTracker(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.recordFailure(requestFromIP(""), "alice")
+
+	// A reload loads the new configuration before cleaning up the old one.
+	second, err := loadLockoutTracker(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, locked := second.lockedOut(requestFromIP(""), "alice"); !locked {
+		t.Error("lockout forgotten across reload")
+	}
+
+	// A different configuration gets its own tracker.
+	other, err := loadLockoutTracker(LockoutConfig{MaxFailures: 3}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == second {
+		t.Error("different configurations share a tracker")
+	}
+
+	for _, tracker := range []*lockoutTracker{second, other} {
+		if err := tracker.release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
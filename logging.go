@@ -10,6 +10,67 @@ import (
 const (
 	// Log key for reporting why a user failed authorization.
 	logAuthorizationFailure = "deny_reason"
+
+	// Log key for reporting that a request was turned away because the DNS
+	// provider's circuit breaker is open.
+	logCircuitOpen = "circuit_open"
+
+	// Log key for reporting the number of requests that were already waiting
+	// for the concurrency limiter when a request arrived.
+	logQueueDepth = "queue_depth"
+
+	// Log key for reporting how long a request waited for the concurrency
+	// limiter.
+	logQueueWait = "queue_wait"
+
+	// Log key for reporting that a request was shed because the concurrency
+	// limiter was saturated.
+	logOverloaded = "overloaded"
+
+	// Log key for reporting that a user without an account of their own fell
+	// back to the default account.
+	logFallbackAccount = "fallback_account"
+
+	// Log key for reporting the TTL used for a presented record.
+	logTTL = "ttl"
+
+	// Log key for reporting which of a user's passwords was used for
+	// authentication.
+	logCredential = "credential"
+
+	// Log key for reporting that a request was rejected because its username or
+	// client IP address is locked out after repeated authentication failures.
+	logLockedOut = "locked_out"
+
+	// Log key for reporting the reason that the authorization webhook gave for
+	// denying a request.
+	logWebhookReason = "webhook_reason"
+
+	// Log key for reporting that the authorization webhook denied a cleanup,
+	// which went ahead anyway.
+	logWebhookDenialIgnored = "webhook_denial_ignored"
+
+	// Log key for reporting the name of the freeze window that caused a request
+	// to be denied.
+	logFreezeWindow = "freeze_window"
+
+	// Log key for reporting the ID of a request that required approval.
+	logApprovalID = "approval_id"
+
+	// Log key for reporting the user that approved or rejected a request.
+	logApprover = "approver"
+
+	// Log key for reporting the delegated account that a request to the
+	// `/delegation` endpoints is about.
+	logDelegatedUserID = "delegated_user_id"
+
+	// Log key for reporting why a user's shadow policies would have denied a
+	// request that their enforced policies allowed.
+	logShadowDenyReason = "shadow_deny_reason"
+
+	// Log key for reporting that a user's shadow policies would have allowed a
+	// request that their enforced policies denied.
+	logShadowAllowed = "shadow_allowed"
 )
 
 // Adds the given field to the access logs for the given request.
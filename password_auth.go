@@ -0,0 +1,220 @@
+package caddydns01proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// A password with which a user can authenticate by HTTP basic authentication.
+// An account can have several, so that passwords can be rotated without
+// downtime.
+type RawCredential struct {
+	// Identifies the credential in logs. Must be unique within the account.
+	Name string `json:"name"`
+
+	// The password, hashed using `caddy hash-password`.
+	Password string `json:"password"`
+
+	// When the credential becomes valid. Optional. If omitted, then the
+	// credential is valid immediately.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+
+	// When the credential stops being valid. Optional. If omitted, then the
+	// credential does not expire.
+	NotAfter *time.Time `json:"not_after,omitempty"`
+}
+
+const (
+	// The user metadata key under which the name of the password credential used
+	// for authentication is recorded.
+	credentialMetadataKey = "credential"
+
+	// The credential name given to [RawAccount.Password].
+	defaultCredentialName = "password"
+
+	// The realm reported in the `WWW-Authenticate` header.
+	basicAuthRealm = "restricted"
+)
+
+// Authenticates clients by HTTP basic authentication. Unlike Caddy's
+// `http_basic` provider, each user can have several passwords.
+type passwordAuthenticator struct {
+	hash caddyauth.BcryptHash
+
+	// Maps each user ID to the user's credentials.
+	credentials map[string][]passwordCredential
+
+	// Compared against when a user is not found, so that the response time
+	// doesn't reveal whether the user exists.
+	fakeHash []byte
+
+	// Tracks failures for brute-force protection. Optional.
+	lockout *lockoutTracker
+}
+
+var _ caddyauth.Authenticator = (*passwordAuthenticator)(nil)
+
+type passwordCredential struct {
+	name      string
+	hash      []byte
+	notBefore *time.Time
+	notAfter  *time.Time
+}
+
+// Returns whether the credential is valid at the given time.
+func (c passwordCredential) activeAt(t time.Time) bool {
+	if c.notBefore != nil && t.Before(*c.notBefore) {
+		return false
+	}
+	if c.notAfter != nil && !t.Before(*c.notAfter) {
+		return false
+	}
+	return true
+}
+
+// Returns an authenticator for the passwords in the given accounts. Returns nil
+// if there are no passwords.
+func newPasswordAuthenticator(
+	accounts []RawAccount,
+) (*passwordAuthenticator, error) {
+	result := &passwordAuthenticator{
+		credentials: map[string][]passwordCredential{},
+	}
+	result.fakeHash = result.hash.FakeHash()
+
+	repl := caddy.NewReplacer()
+	for _, account := range accounts {
+		rawCredentials := account.Credentials
+		if account.Password != nil {
+			rawCredentials = append(
+				[]RawCredential{{
+					Name:     defaultCredentialName,
+					Password: *account.Password,
+				}},
+				rawCredentials...,
+			)
+		}
+
+		names := map[string]struct{}{}
+		for _, rawCredential := range rawCredentials {
+			if rawCredential.Name == "" {
+				return nil, fmt.Errorf(
+					"credential for user ID %q has no name",
+					account.UserID,
+				)
+			}
+			if _, exists := names[rawCredential.Name]; exists {
+				return nil, fmt.Errorf(
+					"credential name is not unique for user ID %q: %q",
+					account.UserID,
+					rawCredential.Name,
+				)
+			}
+			names[rawCredential.Name] = struct{}{}
+
+			hash, err := decodePasswordHash(
+				repl.ReplaceAll(rawCredential.Password, ""),
+			)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"credential %q for user ID %q: %w",
+					rawCredential.Name,
+					account.UserID,
+					err,
+				)
+			}
+
+			result.credentials[account.UserID] = append(
+				result.credentials[account.UserID],
+				passwordCredential{
+					name:      rawCredential.Name,
+					hash:      hash,
+					notBefore: rawCredential.NotBefore,
+					notAfter:  rawCredential.NotAfter,
+				},
+			)
+		}
+	}
+
+	if len(result.credentials) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// Decodes a password hash, as given in the configuration.
+func decodePasswordHash(password string) ([]byte, error) {
+	if password == "" {
+		return nil, fmt.Errorf("password is empty")
+	}
+
+	// Like Caddy's `http_basic` provider, accept hashes in Modular Crypt Format
+	// as-is, and base64-decode anything else.
+	if strings.HasPrefix(password, "$") {
+		return []byte(password), nil
+	}
+	hash, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("unable to base64-decode password hash: %w", err)
+	}
+	return hash, nil
+}
+
+func (a *passwordAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	userID, password, ok := req.BasicAuth()
+	if !ok {
+		return a.promptForCredentials(w, nil)
+	}
+
+	now := time.Now()
+	compared := false
+	for _, credential := range a.credentials[userID] {
+		if !credential.activeAt(now) {
+			continue
+		}
+		compared = true
+		same, err := a.hash.Compare(credential.hash, []byte(password))
+		if err != nil {
+			return a.promptForCredentials(w, err)
+		}
+		if same {
+			if a.lockout != nil {
+				a.lockout.recordSuccess(userID)
+			}
+			return caddyauth.User{
+				ID: userID,
+				Metadata: map[string]string{
+					credentialMetadataKey: credential.name,
+				},
+			}, true, nil
+		}
+	}
+
+	// Spend about as long on unknown users as on known ones.
+	if !compared {
+		_, _ = a.hash.Compare(a.fakeHash, []byte(password))
+	}
+
+	if a.lockout != nil {
+		a.lockout.recordFailure(req, userID)
+	}
+
+	return a.promptForCredentials(w, nil)
+}
+
+func (a *passwordAuthenticator) promptForCredentials(
+	w http.ResponseWriter,
+	err error,
+) (caddyauth.User, bool, error) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+basicAuthRealm+`"`)
+	return caddyauth.User{}, false, err
+}
@@ -0,0 +1,106 @@
+package caddydns01proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The bcrypt hash, at the minimum cost, of "correct horse".
+const testPasswordHash = "$2a$04$pxSMbNOZY5SlxtgVqs6mseNYze79SS70xMLvbXBTpfoqLkVCFrkIm"
+
+func requestWithBasicAuth(userID, password string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/present", nil)
+	req.SetBasicAuth(userID, password)
+	return req
+}
+
+func TestPasswordAuthCredentials(t *testing.T) {
+	password := testPasswordHash
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	a, err := newPasswordAuthenticator([]RawAccount{
+		{
+			ClientPolicy: ClientPolicy{UserID: "alice"},
+			Password:     &password,
+		},
+		{
+			ClientPolicy: ClientPolicy{UserID: "bob"},
+			Credentials: []RawCredential{
+				{Name: "retired", Password: testPasswordHash, NotAfter: &past},
+				{Name: "upcoming", Password: testPasswordHash, NotBefore: &future},
+			},
+		},
+		{
+			ClientPolicy: ClientPolicy{UserID: "carol"},
+			Credentials: []RawCredential{
+				{Name: "old", Password: testPasswordHash, NotAfter: &future},
+				{Name: "new", Password: testPasswordHash, NotBefore: &past},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, authed, err := a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBasicAuth("alice", "correct horse"),
+	)
+	if err != nil || !authed || user.ID != "alice" {
+		t.Fatalf("got authed %v as %q, error %v", authed, user.ID, err)
+	}
+	if got := user.Metadata[credentialMetadataKey]; got != defaultCredentialName {
+		t.Errorf("got credential %q, want %q", got, defaultCredentialName)
+	}
+
+	// During rotation, the first active credential is reported.
+	user, authed, _ = a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBasicAuth("carol", "correct horse"),
+	)
+	if !authed || user.Metadata[credentialMetadataKey] != "old" {
+		t.Errorf("got authed %v with credential %q", authed, user.Metadata[credentialMetadataKey])
+	}
+
+	// Credentials outside their validity periods are ignored.
+	w := httptest.NewRecorder()
+	_, authed, err = a.Authenticate(w, requestWithBasicAuth("bob", "correct horse"))
+	if err != nil || authed {
+		t.Errorf("got authed %v, error %v with inactive credentials", authed, err)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("no password prompt after failure")
+	}
+
+	_, authed, _ = a.Authenticate(
+		httptest.NewRecorder(),
+		requestWithBasicAuth("alice", "wrong"),
+	)
+	if authed {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestPasswordAuthConfigErrors(t *testing.T) {
+	for name, credentials := range map[string][]RawCredential{
+		"no name":        {{Password: testPasswordHash}},
+		"duplicate name": {{Name: "a", Password: testPasswordHash}, {Name: "a", Password: testPasswordHash}},
+		"empty password": {{Name: "a"}},
+		"bad encoding":   {{Name: "a", Password: "not base64!"}},
+	} {
+		_, err := newPasswordAuthenticator([]RawAccount{{
+			ClientPolicy: ClientPolicy{UserID: "alice"},
+			Credentials:  credentials,
+		}})
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	a, err := newPasswordAuthenticator([]RawAccount{{ClientPolicy: ClientPolicy{UserID: "alice"}}})
+	if err != nil || a != nil {
+		t.Errorf("got %v, %v; want nil for no passwords", a, err)
+	}
+}
@@ -0,0 +1,112 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// The credentials of the process at the other end of a Unix socket connection,
+// as reported by the kernel.
+type peerCredentials struct {
+	uid uint32
+	gid uint32
+}
+
+// The request context key under which the connection's peer credentials are
+// stored, if the connection is over a Unix socket.
+const peerCredentialsCtxKey caddy.CtxKey = "dns01proxy.peer_credentials"
+
+// The user metadata key under which the peer's UID is recorded.
+const peerUIDMetadataKey = "peer_uid"
+
+// Records the peer credentials of Unix socket connections in the connection's
+// context. Intended for [caddyhttp.Server.RegisterConnContext].
+func peerCredentialsConnContext(ctx context.Context, c net.Conn) context.Context {
+	creds, ok := getPeerCredentials(c)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsCtxKey, creds)
+}
+
+// Authenticates clients that connect over a Unix socket by the UID or GID of
+// the connecting process.
+type peerCredAuthenticator struct {
+	// Maps UIDs and GIDs to user IDs.
+	uids map[uint32]string
+	gids map[uint32]string
+}
+
+var _ caddyauth.Authenticator = (*peerCredAuthenticator)(nil)
+
+// Returns an authenticator for the peer UIDs and GIDs in the given accounts.
+// Returns nil if no account has any.
+func newPeerCredAuthenticator(
+	accounts []RawAccount,
+) (*peerCredAuthenticator, error) {
+	result := &peerCredAuthenticator{
+		uids: map[uint32]string{},
+		gids: map[uint32]string{},
+	}
+	for _, account := range accounts {
+		for _, uid := range account.PeerUIDs {
+			if other, exists := result.uids[uid]; exists {
+				return nil, fmt.Errorf(
+					"peer UID %d is mapped to both user ID %q and user ID %q",
+					uid,
+					other,
+					account.UserID,
+				)
+			}
+			result.uids[uid] = account.UserID
+		}
+		for _, gid := range account.PeerGIDs {
+			if other, exists := result.gids[gid]; exists {
+				return nil, fmt.Errorf(
+					"peer GID %d is mapped to both user ID %q and user ID %q",
+					gid,
+					other,
+					account.UserID,
+				)
+			}
+			result.gids[gid] = account.UserID
+		}
+	}
+
+	if len(result.uids) == 0 && len(result.gids) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func (a *peerCredAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	creds, ok := req.Context().Value(peerCredentialsCtxKey).(peerCredentials)
+	if !ok {
+		return caddyauth.User{}, false, nil
+	}
+
+	// A UID mapping is more specific than a GID mapping, so it takes precedence.
+	userID, exists := a.uids[creds.uid]
+	if !exists {
+		userID, exists = a.gids[creds.gid]
+	}
+	if !exists {
+		return caddyauth.User{}, false, nil
+	}
+
+	return caddyauth.User{
+		ID: userID,
+		Metadata: map[string]string{
+			peerUIDMetadataKey: strconv.FormatUint(uint64(creds.uid), 10),
+		},
+	}, true, nil
+}
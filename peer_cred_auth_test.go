@@ -0,0 +1,85 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func requestWithPeerCredentials(uid, gid uint32) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/present", nil)
+	ctx := context.WithValue(
+		req.Context(),
+		peerCredentialsCtxKey,
+		peerCredentials{uid: uid, gid: gid},
+	)
+	return req.WithContext(ctx)
+}
+
+func TestPeerCredAuth(t *testing.T) {
+	a, err := newPeerCredAuthenticator([]RawAccount{
+		{ClientPolicy: ClientPolicy{UserID: "alice"}, PeerUIDs: []uint32{1000}},
+		{ClientPolicy: ClientPolicy{UserID: "web"}, PeerGIDs: []uint32{33}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		uid, gid   uint32
+		wantUser   string
+		wantAuthed bool
+	}{
+		{1000, 1000, "alice", true},
+		{2000, 33, "web", true},
+		// The UID mapping takes precedence over the GID mapping.
+		{1000, 33, "alice", true},
+		{2000, 2000, "", false},
+	} {
+		user, authed, err := a.Authenticate(
+			httptest.NewRecorder(),
+			requestWithPeerCredentials(test.uid, test.gid),
+		)
+		if err != nil || authed != test.wantAuthed || user.ID != test.wantUser {
+			t.Errorf(
+				"uid %d, gid %d: got authed %v as %q, error %v",
+				test.uid, test.gid, authed, user.ID, err,
+			)
+		}
+		if authed && user.Metadata[peerUIDMetadataKey] == "" {
+			t.Errorf("uid %d, gid %d: peer UID not recorded", test.uid, test.gid)
+		}
+	}
+
+	// Connections that aren't over a Unix socket have no peer credentials.
+	_, authed, err := a.Authenticate(
+		httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/present", nil),
+	)
+	if err != nil || authed {
+		t.Errorf("got authed %v, error %v without peer credentials", authed, err)
+	}
+}
+
+func TestPeerCredAuthConfigErrors(t *testing.T) {
+	for name, accounts := range map[string][]RawAccount{
+		"shared UID": {
+			{ClientPolicy: ClientPolicy{UserID: "alice"}, PeerUIDs: []uint32{1000}},
+			{ClientPolicy: ClientPolicy{UserID: "bob"}, PeerUIDs: []uint32{1000}},
+		},
+		"shared GID": {
+			{ClientPolicy: ClientPolicy{UserID: "alice"}, PeerGIDs: []uint32{100}},
+			{ClientPolicy: ClientPolicy{UserID: "bob"}, PeerGIDs: []uint32{100}},
+		},
+	} {
+		if _, err := newPeerCredAuthenticator(accounts); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	a, err := newPeerCredAuthenticator([]RawAccount{{ClientPolicy: ClientPolicy{UserID: "alice"}}})
+	if err != nil || a != nil {
+		t.Errorf("got %v, %v; want nil for no peer credentials", a, err)
+	}
+}
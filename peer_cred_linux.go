@@ -0,0 +1,34 @@
+package caddydns01proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// Returns the peer credentials of the given connection, if it is a Unix socket
+// connection.
+func getPeerCredentials(c net.Conn) (peerCredentials, bool) {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return peerCredentials{}, false
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, false
+	}
+
+	var ucred *syscall.Ucred
+	var ucredErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(
+			int(fd),
+			syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED,
+		)
+	})
+	if err != nil || ucredErr != nil {
+		return peerCredentials{}, false
+	}
+
+	return peerCredentials{uid: ucred.Uid, gid: ucred.Gid}, true
+}
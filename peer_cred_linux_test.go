@@ -0,0 +1,54 @@
+package caddydns01proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetPeerCredentials(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "test.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	creds, ok := getPeerCredentials(server)
+	if !ok {
+		t.Fatal("no peer credentials")
+	}
+	if creds.uid != uint32(os.Getuid()) || creds.gid != uint32(os.Getgid()) {
+		t.Errorf(
+			"got uid %d, gid %d; want %d, %d",
+			creds.uid, creds.gid, os.Getuid(), os.Getgid(),
+		)
+	}
+
+	// TCP connections have no peer credentials.
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	tcpClient, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpClient.Close()
+	if _, ok := getPeerCredentials(tcpClient); ok {
+		t.Error("got peer credentials for a TCP connection")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package caddydns01proxy
+
+import "net"
+
+// Peer credentials are only supported on Linux.
+func getPeerCredentials(c net.Conn) (peerCredentials, bool) {
+	return peerCredentials{}, false
+}
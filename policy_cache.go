@@ -0,0 +1,72 @@
+package caddydns01proxy
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	x509policy "github.com/smallstep/certificates/authority/policy"
+)
+
+// The maximum number of entries in a policyCache. When exceeded, the least
+// recently used entry is evicted.
+const maxPolicyCacheSize = 1024
+
+// Caches domain policy engines that are built at request time, keyed by their
+// allow and deny lists. Safe for concurrent use.
+type policyCache struct {
+	mu sync.Mutex
+
+	// Maps each key to its element in [recency].
+	engines map[string]*list.Element
+
+	// The cached entries, from most to least recently used.
+	recency list.List
+}
+
+type policyCacheEntry struct {
+	key    string
+	engine x509policy.X509Policy
+}
+
+// Returns a policy engine for the given allow and deny lists, building it if
+// needed. Returns nil if both lists are empty.
+func (c *policyCache) get(
+	allow []string,
+	deny []string,
+) (x509policy.X509Policy, error) {
+	key := strings.Join(allow, " ") + "\x00" + strings.Join(deny, " ")
+
+	c.mu.Lock()
+	elem, exists := c.engines[key]
+	if exists {
+		c.recency.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if exists {
+		return elem.Value.(*policyCacheEntry).engine, nil
+	}
+
+	engine, err := newDomainPolicy(allow, deny)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.engines == nil {
+		c.engines = map[string]*list.Element{}
+	}
+	if elem, exists := c.engines[key]; exists {
+		// Another request built the same engine concurrently.
+		c.recency.MoveToFront(elem)
+		return elem.Value.(*policyCacheEntry).engine, nil
+	}
+	c.engines[key] = c.recency.PushFront(&policyCacheEntry{key: key, engine: engine})
+	if c.recency.Len() > maxPolicyCacheSize {
+		oldest := c.recency.Back()
+		c.recency.Remove(oldest)
+		delete(c.engines, oldest.Value.(*policyCacheEntry).key)
+	}
+	return engine, nil
+}
@@ -0,0 +1,55 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPolicyCache(t *testing.T) {
+	cache := &policyCache{}
+
+	engine, err := cache.get(nil, nil)
+	if err != nil || engine != nil {
+		t.Errorf("got %v, %v; want nil for empty lists", engine, err)
+	}
+
+	first, err := cache.get([]string{"example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := cache.get([]string{"example.com"}, nil)
+	if again != first {
+		t.Error("engine not cached")
+	}
+
+	if _, err := cache.get([]string{"*.*.example.com"}, nil); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+}
+
+func TestPolicyCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := &policyCache{}
+	domain := func(i int) []string {
+		return []string{fmt.Sprintf("host%d.example.com", i)}
+	}
+
+	first, _ := cache.get(domain(0), nil)
+	second, _ := cache.get(domain(1), nil)
+	for i := 2; i < maxPolicyCacheSize; i++ {
+		cache.get(domain(i), nil)
+	}
+
+	// Using the first entry keeps it when the cache overflows.
+	cache.get(domain(0), nil)
+	cache.get(domain(maxPolicyCacheSize), nil)
+
+	if got := len(cache.engines); got != maxPolicyCacheSize {
+		t.Errorf("got %d entries, want %d", got, maxPolicyCacheSize)
+	}
+	if got, _ := cache.get(domain(0), nil); got != first {
+		t.Error("recently used entry evicted")
+	}
+	if got, _ := cache.get(domain(1), nil); got == second {
+		t.Error("least recently used entry not evicted")
+	}
+}
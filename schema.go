@@ -7,6 +7,13 @@ type RequestBody struct {
 
 	// The value of the DNS-01 response.
 	Value string `json:"value"`
+
+	// In requests, the TTL, in seconds, that the client would like for the DNS
+	// record. Optional. Only honoured if the user's policy allows it.
+	//
+	// In responses, the TTL, in seconds, that the DNS record was actually given.
+	// Omitted if the DNS provider's default TTL was used.
+	TTL *int `json:"ttl,omitempty"`
 }
 
 func (r RequestBody) IsValid() bool {
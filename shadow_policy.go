@@ -0,0 +1,164 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/liujed/goutil/optionals"
+	x509policy "github.com/smallstep/certificates/authority/policy"
+	"go.uber.org/zap"
+)
+
+// The request variable that records that the shadow policy has denied the
+// request, so that later checks don't report the same divergence again.
+const shadowDeniedVarKey = "dns01proxy.shadow_denied"
+
+// The provisioned form of an account's shadow policies, which are evaluated on
+// each request without being enforced.
+type shadowPolicy struct {
+	// Whether the account has shadow domain lists.
+	hasDomains bool
+
+	// The shadow allow and deny lists. Each falls back to the account's enforced
+	// list if the account doesn't give a shadow version.
+	allow []string
+	deny  []string
+
+	// The policy engine for the shadow lists. Nil if the lists have
+	// placeholders, or if they are combined with the account's patterns.
+	domainPolicy x509policy.X509Policy
+
+	// The shadow lists, if they have placeholders. Optional.
+	domainTemplates *domainTemplates
+
+	// The compiled version of [ClientPolicy.ShadowCEL]. Optional.
+	celPolicy *celPolicy
+}
+
+// Provisions the user's shadow policies. Must be called after the user's
+// enforced domain policy is provisioned, but before the raw lists are
+// discarded. Returns nil if the user has no shadow policies.
+func (c *ClientPolicy) provisionShadow() (*shadowPolicy, error) {
+	hasDomains := len(c.ShadowAllowDomainsRaw) > 0 || len(c.ShadowDenyDomainsRaw) > 0
+	if !hasDomains && c.ShadowCEL == "" {
+		return nil, nil
+	}
+
+	result := &shadowPolicy{hasDomains: hasDomains}
+	if hasDomains {
+		result.allow = c.ShadowAllowDomainsRaw
+		if len(result.allow) == 0 {
+			result.allow = c.AllowDomainsRaw
+		}
+		result.deny = c.ShadowDenyDomainsRaw
+		if len(result.deny) == 0 {
+			result.deny = c.DenyDomainsRaw
+		}
+
+		var err error
+		result.domainTemplates, err = newDomainTemplates(result.allow, result.deny)
+		if err != nil {
+			return nil, fmt.Errorf("unable to provision shadow domain policy: %w", err)
+		}
+		if result.domainTemplates == nil && c.domainPatterns == nil {
+			result.domainPolicy, err = newDomainPolicy(result.allow, result.deny)
+			if err != nil {
+				return nil, fmt.Errorf("unable to provision shadow domain policy: %w", err)
+			}
+		}
+	}
+
+	if c.ShadowCEL != "" {
+		var err error
+		result.celPolicy, err = newCELPolicy(c.ShadowCEL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shadow CEL policy: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// Determines whether there is a shadow CEL policy.
+func (s *shadowPolicy) hasCEL() bool {
+	return s != nil && s.celPolicy != nil
+}
+
+// Evaluates the user's shadow domain policy, if any, against the given domain,
+// and logs whether it diverges from the given enforced decision.
+func (r *ClientRegistry) checkShadowDomainPolicy(
+	req *http.Request,
+	userID string,
+	config *ClientPolicy,
+	domain string,
+	enforced optionals.Optional[DenyReason],
+) {
+	shadow := config.shadow
+	if shadow == nil || !shadow.hasDomains {
+		return
+	}
+
+	shadowOpt, err := r.checkDomainLists(
+		req,
+		userID,
+		shadow.domainPolicy,
+		shadow.domainTemplates,
+		config.domainPatterns,
+		shadow.allow,
+		shadow.deny,
+		domain,
+	)
+	if err != nil {
+		shadowOpt = optionals.Some(DenyError)
+	}
+	logShadowDivergence(req, enforced, shadowOpt)
+}
+
+// Evaluates the user's shadow CEL policy, if any, on the given input, and logs
+// whether it diverges from the given enforced decision. Skipped if the shadow
+// policies have already denied the request.
+func (h *Handler) checkShadowCELPolicy(
+	req *http.Request,
+	policy *ClientPolicy,
+	input celPolicyInput,
+	enforced optionals.Optional[DenyReason],
+) {
+	if !policy.shadow.hasCEL() {
+		return
+	}
+	if denied, _ := caddyhttp.GetVar(req.Context(), shadowDeniedVarKey).(bool); denied {
+		return
+	}
+
+	shadowOpt := optionals.None[DenyReason]()
+	allowed, err := policy.shadow.celPolicy.allows(req.Context(), input)
+	if err != nil {
+		h.logger.Debug(
+			"shadow CEL policy failed",
+			zap.String("user_id", input.userID),
+			zap.Error(err),
+		)
+	}
+	if !allowed {
+		shadowOpt = optionals.Some(DenyCELPolicy)
+	}
+	logShadowDivergence(req, enforced, shadowOpt)
+}
+
+// Adds the shadow policy's decision to the access logs if it differs from the
+// enforced decision.
+func logShadowDivergence(
+	req *http.Request,
+	enforced optionals.Optional[DenyReason],
+	shadow optionals.Optional[DenyReason],
+) {
+	if enforced.IsSome() == shadow.IsSome() {
+		return
+	}
+	if denyReason, denied := shadow.Get(); denied {
+		addLogField(req, zap.String(logShadowDenyReason, string(denyReason)))
+		caddyhttp.SetVar(req.Context(), shadowDeniedVarKey, true)
+		return
+	}
+	addLogField(req, zap.Bool(logShadowAllowed, true))
+}
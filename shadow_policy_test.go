@@ -0,0 +1,166 @@
+package caddydns01proxy
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/liujed/goutil/optionals"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Returns the fields that have been added to the access logs for the given
+// request. String fields map to their values, and bool fields to "true" or
+// "false".
+func loggedFields(req *http.Request) map[string]string {
+	extra := req.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	fields := reflect.ValueOf(extra).Elem().FieldByName("fields")
+	result := map[string]string{}
+	for i := range fields.Len() {
+		field := fields.Index(i)
+		key := field.FieldByName("Key").String()
+		switch zapcore.FieldType(field.FieldByName("Type").Uint()) {
+		case zapcore.StringType:
+			result[key] = field.FieldByName("String").String()
+		case zapcore.BoolType:
+			result[key] = "false"
+			if field.FieldByName("Integer").Int() == 1 {
+				result[key] = "true"
+			}
+		}
+	}
+	return result
+}
+
+func TestShadowDomainPolicy(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{
+		{
+			// Trying out a narrower policy.
+			ClientPolicy: ClientPolicy{
+				UserID:                "alice",
+				AllowDomainsRaw:       []string{"*.example.com"},
+				ShadowAllowDomainsRaw: []string{"www.example.com"},
+			},
+		},
+		{
+			// Trying out a broader policy.
+			ClientPolicy: ClientPolicy{
+				UserID:               "bob",
+				AllowDomainsRaw:      []string{"*.example.com"},
+				DenyDomainsRaw:       []string{"admin.example.com"},
+				ShadowDenyDomainsRaw: []string{"root.example.com"},
+			},
+		},
+	}, nil)
+
+	for _, test := range []struct {
+		userID     string
+		domain     string
+		enforced   optionals.Optional[DenyReason]
+		wantFields map[string]string
+	}{
+		{"alice", "www.example.com", optionals.None[DenyReason](), map[string]string{}},
+		{
+			"alice",
+			"api.example.com",
+			optionals.None[DenyReason](),
+			map[string]string{logShadowDenyReason: string(DenyDomainNotAllowed)},
+		},
+		{"bob", "www.example.com", optionals.None[DenyReason](), map[string]string{}},
+		{
+			"bob",
+			"admin.example.com",
+			optionals.Some(DenyDomainNotAllowed),
+			map[string]string{logShadowAllowed: "true"},
+		},
+		{
+			"bob",
+			"root.example.com",
+			optionals.None[DenyReason](),
+			map[string]string{logShadowDenyReason: string(DenyDomainNotAllowed)},
+		},
+	} {
+		req := authedRequest(test.userID, "192.0.2.1", nil)
+		expectAuthorization(t, registry, req, test.domain, test.enforced)
+
+		got := loggedFields(req)
+		for _, key := range []string{logShadowDenyReason, logShadowAllowed} {
+			if got[key] != test.wantFields[key] {
+				t.Errorf("%s, %s: got %s %q, want %q",
+					test.userID, test.domain, key, got[key], test.wantFields[key])
+			}
+		}
+	}
+}
+
+func TestProvisionShadow(t *testing.T) {
+	none, err := (&ClientPolicy{AllowDomainsRaw: []string{"example.com"}}).provisionShadow()
+	if err != nil || none != nil {
+		t.Errorf("got %v, %v; want nil without shadow policies", none, err)
+	}
+
+	// A missing shadow list falls back to the enforced one.
+	shadow, err := (&ClientPolicy{
+		AllowDomainsRaw:      []string{"*.example.com"},
+		DenyDomainsRaw:       []string{"admin.example.com"},
+		ShadowDenyDomainsRaw: []string{"root.example.com"},
+	}).provisionShadow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(shadow.allow, []string{"*.example.com"}) ||
+		!slices.Equal(shadow.deny, []string{"root.example.com"}) {
+		t.Errorf("got shadow allow %q, deny %q", shadow.allow, shadow.deny)
+	}
+	if shadow.hasCEL() {
+		t.Error("got a shadow CEL policy without one configured")
+	}
+
+	for name, policy := range map[string]ClientPolicy{
+		"bad domain": {ShadowAllowDomainsRaw: []string{"*.*.example.com"}},
+		"bad CEL":    {ShadowCEL: `domain ==`},
+	} {
+		if _, err := policy.provisionShadow(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestShadowCELPolicy(t *testing.T) {
+	h := &Handler{logger: zap.NewNop()}
+	policy := &ClientPolicy{UserID: "alice", ShadowCEL: `domain.startsWith("www.")`}
+	var err error
+	policy.shadow, err = policy.provisionShadow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		domain   string
+		enforced optionals.Optional[DenyReason]
+		key      string
+		want     string
+	}{
+		{"www.example.com", optionals.None[DenyReason](), logShadowDenyReason, ""},
+		{"api.example.com", optionals.None[DenyReason](), logShadowDenyReason, string(DenyCELPolicy)},
+		{"www.example.com", optionals.Some(DenyCELPolicy), logShadowAllowed, "true"},
+	} {
+		req := authedRequest("alice", "192.0.2.1", nil)
+		h.checkShadowCELPolicy(req, policy, celPolicyInput{domain: test.domain}, test.enforced)
+		if got := loggedFields(req)[test.key]; got != test.want {
+			t.Errorf("%s: got %s %q, want %q", test.domain, test.key, got, test.want)
+		}
+	}
+
+	// A divergence that the shadow domain policy already reported isn't
+	// reported again.
+	req := authedRequest("alice", "192.0.2.1", nil)
+	caddyhttp.SetVar(req.Context(), shadowDeniedVarKey, true)
+	h.checkShadowCELPolicy(req, policy, celPolicyInput{domain: "api.example.com"}, optionals.None[DenyReason]())
+	if len(loggedFields(req)) != 0 {
+		t.Errorf("got log fields %v after an earlier shadow denial", loggedFields(req))
+	}
+}
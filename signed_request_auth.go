@@ -0,0 +1,219 @@
+package caddydns01proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/liujed/caddy-dns01proxy/signing"
+	"go.uber.org/zap"
+)
+
+const (
+	// The default for [Handler.SignatureMaxSkew].
+	defaultSignatureMaxSkew = 5 * time.Minute
+
+	// The largest request body that is read for verifying a signature.
+	maxSignedBodySize = 64 << 10
+)
+
+// Authenticates clients by HMAC request signatures. See the signing package.
+type signedRequestAuthenticator struct {
+	// Maps each user ID to the user's signing secret.
+	secrets map[string][]byte
+
+	// How far a signature's timestamp can be from the current time.
+	maxSkew time.Duration
+
+	// Nonces that have been seen recently. Shared by all handlers in the process.
+	nonces *nonceCache
+
+	logger *zap.Logger
+}
+
+var _ caddyauth.Authenticator = (*signedRequestAuthenticator)(nil)
+
+// Returns an authenticator for the signing secrets in the given accounts.
+// Returns nil if there are no signing secrets.
+func newSignedRequestAuthenticator(
+	accounts []RawAccount,
+	maxSkew time.Duration,
+	logger *zap.Logger,
+) (*signedRequestAuthenticator, error) {
+	repl := caddy.NewReplacer()
+	secrets := map[string][]byte{}
+	for _, account := range accounts {
+		if account.SigningSecret == nil {
+			continue
+		}
+
+		secret, err := repl.ReplaceOrErr(*account.SigningSecret, true, true)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"unable to resolve signing secret for user ID %q: %w",
+				account.UserID,
+				err,
+			)
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("empty signing secret for user ID %q", account.UserID)
+		}
+		secrets[account.UserID] = []byte(secret)
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	if maxSkew <= 0 {
+		maxSkew = defaultSignatureMaxSkew
+	}
+	nonces, _, err := nonceCachePool.LoadOrNew(
+		nonceCachePoolKey,
+		func() (caddy.Destructor, error) {
+			return &nonceCache{}, nil
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load nonce cache: %w", err)
+	}
+	return &signedRequestAuthenticator{
+		secrets: secrets,
+		maxSkew: maxSkew,
+		nonces:  nonces.(*nonceCache),
+		logger:  logger,
+	}, nil
+}
+
+// Releases this authenticator's reference to the shared nonce cache.
+func (a *signedRequestAuthenticator) Cleanup() error {
+	_, err := nonceCachePool.Delete(nonceCachePoolKey)
+	return err
+}
+
+func (a *signedRequestAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	headerValue := req.Header.Get(signing.Header)
+	if headerValue == "" {
+		return caddyauth.User{}, false, nil
+	}
+
+	sig, err := signing.ParseSignature(headerValue)
+	if err != nil {
+		a.logger.Debug("rejected request signature", zap.Error(err))
+		return caddyauth.User{}, false, nil
+	}
+
+	secret, exists := a.secrets[sig.KeyID]
+	if !exists {
+		return caddyauth.User{}, false, nil
+	}
+
+	now := time.Now()
+	skew := now.Sub(sig.Timestamp)
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		a.logger.Debug(
+			"rejected request signature outside clock-skew window",
+			zap.String("user_id", sig.KeyID),
+			zap.Duration("skew", skew),
+		)
+		return caddyauth.User{}, false, nil
+	}
+
+	// Read the body, leaving it in place for the request handler.
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBodySize+1))
+	if err != nil {
+		return caddyauth.User{}, false,
+			fmt.Errorf("unable to read request body: %w", err)
+	}
+	if len(body) > maxSignedBodySize {
+		// Put back what was read, so that the body isn't truncated for anyone
+		// else.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return caddyauth.User{}, false, fmt.Errorf(
+			"signed request body is larger than %d bytes",
+			maxSignedBodySize,
+		)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Verify against the path that the client sent, in case the request has
+	// since been rewritten.
+	path := req.URL.EscapedPath()
+	if origReq, ok := req.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		path = origReq.URL.EscapedPath()
+	}
+	if !sig.Verify(secret, req.Method, path, body) {
+		return caddyauth.User{}, false, nil
+	}
+
+	// Only now that the signature is known to be genuine, check for replays.
+	// A nonce needs to be remembered for as long as its timestamp is acceptable.
+	if !a.nonces.add(sig.KeyID+"\x00"+sig.Nonce, now, 2*a.maxSkew) {
+		a.logger.Warn(
+			"rejected replayed request signature",
+			zap.String("user_id", sig.KeyID),
+		)
+		return caddyauth.User{}, false, nil
+	}
+
+	return caddyauth.User{ID: sig.KeyID}, true, nil
+}
+
+// Holds the nonce cache, so that nonces are remembered across configuration
+// reloads and by every listener in the process.
+var nonceCachePool = caddy.NewUsagePool()
+
+const nonceCachePoolKey = "signed_request_nonces"
+
+// Remembers nonces for as long as they could be replayed. Safe for concurrent
+// use.
+type nonceCache struct {
+	mu sync.Mutex
+
+	// Maps each nonce to the time at which it can be forgotten.
+	expiries  map[string]time.Time
+	lastSweep time.Time
+}
+
+var _ caddy.Destructor = (*nonceCache)(nil)
+
+func (c *nonceCache) Destruct() error {
+	return nil
+}
+
+// Records the given nonce, to be remembered for the given retention period.
+// Returns false if the nonce has already been seen.
+func (c *nonceCache) add(nonce string, now time.Time, retention time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Forget expired nonces every so often.
+	if now.Sub(c.lastSweep) > retention {
+		for n, expiry := range c.expiries {
+			if now.After(expiry) {
+				delete(c.expiries, n)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if expiry, exists := c.expiries[nonce]; exists && !now.After(expiry) {
+		return false
+	}
+	if c.expiries == nil {
+		c.expiries = map[string]time.Time{}
+	}
+	c.expiries[nonce] = now.Add(retention)
+	return true
+}
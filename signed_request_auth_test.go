@@ -0,0 +1,137 @@
+package caddydns01proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liujed/caddy-dns01proxy/signing"
+	"go.uber.org/zap"
+)
+
+func newTestSignedRequestAuthenticator(t *testing.T) *signedRequestAuthenticator {
+	t.Helper()
+	secret := "alice-secret"
+	a, err := newSignedRequestAuthenticator(
+		[]RawAccount{{
+			ClientPolicy:  ClientPolicy{UserID: "alice"},
+			SigningSecret: &secret,
+		}},
+		time.Minute,
+		zap.NewNop(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = a.Cleanup() })
+	return a
+}
+
+func signedRequest(t *testing.T, keyID string, secret string, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(body))
+	err := signing.Sign(req, keyID, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestSignedRequestAuth(t *testing.T) {
+	a := newTestSignedRequestAuthenticator(t)
+
+	body := `{"fqdn": "_acme-challenge.example.com.", "value": "x"}`
+	req := signedRequest(t, "alice", "alice-secret", body)
+	user, authed, err := a.Authenticate(httptest.NewRecorder(), req)
+	if err != nil || !authed || user.ID != "alice" {
+		t.Fatalf("got authed %v as %q, error %v", authed, user.ID, err)
+	}
+
+	// The body is left in place for the handler.
+	remaining, _ := io.ReadAll(req.Body)
+	if string(remaining) != body {
+		t.Errorf("got body %q, want %q", remaining, body)
+	}
+}
+
+func TestSignedRequestAuthRejects(t *testing.T) {
+	a := newTestSignedRequestAuthenticator(t)
+
+	tampered := signedRequest(t, "alice", "alice-secret", `{"value": "a"}`)
+	tampered.Body = io.NopCloser(strings.NewReader(`{"value": "b"}`))
+
+	stale := signedRequest(t, "alice", "alice-secret", "")
+	sig, err := signing.ParseSignature(stale.Header.Get(signing.Header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Timestamp = sig.Timestamp.Add(-time.Hour)
+	stale.Header.Set(signing.Header, sig.String())
+
+	for name, req := range map[string]*http.Request{
+		"wrong secret": signedRequest(t, "alice", "wrong", ""),
+		"unknown key":  signedRequest(t, "bob", "alice-secret", ""),
+		"tampered":     tampered,
+		"stale":        stale,
+		"unsigned":     httptest.NewRequest(http.MethodPost, "/present", nil),
+	} {
+		_, authed, err := a.Authenticate(httptest.NewRecorder(), req)
+		if err != nil || authed {
+			t.Errorf("%s: got authed %v, error %v", name, authed, err)
+		}
+	}
+}
+
+func TestSignedRequestAuthReplay(t *testing.T) {
+	// Two authenticators, as for two listeners or two configurations.
+	a := newTestSignedRequestAuthenticator(t)
+	b := newTestSignedRequestAuthenticator(t)
+
+	req := signedRequest(t, "alice", "alice-secret", "")
+	replay := req.Clone(req.Context())
+	replay.Body = http.NoBody
+
+	_, authed, _ := a.Authenticate(httptest.NewRecorder(), req)
+	if !authed {
+		t.Fatal("original request was not authenticated")
+	}
+	_, authed, _ = b.Authenticate(httptest.NewRecorder(), replay)
+	if authed {
+		t.Error("replayed request was authenticated")
+	}
+}
+
+func TestSignedRequestAuthOversizedBody(t *testing.T) {
+	a := newTestSignedRequestAuthenticator(t)
+
+	body := bytes.Repeat([]byte("x"), maxSignedBodySize+100)
+	req := signedRequest(t, "alice", "alice-secret", string(body))
+	_, authed, err := a.Authenticate(httptest.NewRecorder(), req)
+	if authed || err == nil {
+		t.Fatalf("got authed %v, error %v; want an error", authed, err)
+	}
+
+	// The body is left intact.
+	remaining, _ := io.ReadAll(req.Body)
+	if !bytes.Equal(remaining, body) {
+		t.Errorf("got %d bytes of body, want %d", len(remaining), len(body))
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := &nonceCache{}
+	now := time.Now()
+	if !c.add("n", now, time.Minute) {
+		t.Fatal("new nonce rejected")
+	}
+	if c.add("n", now.Add(30*time.Second), time.Minute) {
+		t.Error("repeated nonce accepted")
+	}
+	if !c.add("n", now.Add(2*time.Minute), time.Minute) {
+		t.Error("expired nonce rejected")
+	}
+}
@@ -0,0 +1,157 @@
+// Implements dns01proxy's HMAC request-signing scheme.
+//
+// A signed request carries a [Header] whose value holds the signer's key ID
+// (the dns01proxy user ID), a Unix timestamp, a random nonce, and an
+// HMAC-SHA256 over the request method, path, body digest, timestamp, and
+// nonce, keyed with the user's shared secret. The server rejects signatures
+// whose timestamps are too far from its own clock, and nonces that it has
+// already seen.
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The HTTP header that carries the signature.
+const Header = "X-Dns01proxy-Signature"
+
+// A parsed request signature.
+type Signature struct {
+	// Identifies the secret with which the request was signed.
+	KeyID string
+
+	// When the request was signed.
+	Timestamp time.Time
+
+	// A random value that is unique to the request.
+	Nonce string
+
+	// The HMAC-SHA256 of the request.
+	MAC []byte
+}
+
+// Signs the given request with the given key ID and secret, by setting its
+// signature header. The request body is read and replaced, so that it can
+// still be sent.
+func Sign(req *http.Request, keyID string, secret []byte) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	nonceBytes := make([]byte, 16)
+	_, err = rand.Read(nonceBytes)
+	if err != nil {
+		return fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	sig := Signature{
+		KeyID:     keyID,
+		Timestamp: time.Now(),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonceBytes),
+	}
+	sig.MAC = sig.computeMAC(secret, req.Method, req.URL.EscapedPath(), body)
+
+	req.Header.Set(Header, sig.String())
+	return nil
+}
+
+// Parses the value of a signature header.
+func ParseSignature(headerValue string) (Signature, error) {
+	values, err := url.ParseQuery(headerValue)
+	if err != nil {
+		return Signature{}, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	keyID := values.Get("key")
+	timestampRaw := values.Get("ts")
+	nonce := values.Get("nonce")
+	macRaw := values.Get("sig")
+	if keyID == "" || timestampRaw == "" || nonce == "" || macRaw == "" {
+		return Signature{}, fmt.Errorf("incomplete signature")
+	}
+
+	timestamp, err := strconv.ParseInt(timestampRaw, 10, 64)
+	if err != nil {
+		return Signature{}, fmt.Errorf("malformed signature timestamp: %w", err)
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macRaw)
+	if err != nil {
+		return Signature{}, fmt.Errorf("malformed signature MAC: %w", err)
+	}
+
+	return Signature{
+		KeyID:     keyID,
+		Timestamp: time.Unix(timestamp, 0),
+		Nonce:     nonce,
+		MAC:       mac,
+	}, nil
+}
+
+// Returns the value of the signature header for this signature.
+func (s Signature) String() string {
+	values := url.Values{}
+	values.Set("key", s.KeyID)
+	values.Set("ts", strconv.FormatInt(s.Timestamp.Unix(), 10))
+	values.Set("nonce", s.Nonce)
+	values.Set("sig", base64.RawURLEncoding.EncodeToString(s.MAC))
+	return values.Encode()
+}
+
+// Determines whether this signature's MAC is valid for a request with the
+// given method, path, and body. Does not check the timestamp or nonce.
+func (s Signature) Verify(
+	secret []byte,
+	method string,
+	path string,
+	body []byte,
+) bool {
+	return hmac.Equal(s.MAC, s.computeMAC(secret, method, path, body))
+}
+
+func (s Signature) computeMAC(
+	secret []byte,
+	method string,
+	path string,
+	body []byte,
+) []byte {
+	bodyDigest := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(
+		mac,
+		"%s\n%s\n%s\n%d\n%s",
+		method,
+		path,
+		hex.EncodeToString(bodyDigest[:]),
+		s.Timestamp.Unix(),
+		s.Nonce,
+	)
+	return mac.Sum(nil)
+}
+
+// Reads the request body, replacing it so that it can be read again.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read request body: %w", err)
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
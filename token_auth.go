@@ -0,0 +1,136 @@
+package caddydns01proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// An API token with which a user can authenticate, by sending it in an
+// `Authorization: Bearer <token>` header.
+type RawToken struct {
+	// Identifies the token in logs. Must be unique within the account.
+	Name string `json:"name"`
+
+	// The token's SHA-256 hash, hex-encoded. For example, the output of
+	// `printf %s "$TOKEN" | sha256sum`.
+	SHA256 string `json:"sha256"`
+
+	// When the token expires. Optional. If omitted, then the token does not
+	// expire.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Restricts the token to a subset of the user's allowed domains. Optional.
+	// Follows the same rules as [ClientPolicy.AllowDomainsRaw].
+	Scope []string `json:"scope,omitempty"`
+}
+
+// The user metadata key under which the name of the token used for
+// authentication is recorded.
+const tokenMetadataKey = "token"
+
+// Authenticates clients by API tokens.
+type tokenAuthenticator struct {
+	// Maps each token's SHA-256 hash to the token.
+	tokens map[[sha256.Size]byte]tokenEntry
+}
+
+var _ caddyauth.Authenticator = (*tokenAuthenticator)(nil)
+
+type tokenEntry struct {
+	userID string
+	name   string
+
+	// Optional.
+	expires *time.Time
+}
+
+// Returns an authenticator for the API tokens in the given accounts. Returns
+// nil if there are no API tokens.
+func newTokenAuthenticator(accounts []RawAccount) (*tokenAuthenticator, error) {
+	result := &tokenAuthenticator{
+		tokens: map[[sha256.Size]byte]tokenEntry{},
+	}
+	for _, account := range accounts {
+		names := map[string]struct{}{}
+		for _, token := range account.Tokens {
+			if token.Name == "" {
+				return nil, fmt.Errorf(
+					"API token for user ID %q has no name",
+					account.UserID,
+				)
+			}
+			if _, exists := names[token.Name]; exists {
+				return nil, fmt.Errorf(
+					"API token name is not unique for user ID %q: %q",
+					account.UserID,
+					token.Name,
+				)
+			}
+			names[token.Name] = struct{}{}
+
+			hashBytes, err := hex.DecodeString(token.SHA256)
+			if err != nil || len(hashBytes) != sha256.Size {
+				return nil, fmt.Errorf(
+					"API token %q for user ID %q does not have a valid SHA-256 hash",
+					token.Name,
+					account.UserID,
+				)
+			}
+			hash := [sha256.Size]byte(hashBytes)
+			if _, exists := result.tokens[hash]; exists {
+				return nil, fmt.Errorf(
+					"API token %q for user ID %q is not unique",
+					token.Name,
+					account.UserID,
+				)
+			}
+
+			result.tokens[hash] = tokenEntry{
+				userID:  account.UserID,
+				name:    token.Name,
+				expires: token.Expires,
+			}
+		}
+	}
+
+	if len(result.tokens) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(
+	w http.ResponseWriter,
+	req *http.Request,
+) (caddyauth.User, bool, error) {
+	const bearerPrefix = "Bearer "
+	authz := req.Header.Get("Authorization")
+	if len(authz) <= len(bearerPrefix) ||
+		!strings.EqualFold(authz[:len(bearerPrefix)], bearerPrefix) {
+		return caddyauth.User{}, false, nil
+	}
+
+	// Tokens are looked up by hash, so the lookup leaks no timing information
+	// about the tokens themselves.
+	hash := sha256.Sum256([]byte(strings.TrimSpace(authz[len(bearerPrefix):])))
+	token, exists := a.tokens[hash]
+	if !exists {
+		return caddyauth.User{}, false, nil
+	}
+	if token.expires != nil && time.Now().After(*token.expires) {
+		return caddyauth.User{}, false, nil
+	}
+
+	return caddyauth.User{
+		ID: token.userID,
+		Metadata: map[string]string{
+			tokenMetadataKey: token.name,
+		},
+	}, true, nil
+}
@@ -0,0 +1,106 @@
+package caddydns01proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func requestWithBearer(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/present", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestTokenAuth(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	a, err := newTokenAuthenticator([]RawAccount{
+		{
+			ClientPolicy: ClientPolicy{UserID: "alice"},
+			Tokens: []RawToken{
+				{Name: "ci", SHA256: tokenHash("alice-ci")},
+				{Name: "old", SHA256: tokenHash("alice-old"), Expires: &expired},
+			},
+		},
+		{
+			ClientPolicy: ClientPolicy{UserID: "bob"},
+			Tokens:       []RawToken{{Name: "ci", SHA256: tokenHash("bob-ci")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, authed, err := a.Authenticate(httptest.NewRecorder(), requestWithBearer("alice-ci"))
+	if err != nil || !authed {
+		t.Fatalf("got authed %v, error %v", authed, err)
+	}
+	if user.ID != "alice" || user.Metadata[tokenMetadataKey] != "ci" {
+		t.Errorf("got user %q with token %q", user.ID, user.Metadata[tokenMetadataKey])
+	}
+
+	user, authed, _ = a.Authenticate(httptest.NewRecorder(), requestWithBearer("bob-ci"))
+	if !authed || user.ID != "bob" {
+		t.Errorf("got authed %v as %q, want bob", authed, user.ID)
+	}
+
+	for name, token := range map[string]string{
+		"expired": "alice-old",
+		"unknown": "mallory",
+		"missing": "",
+	} {
+		_, authed, err := a.Authenticate(httptest.NewRecorder(), requestWithBearer(token))
+		if err != nil || authed {
+			t.Errorf("%s: got authed %v, error %v", name, authed, err)
+		}
+	}
+}
+
+func TestTokenAuthConfigErrors(t *testing.T) {
+	for name, accounts := range map[string][]RawAccount{
+		"no name": {{
+			ClientPolicy: ClientPolicy{UserID: "alice"},
+			Tokens:       []RawToken{{SHA256: tokenHash("a")}},
+		}},
+		"duplicate name": {{
+			ClientPolicy: ClientPolicy{UserID: "alice"},
+			Tokens: []RawToken{
+				{Name: "ci", SHA256: tokenHash("a")},
+				{Name: "ci", SHA256: tokenHash("b")},
+			},
+		}},
+		"bad hash": {{
+			ClientPolicy: ClientPolicy{UserID: "alice"},
+			Tokens:       []RawToken{{Name: "ci", SHA256: "abc"}},
+		}},
+		"shared token": {
+			{
+				ClientPolicy: ClientPolicy{UserID: "alice"},
+				Tokens:       []RawToken{{Name: "ci", SHA256: tokenHash("a")}},
+			},
+			{
+				ClientPolicy: ClientPolicy{UserID: "bob"},
+				Tokens:       []RawToken{{Name: "ci", SHA256: tokenHash("a")}},
+			},
+		},
+	} {
+		if _, err := newTokenAuthenticator(accounts); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	a, err := newTokenAuthenticator([]RawAccount{{ClientPolicy: ClientPolicy{UserID: "alice"}}})
+	if err != nil || a != nil {
+		t.Errorf("got %v, %v; want nil for no tokens", a, err)
+	}
+}
@@ -0,0 +1,114 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Configuration that applies to a single DNS zone.
+type ZoneConfig struct {
+	// The TTL to use in DNS TXT records in this zone. Optional. Overrides the
+	// global TTL.
+	TTL *caddy.Duration `json:"ttl,omitempty"`
+
+	// The minimum and maximum TTLs that the DNS provider accepts in this zone.
+	// Optional. TTLs outside this range are clamped to fit.
+	MinTTL *caddy.Duration `json:"min_ttl,omitempty"`
+	MaxTTL *caddy.Duration `json:"max_ttl,omitempty"`
+}
+
+func (z *ZoneConfig) validate() error {
+	return validateTTLRange(z.MinTTL, z.MaxTTL)
+}
+
+// Checks that the given optional bounds form a valid TTL range.
+func validateTTLRange(minTTL, maxTTL *caddy.Duration) error {
+	if minTTL != nil && *minTTL < 0 {
+		return fmt.Errorf("minimum TTL must not be negative")
+	}
+	if maxTTL != nil && *maxTTL <= 0 {
+		return fmt.Errorf("maximum TTL must be positive")
+	}
+	if minTTL != nil && maxTTL != nil && *minTTL > *maxTTL {
+		return fmt.Errorf("minimum TTL must not exceed maximum TTL")
+	}
+	return nil
+}
+
+// The largest number of seconds that fits in a time.Duration.
+const maxTTLSeconds = int(math.MaxInt64 / int64(time.Second))
+
+// Normalizes a zone name for use as a key in [DNSConfig.Zones].
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(zone, "."))
+}
+
+// Determines the TTL for a challenge record that the given user presents in the
+// given zone. Zero means that the DNS provider's default is used.
+//
+// In order of increasing precedence, the TTL comes from the global TTL, the
+// zone's TTL, the user's TTL, and the TTL requested by the client. The
+// requested TTL is only honoured if the user has a TTL range configured, and is
+// clamped to fit that range. Finally, the result is clamped to fit the zone's
+// TTL range.
+func (d *DNSConfig) recordTTL(
+	policy *ClientPolicy,
+	zone string,
+	requestedSeconds *int,
+) time.Duration {
+	ttl := time.Duration(0)
+	if d.TTL != nil {
+		ttl = time.Duration(*d.TTL)
+	}
+
+	zoneConfig := d.Zones[normalizeZone(zone)]
+	if zoneConfig != nil && zoneConfig.TTL != nil {
+		ttl = time.Duration(*zoneConfig.TTL)
+	}
+
+	if policy.TTL != nil {
+		ttl = time.Duration(*policy.TTL)
+	}
+
+	if requestedSeconds != nil && *requestedSeconds > 0 &&
+		(policy.MinTTL != nil || policy.MaxTTL != nil) {
+		// Clamp before converting, so that huge requests don't overflow.
+		seconds := min(*requestedSeconds, maxTTLSeconds)
+		ttl = clampTTL(
+			time.Duration(seconds)*time.Second,
+			policy.MinTTL,
+			policy.MaxTTL,
+		)
+	}
+
+	if ttl > 0 && zoneConfig != nil {
+		ttl = clampTTL(ttl, zoneConfig.MinTTL, zoneConfig.MaxTTL)
+	}
+
+	return ttl
+}
+
+// Clamps ttl to fit within the given optional bounds.
+func clampTTL(ttl time.Duration, minTTL, maxTTL *caddy.Duration) time.Duration {
+	if minTTL != nil {
+		ttl = max(ttl, time.Duration(*minTTL))
+	}
+	if maxTTL != nil {
+		ttl = min(ttl, time.Duration(*maxTTL))
+	}
+	return ttl
+}
+
+// Converts the given record TTL to whole seconds, for reporting back to the
+// client. Returns nil if the DNS provider's default TTL is used.
+func ttlSeconds(ttl time.Duration) *int {
+	if ttl <= 0 {
+		return nil
+	}
+	seconds := int(ttl / time.Second)
+	return &seconds
+}
@@ -0,0 +1,90 @@
+package caddydns01proxy
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func durationPtr(d time.Duration) *caddy.Duration {
+	result := caddy.Duration(d)
+	return &result
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestRecordTTLPrecedence(t *testing.T) {
+	d := &DNSConfig{
+		TTL: durationPtr(time.Minute),
+		Zones: map[string]*ZoneConfig{
+			"example.com": {TTL: durationPtr(2 * time.Minute)},
+		},
+	}
+
+	if ttl := d.recordTTL(&ClientPolicy{}, "other.com.", nil); ttl != time.Minute {
+		t.Errorf("got %s for global TTL, want 1m", ttl)
+	}
+	if ttl := d.recordTTL(&ClientPolicy{}, "Example.com.", nil); ttl != 2*time.Minute {
+		t.Errorf("got %s for zone TTL, want 2m", ttl)
+	}
+
+	policy := &ClientPolicy{TTL: durationPtr(3 * time.Minute)}
+	if ttl := d.recordTTL(policy, "example.com.", nil); ttl != 3*time.Minute {
+		t.Errorf("got %s for user TTL, want 3m", ttl)
+	}
+
+	// Without a range, the requested TTL is ignored.
+	if ttl := d.recordTTL(policy, "example.com.", intPtr(600)); ttl != 3*time.Minute {
+		t.Errorf("got %s for unranged request, want 3m", ttl)
+	}
+}
+
+func TestRecordTTLClampsRequested(t *testing.T) {
+	d := &DNSConfig{}
+	policy := &ClientPolicy{
+		MinTTL: durationPtr(time.Minute),
+		MaxTTL: durationPtr(time.Hour),
+	}
+
+	for _, test := range []struct {
+		requested int
+		want      time.Duration
+	}{
+		{120, 2 * time.Minute},
+		{1, time.Minute},
+		{86400, time.Hour},
+		{math.MaxInt, time.Hour},
+	} {
+		ttl := d.recordTTL(policy, "example.com.", intPtr(test.requested))
+		if ttl != test.want {
+			t.Errorf("requested %d: got %s, want %s", test.requested, ttl, test.want)
+		}
+	}
+}
+
+func TestRecordTTLZoneRange(t *testing.T) {
+	d := &DNSConfig{
+		Zones: map[string]*ZoneConfig{
+			"example.com": {MaxTTL: durationPtr(5 * time.Minute)},
+		},
+	}
+	policy := &ClientPolicy{MaxTTL: durationPtr(time.Hour)}
+
+	ttl := d.recordTTL(policy, "example.com.", intPtr(1800))
+	if ttl != 5*time.Minute {
+		t.Errorf("got %s, want 5m", ttl)
+	}
+}
+
+func TestTTLSeconds(t *testing.T) {
+	if ttlSeconds(0) != nil {
+		t.Error("expected nil for the provider's default TTL")
+	}
+	if got := ttlSeconds(90 * time.Second); got == nil || *got != 90 {
+		t.Errorf("got %v, want 90", got)
+	}
+}
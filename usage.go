@@ -0,0 +1,355 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/liujed/goutil/optionals"
+	"go.uber.org/zap"
+)
+
+// Limits how often a user can make requests.
+type AccountLimits struct {
+	// The sustained number of requests per minute that the user can make.
+	// Optional. If omitted, then the request rate is not limited.
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+
+	// The number of requests that the user can make in a burst, above the
+	// sustained rate. Defaults to the value of [RequestsPerMinute].
+	Burst int `json:"burst,omitempty"`
+
+	// The number of records that the user can present per UTC day. Optional. If
+	// omitted, then there is no daily quota.
+	PresentsPerDay int `json:"presents_per_day,omitempty"`
+
+	// The number of records that the user can have presented at once without
+	// cleaning them up. Optional. If omitted, then there is no limit.
+	MaxOutstandingRecords int `json:"max_outstanding_records,omitempty"`
+}
+
+// Records that are presented but never cleaned up stop counting against the
+// outstanding-record limit after this long.
+const outstandingRecordLifetime = time.Hour
+
+// Holds the state of each user's usage. Shared across config reloads, so that
+// counters are not reset when the configuration changes.
+var usagePool = caddy.NewUsagePool()
+
+// The prefix for keys in Caddy storage at which usage state is persisted.
+const usageStoragePrefix = "dns01proxy/usage"
+
+// How long after a change to a user's usage state it is persisted. Changes made
+// in the meantime are persisted along with it.
+const usageSaveDelay = 5 * time.Second
+
+// Tracks each user's usage against their limits.
+type usageTracker struct {
+	// Maps each limited user's ID to their usage state.
+	accounts map[string]*accountUsage
+}
+
+// Sets up usage tracking for each user in the registry that has limits
+// configured. If persist is true, then usage state is loaded from and saved to
+// Caddy storage.
+func (t *usageTracker) Provision(
+	ctx caddy.Context,
+	registry *ClientRegistry,
+	persist bool,
+) error {
+	var storage certmagic.Storage
+	if persist {
+		storage = ctx.Storage()
+	}
+
+	t.accounts = map[string]*accountUsage{}
+	for userID, policy := range registry.clients {
+		if policy.Limits == nil {
+			continue
+		}
+
+		// Usage state that is persisted is kept apart from usage state that isn't,
+		// so that turning on persistence takes effect.
+		poolKey := fmt.Sprintf("%t/%s", persist, userID)
+		usage, _, err := usagePool.LoadOrNew(
+			poolKey,
+			func() (caddy.Destructor, error) {
+				return loadAccountUsage(ctx, storage, userID, poolKey)
+			},
+		)
+		if err != nil {
+			return fmt.Errorf(
+				"unable to load usage state for user ID %q: %w",
+				userID,
+				err,
+			)
+		}
+		t.accounts[userID] = usage.(*accountUsage)
+	}
+
+	return nil
+}
+
+// Releases this tracker's references to shared usage state.
+func (t *usageTracker) Cleanup() error {
+	var errs []error
+	for _, usage := range t.accounts {
+		_, err := usagePool.Delete(usage.poolKey)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks whether the given user can make a request in the given mode, given
+// their limits. If so, returns None, along with a function that must be called
+// exactly once with the outcome of the request, including when the request is
+// denied later on. Otherwise, returns the reason for denial.
+func (t *usageTracker) Reserve(
+	userID string,
+	limits *AccountLimits,
+	mode handlerMode,
+	reqBody RequestBody,
+) (optionals.Optional[DenyReason], func(success bool)) {
+	usage, exists := t.accounts[userID]
+	if !exists || limits == nil {
+		return optionals.None[DenyReason](), func(bool) {}
+	}
+	return usage.reserve(*limits, mode, reqBody, time.Now())
+}
+
+// The usage state of a single user. Safe for concurrent use.
+type accountUsage struct {
+	// The key for this in [usagePool].
+	poolKey string
+
+	mu    sync.Mutex
+	state accountUsageState
+
+	// Where the state is persisted. Optional.
+	storage    certmagic.Storage
+	storageKey string
+
+	// Persists the state after a change, if storage is configured. Nil unless a
+	// change is waiting to be persisted.
+	saveTimer *time.Timer
+
+	// Serializes writes to storage, so that an older state can't overwrite a
+	// newer one.
+	saveMu sync.Mutex
+}
+
+var _ caddy.Destructor = (*accountUsage)(nil)
+
+// The serialized form of a user's usage state.
+type accountUsageState struct {
+	// The number of requests remaining in the user's token bucket.
+	Tokens float64 `json:"tokens"`
+
+	// When the token bucket was last refilled. If zero, then the token bucket is
+	// full.
+	LastRefill time.Time `json:"last_refill"`
+
+	// The start of the UTC day for which presents are being counted.
+	Day time.Time `json:"day"`
+
+	// The number of records presented during [Day].
+	Presents int `json:"presents"`
+
+	// Maps each outstanding record to the time at which it was presented.
+	Outstanding map[string]time.Time `json:"outstanding,omitempty"`
+}
+
+// Loads a user's usage state from storage, if given and present. Otherwise,
+// returns a fresh state.
+func loadAccountUsage(
+	ctx context.Context,
+	storage certmagic.Storage,
+	userID string,
+	poolKey string,
+) (*accountUsage, error) {
+	result := &accountUsage{
+		poolKey:    poolKey,
+		storage:    storage,
+		storageKey: usageStoragePrefix + "/" + url.PathEscape(userID) + ".json",
+	}
+	if storage == nil {
+		return result, nil
+	}
+
+	stateJSON, err := storage.Load(ctx, result.storageKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(stateJSON, &result.state)
+	if err != nil {
+		// Start afresh rather than refusing to start.
+		caddy.Log().Warn(
+			"discarding unreadable usage state",
+			zap.String("user_id", userID),
+			zap.Error(err),
+		)
+		result.state = accountUsageState{}
+	}
+	return result, nil
+}
+
+// Persists any change to the usage state that is waiting to be persisted.
+func (u *accountUsage) Destruct() error {
+	u.mu.Lock()
+	pending := u.saveTimer != nil && u.saveTimer.Stop()
+	u.saveTimer = nil
+	u.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	return u.save()
+}
+
+// Schedules the usage state to be persisted, if storage is configured. Must be
+// called with mu held, after every change to the state, so that usage isn't
+// lost if Caddy exits without shutting down cleanly.
+func (u *accountUsage) changed() {
+	if u.storage == nil || u.saveTimer != nil {
+		return
+	}
+	u.saveTimer = time.AfterFunc(usageSaveDelay, func() {
+		err := u.save()
+		if err != nil {
+			caddy.Log().Error(
+				"unable to persist usage state",
+				zap.String("storage_key", u.storageKey),
+				zap.Error(err),
+			)
+		}
+	})
+}
+
+// Writes the current usage state to storage. Later changes schedule another
+// write.
+func (u *accountUsage) save() error {
+	u.saveMu.Lock()
+	defer u.saveMu.Unlock()
+
+	u.mu.Lock()
+	u.saveTimer = nil
+	stateJSON, err := json.Marshal(u.state)
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return u.storage.Store(context.Background(), u.storageKey, stateJSON)
+}
+
+func (u *accountUsage) reserve(
+	limits AccountLimits,
+	mode handlerMode,
+	reqBody RequestBody,
+	now time.Time,
+) (optionals.Optional[DenyReason], func(success bool)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.changed()
+
+	// Refill the token bucket and take a token.
+	if limits.RequestsPerMinute > 0 {
+		burst := float64(limits.Burst)
+		if burst <= 0 {
+			burst = float64(limits.RequestsPerMinute)
+		}
+		if u.state.LastRefill.IsZero() {
+			u.state.Tokens = burst
+		} else {
+			elapsed := now.Sub(u.state.LastRefill).Minutes()
+			u.state.Tokens = min(
+				burst,
+				u.state.Tokens+elapsed*float64(limits.RequestsPerMinute),
+			)
+		}
+		u.state.LastRefill = now
+
+		if u.state.Tokens < 1 {
+			return optionals.Some(DenyRateLimited), nil
+		}
+		u.state.Tokens--
+	}
+
+	recordKey := reqBody.ChallengeFQDN + " " + reqBody.Value
+	switch mode {
+	case hmPresent:
+		// Start a new day, if needed.
+		day := now.UTC().Truncate(24 * time.Hour)
+		if !u.state.Day.Equal(day) {
+			u.state.Day = day
+			u.state.Presents = 0
+		}
+		if limits.PresentsPerDay > 0 && u.state.Presents >= limits.PresentsPerDay {
+			return optionals.Some(DenyQuotaExceeded), nil
+		}
+
+		// Forget about stale records.
+		for key, presentedAt := range u.state.Outstanding {
+			if now.Sub(presentedAt) > outstandingRecordLifetime {
+				delete(u.state.Outstanding, key)
+			}
+		}
+		_, alreadyOutstanding := u.state.Outstanding[recordKey]
+		if limits.MaxOutstandingRecords > 0 && !alreadyOutstanding &&
+			len(u.state.Outstanding) >= limits.MaxOutstandingRecords {
+			return optionals.Some(DenyTooManyOutstanding), nil
+		}
+
+		// Take the quota and the outstanding-record slot now, so that concurrent
+		// requests can't overshoot the limits. They are given back if the request
+		// fails.
+		u.state.Presents++
+		if u.state.Outstanding == nil {
+			u.state.Outstanding = map[string]time.Time{}
+		}
+		if !alreadyOutstanding {
+			u.state.Outstanding[recordKey] = now
+		}
+
+		return optionals.None[DenyReason](), func(success bool) {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			defer u.changed()
+			if success {
+				u.state.Outstanding[recordKey] = now
+				return
+			}
+			if u.state.Day.Equal(day) && u.state.Presents > 0 {
+				u.state.Presents--
+			}
+			if !alreadyOutstanding {
+				delete(u.state.Outstanding, recordKey)
+			}
+		}
+
+	case hmCleanup:
+		return optionals.None[DenyReason](), func(success bool) {
+			if !success {
+				return
+			}
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			defer u.changed()
+			delete(u.state.Outstanding, recordKey)
+		}
+	}
+
+	return optionals.None[DenyReason](), func(bool) {}
+}
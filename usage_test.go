@@ -0,0 +1,224 @@
+package caddydns01proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/liujed/goutil/optionals"
+)
+
+func testRequestBody(value string) RequestBody {
+	return RequestBody{
+		ChallengeFQDN: "_acme-challenge.example.com.",
+		Value:         value,
+	}
+}
+
+func expectDenyReason(
+	t *testing.T,
+	got optionals.Optional[DenyReason],
+	want optionals.Optional[DenyReason],
+) {
+	t.Helper()
+	gotReason, gotDenied := got.Get()
+	wantReason, wantDenied := want.Get()
+	if gotDenied != wantDenied || gotReason != wantReason {
+		t.Fatalf("got deny reason %v, want %v", got, want)
+	}
+}
+
+func TestUsageRateLimit(t *testing.T) {
+	u := &accountUsage{}
+	limits := AccountLimits{RequestsPerMinute: 60, Burst: 2}
+	now := time.Now()
+
+	for range 2 {
+		denyReason, commit := u.reserve(limits, hmCleanup, testRequestBody("a"), now)
+		expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+		commit(true)
+	}
+	denyReason, _ := u.reserve(limits, hmCleanup, testRequestBody("a"), now)
+	expectDenyReason(t, denyReason, optionals.Some(DenyRateLimited))
+
+	// One request per second is refilled.
+	denyReason, commit := u.reserve(
+		limits,
+		hmCleanup,
+		testRequestBody("a"),
+		now.Add(time.Second),
+	)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+}
+
+func TestUsageDailyQuota(t *testing.T) {
+	u := &accountUsage{}
+	limits := AccountLimits{PresentsPerDay: 2}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, value := range []string{"a", "b"} {
+		denyReason, commit := u.reserve(limits, hmPresent, testRequestBody(value), now)
+		expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+		commit(true)
+	}
+	denyReason, _ := u.reserve(limits, hmPresent, testRequestBody("c"), now)
+	expectDenyReason(t, denyReason, optionals.Some(DenyQuotaExceeded))
+
+	// The quota resets at the start of the next UTC day.
+	denyReason, commit := u.reserve(
+		limits,
+		hmPresent,
+		testRequestBody("c"),
+		now.Add(12*time.Hour),
+	)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+}
+
+func TestUsageFailedPresentDoesNotCount(t *testing.T) {
+	u := &accountUsage{}
+	limits := AccountLimits{PresentsPerDay: 1, MaxOutstandingRecords: 1}
+	now := time.Now()
+
+	denyReason, commit := u.reserve(limits, hmPresent, testRequestBody("a"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(false)
+
+	denyReason, commit = u.reserve(limits, hmPresent, testRequestBody("b"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+}
+
+func TestUsageOutstandingRecords(t *testing.T) {
+	u := &accountUsage{}
+	limits := AccountLimits{MaxOutstandingRecords: 1}
+	now := time.Now()
+
+	denyReason, commit := u.reserve(limits, hmPresent, testRequestBody("a"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+
+	denyReason, _ = u.reserve(limits, hmPresent, testRequestBody("b"), now)
+	expectDenyReason(t, denyReason, optionals.Some(DenyTooManyOutstanding))
+
+	// Presenting the same record again doesn't take another slot.
+	denyReason, commit = u.reserve(limits, hmPresent, testRequestBody("a"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+
+	// Cleaning up frees the slot.
+	denyReason, commit = u.reserve(limits, hmCleanup, testRequestBody("a"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+	denyReason, commit = u.reserve(limits, hmPresent, testRequestBody("b"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+
+	// Records that are never cleaned up are eventually forgotten.
+	denyReason, commit = u.reserve(
+		limits,
+		hmPresent,
+		testRequestBody("c"),
+		now.Add(outstandingRecordLifetime+time.Minute),
+	)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+}
+
+func TestUsageConcurrentPresentsTakeSlots(t *testing.T) {
+	u := &accountUsage{}
+	limits := AccountLimits{MaxOutstandingRecords: 1}
+	now := time.Now()
+
+	// The first present is still in progress when the second arrives.
+	denyReason, commitFirst := u.reserve(limits, hmPresent, testRequestBody("a"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	denyReason, _ = u.reserve(limits, hmPresent, testRequestBody("b"), now)
+	expectDenyReason(t, denyReason, optionals.Some(DenyTooManyOutstanding))
+
+	// Once the first fails, its slot is released.
+	commitFirst(false)
+	denyReason, commit := u.reserve(limits, hmPresent, testRequestBody("b"), now)
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+}
+
+func TestUsagePersistedOnChange(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u, err := loadAccountUsage(ctx, storage, "alice", "true/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := AccountLimits{PresentsPerDay: 2}
+
+	denyReason, commit := u.reserve(limits, hmPresent, testRequestBody("a"), time.Now())
+	expectDenyReason(t, denyReason, optionals.None[DenyReason]())
+	commit(true)
+
+	// The change is persisted without waiting for the state to be destroyed.
+	// Skip the delay, then wait for the write to finish.
+	u.mu.Lock()
+	if u.saveTimer == nil {
+		u.mu.Unlock()
+		t.Fatal("change was not scheduled to be persisted")
+	}
+	u.saveTimer.Reset(0)
+	u.mu.Unlock()
+	for pending := true; pending; {
+		time.Sleep(time.Millisecond)
+		u.mu.Lock()
+		pending = u.saveTimer != nil
+		u.mu.Unlock()
+	}
+	u.saveMu.Lock()
+	u.saveMu.Unlock()
+
+	loaded, err := loadAccountUsage(ctx, storage, "alice", "true/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.state.Presents != 1 {
+		t.Errorf("got %d persisted presents, want 1", loaded.state.Presents)
+	}
+}
+
+func TestUsagePoolKeyedByPersistence(t *testing.T) {
+	registry := newTestRegistry(t, []RawAccount{{
+		ClientPolicy: ClientPolicy{
+			UserID:          "alice",
+			AllowDomainsRaw: []string{"example.com"},
+			Limits:          &AccountLimits{PresentsPerDay: 1},
+		},
+	}}, nil)
+
+	// Usage state that is persisted isn't reused when persistence is off.
+	persisted, _, err := usagePool.LoadOrNew(
+		"true/alice",
+		func() (caddy.Destructor, error) {
+			return loadAccountUsage(
+				context.Background(),
+				&certmagic.FileStorage{Path: t.TempDir()},
+				"alice",
+				"true/alice",
+			)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer usagePool.Delete("true/alice")
+
+	var tracker usageTracker
+	err = tracker.Provision(newTestContext(t), registry, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Cleanup()
+	if tracker.accounts["alice"] == persisted {
+		t.Error("got persisted usage state with persistence off")
+	}
+}
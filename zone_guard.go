@@ -0,0 +1,90 @@
+package caddydns01proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Restricts the DNS zones in which challenges can be answered, independently of
+// account policies. Each zone also covers its subzones.
+type zoneGuard struct {
+	// Optional. If empty, then all zones are allowed, except denied ones.
+	allowed []string
+
+	denied []string
+}
+
+func newZoneGuard(allowed, denied []string) zoneGuard {
+	normalizeAll := func(zones []string) []string {
+		result := make([]string, 0, len(zones))
+		for _, zone := range zones {
+			result = append(result, normalizeZone(zone))
+		}
+		return result
+	}
+
+	return zoneGuard{
+		allowed: normalizeAll(allowed),
+		denied:  normalizeAll(denied),
+	}
+}
+
+// Determines whether challenges can be answered in the given zone.
+func (g zoneGuard) allowsZone(zone string) bool {
+	zone = normalizeZone(zone)
+	if withinAnyZone(zone, g.denied) {
+		return false
+	}
+	return len(g.allowed) == 0 || withinAnyZone(zone, g.allowed)
+}
+
+// Checks that each of the given domains, taken from an `allow_domains` list,
+// falls within the allowed zones. The domains can contain wildcards and
+// placeholders, in which case the part after the last wildcard or placeholder
+// must fall within an allowed zone.
+//
+// Allowed domain patterns can't be checked this way, so only the request-time
+// zone check applies to them.
+func (g zoneGuard) checkAllowDomains(owner string, allowDomains []string) error {
+	if len(g.allowed) == 0 {
+		return nil
+	}
+
+	for _, domain := range allowDomains {
+		name := literalDomainSuffix(domain)
+		if name == "" || !withinAnyZone(normalizeZone(name), g.allowed) {
+			return fmt.Errorf(
+				"allowed domain %q for %s is outside the allowed zones",
+				domain,
+				owner,
+			)
+		}
+	}
+	return nil
+}
+
+// Returns the trailing labels of the given domain that contain no wildcards or
+// placeholders. This is what remains fixed, however the domain is matched or
+// filled in.
+func literalDomainSuffix(domain string) string {
+	// Strip off any subdomain marker.
+	domain = strings.TrimPrefix(domain, ".")
+
+	labels := strings.Split(domain, ".")
+	i := len(labels)
+	for i > 0 && !strings.ContainsAny(labels[i-1], "*{}") {
+		i--
+	}
+	return strings.Join(labels[i:], ".")
+}
+
+// Determines whether the given normalized name is equal to, or a subdomain of,
+// any of the given normalized zones.
+func withinAnyZone(name string, zones []string) bool {
+	for _, zone := range zones {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
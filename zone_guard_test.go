@@ -0,0 +1,63 @@
+package caddydns01proxy
+
+import "testing"
+
+func TestZoneGuardAllowsZone(t *testing.T) {
+	g := newZoneGuard(
+		[]string{"Example.com."},
+		[]string{"internal.example.com"},
+	)
+
+	for _, test := range []struct {
+		zone string
+		want bool
+	}{
+		{"example.com.", true},
+		{"sub.example.com.", true},
+		{"internal.example.com.", false},
+		{"a.internal.example.com.", false},
+		{"example.org.", false},
+		{"notexample.com.", false},
+	} {
+		if got := g.allowsZone(test.zone); got != test.want {
+			t.Errorf("allowsZone(%q) = %v, want %v", test.zone, got, test.want)
+		}
+	}
+}
+
+func TestZoneGuardCheckAllowDomains(t *testing.T) {
+	g := newZoneGuard([]string{"example.com"}, nil)
+
+	for _, test := range []struct {
+		domain  string
+		wantErr bool
+	}{
+		{"example.com", false},
+		{"*.example.com", false},
+		{".example.com", false},
+		{"host.example.com", false},
+		{"{user}.example.com", false},
+		{"{claims.repo}.ci.example.com", false},
+		{"*.{user}.example.com", false},
+		{"example.org", true},
+		{"*.com", true},
+		{"{user}.com", true},
+		{"example.{header.tld}", true},
+		{"{user}", true},
+	} {
+		err := g.checkAllowDomains("test", []string{test.domain})
+		if (err != nil) != test.wantErr {
+			t.Errorf("checkAllowDomains(%q) = %v, wantErr %v", test.domain, err, test.wantErr)
+		}
+	}
+}
+
+func TestZoneGuardUnrestricted(t *testing.T) {
+	g := newZoneGuard(nil, nil)
+	if !g.allowsZone("example.com.") {
+		t.Error("expected all zones to be allowed")
+	}
+	if err := g.checkAllowDomains("test", []string{"{user}"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}